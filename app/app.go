@@ -1,66 +1,126 @@
 package app
 
 import (
+	"fmt"
+	"github.com/fztcjjl/tiger/pkg/middleware/grpc/logging"
 	"github.com/fztcjjl/tiger/pkg/middleware/grpc/zap"
 	"github.com/fztcjjl/tiger/pkg/trace"
+	"github.com/fztcjjl/tiger/trpc/client"
 	log "github.com/fztcjjl/tiger/trpc/logger"
 	"github.com/fztcjjl/tiger/trpc/registry"
 	"github.com/fztcjjl/tiger/trpc/registry/etcd"
+	"github.com/fztcjjl/tiger/trpc/registry/mdns"
 	"github.com/fztcjjl/tiger/trpc/server"
 	"github.com/fztcjjl/tiger/trpc/web"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_recovery "github.com/grpc-ecosystem/go-grpc-middleware/recovery"
 	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/opentracing/opentracing-go"
 	"github.com/spf13/viper"
+	"google.golang.org/grpc"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type App struct {
 	opts      Options
 	config    *Config
+	registry  registry.Registry
 	server    *server.Server
 	webServer *web.Server
 }
 
-func NewApp(opt ...Option) *App {
+// NewApp loads the config and sets up the servers. A missing config file
+// is not an error, the app then runs with the mdns registry and no tracer.
+func NewApp(opt ...Option) (*App, error) {
 	app := new(App)
-	app.loadConfig()
+	app.opts = newOptions(opt...)
+	if err := app.loadConfig(); err != nil {
+		return nil, err
+	}
 	app.initLogger()
-	app.initTracer()
-	options := newOptions(opt...)
-	app.opts = options
-
-	var r registry.Registry
-	addrs := app.config.GetStringSlice("etcd")
-	if len(addrs) > 0 {
-		r = etcd.NewRegistry(registry.Addrs(addrs...))
+	if err := app.initTracer(); err != nil {
+		return nil, err
 	}
+	if err := app.initRegistry(); err != nil {
+		return nil, err
+	}
+	r := app.registry
+
 	name := app.config.GetString("app.name")
 	version := app.config.GetString("app.version")
+
+	if app.opts.ShutdownTimeout == 0 {
+		app.opts.ShutdownTimeout = app.config.GetDuration("app.shutdown_timeout")
+	}
+	if app.opts.GracePeriod == 0 {
+		app.opts.GracePeriod = app.config.GetDuration("app.grace_period")
+	}
+
 	if app.opts.EnableHttp {
-		app.webServer = web.NewServer(
-			web.Name("web."+name),
+		webOpts := []web.Option{
+			web.Name("web." + name),
 			web.Version(version),
 			web.Registry(r),
-		)
+			web.GracePeriod(app.opts.GracePeriod),
+		}
+		if app.opts.ShutdownTimeout > 0 {
+			webOpts = append(webOpts, web.ShutdownTimeout(app.opts.ShutdownTimeout))
+		}
+		app.webServer = web.NewServer(append(webOpts, app.opts.WebOptions...)...)
 	}
 
-	app.server = server.NewServer(
-		server.Name("srv."+name),
+	zapLogger := zap.Logger()
+	tracing := grpc_opentracing.WithTracer(app.tracer())
+	srvOpts := []server.Option{
+		server.Name("srv." + name),
 		server.Version(version),
 		server.Registry(r),
-		server.Interceptors(
-			grpc_opentracing.UnaryServerInterceptor(),
+		server.GracePeriod(app.opts.GracePeriod),
+		server.Interceptors(append([]grpc.UnaryServerInterceptor{
+			grpc_opentracing.UnaryServerInterceptor(tracing),
+			logging.UnaryServerInterceptor(),
 			grpc_prometheus.UnaryServerInterceptor,
-			grpc_zap.UnaryServerInterceptor(zap.Logger()),
+			grpc_zap.UnaryServerInterceptor(zapLogger),
 			grpc_recovery.UnaryServerInterceptor(),
-		),
-	)
+		}, app.opts.UnaryInterceptors...)...),
+		server.StreamInterceptors(append([]grpc.StreamServerInterceptor{
+			grpc_opentracing.StreamServerInterceptor(tracing),
+			logging.StreamServerInterceptor(),
+			grpc_prometheus.StreamServerInterceptor,
+			grpc_zap.StreamServerInterceptor(zapLogger),
+			grpc_recovery.StreamServerInterceptor(),
+		}, app.opts.StreamInterceptors...)...),
+	}
+	if app.opts.ShutdownTimeout > 0 {
+		srvOpts = append(srvOpts, server.ShutdownTimeout(app.opts.ShutdownTimeout))
+	}
+	app.server = server.NewServer(append(srvOpts, app.opts.ServerOptions...)...)
+
+	return app, nil
+}
+
+// NewClient returns a client for service which discovers nodes through the
+// app registry and traces calls with the app tracer
+func (a *App) NewClient(service string, opt ...client.Option) *client.Client {
+	tracing := grpc_opentracing.WithTracer(a.tracer())
+	opts := []client.Option{
+		client.Interceptors(append([]grpc.UnaryClientInterceptor{
+			grpc_opentracing.UnaryClientInterceptor(tracing),
+		}, a.opts.ClientUnaryInterceptors...)...),
+		client.StreamInterceptors(append([]grpc.StreamClientInterceptor{
+			grpc_opentracing.StreamClientInterceptor(tracing),
+		}, a.opts.ClientStreamInterceptors...)...),
+	}
+	if a.registry != nil {
+		opts = append(opts, client.Registry(a.registry))
+	}
 
-	return app
+	return client.NewClient(service, append(opts, opt...)...)
 }
 
 func (a *App) GetServer() *server.Server {
@@ -81,46 +141,179 @@ func (a *App) Init(opt ...Option) {
 	}
 }
 
-func (a *App) loadConfig() {
+func (a *App) loadConfig() error {
 	v := viper.New()
-	v.AddConfigPath("conf")
-	v.SetConfigName("config")
+	for _, p := range a.opts.ConfigPaths {
+		v.AddConfigPath(p)
+	}
+	v.SetConfigName(a.opts.ConfigName)
+	if len(a.opts.ConfigType) > 0 {
+		v.SetConfigType(a.opts.ConfigType)
+	}
+
+	a.config = newConfig(v)
+
 	if err := v.ReadInConfig(); err != nil {
-		log.Fatal(err)
-		return
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			log.Infof("No config file %s found in %v, using defaults", a.opts.ConfigName, a.opts.ConfigPaths)
+			return nil
+		}
+		return &ConfigError{Err: err}
 	}
 
-	a.config = &Config{Viper: v}
-	return
+	a.config.watchFile()
+
+	return nil
 }
 
 func (a *App) initLogger() {
+	if a.opts.Logger != nil {
+		log.DefaultLogger = a.opts.Logger
+	}
 
+	setLevel := func(v string) {
+		if len(v) == 0 {
+			return
+		}
+		lvl, err := log.GetLevel(v)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		if err := log.Init(log.WithLevel(lvl)); err != nil {
+			log.Error(err)
+		}
+	}
+
+	// the level can be changed at runtime through the config file
+	setLevel(a.config.GetString("logger.level"))
+	a.config.Watch("logger.level", func(old, new interface{}) {
+		log.Infof("Changing log level from %v to %v", old, new)
+		setLevel(a.config.GetString("logger.level"))
+	})
 }
 
-func (a *App) initTracer() {
-	n := a.config.GetString("app.name")
+func (a *App) initTracer() error {
+	if a.opts.Tracer != nil {
+		opentracing.SetGlobalTracer(a.opts.Tracer)
+		return nil
+	}
+
+	// tracing is off unless a jaeger agent is configured
 	addr := a.config.GetString("jaeger.address")
-	trace.Init(n, addr)
+	if len(addr) == 0 {
+		return nil
+	}
+
+	n := a.config.GetString("app.name")
+	if _, err := trace.Init(n, addr); err != nil {
+		return &TracerError{Err: err}
+	}
+	return nil
+}
+
+// etcdConfig is the etcd section of the config file, which may also be
+// just the list of addresses
+type etcdConfig struct {
+	Addrs    []string      `mapstructure:"addrs"`
+	Prefix   string        `mapstructure:"prefix"`
+	Encoding string        `mapstructure:"encoding"`
+	Username string        `mapstructure:"username"`
+	Password string        `mapstructure:"password"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	TLS      struct {
+		CAFile   string `mapstructure:"ca_file"`
+		CertFile string `mapstructure:"cert_file"`
+		KeyFile  string `mapstructure:"key_file"`
+	} `mapstructure:"tls"`
+}
+
+// initRegistry uses the registry option if set, then etcd if its
+// addresses are configured and falls back to mdns
+func (a *App) initRegistry() error {
+	if a.opts.Registry != nil {
+		a.registry = a.opts.Registry
+		return nil
+	}
+
+	var cfg etcdConfig
+	if a.config.IsSet("etcd.addrs") {
+		if err := a.config.Scan("etcd", &cfg); err != nil {
+			return &RegistryError{Err: err}
+		}
+	} else {
+		cfg.Addrs = a.config.GetStringSlice("etcd")
+	}
+	if len(cfg.Addrs) == 0 {
+		a.registry = mdns.NewRegistry()
+		return nil
+	}
+
+	opts := []registry.Option{registry.Addrs(cfg.Addrs...)}
+	if len(cfg.Prefix) > 0 {
+		opts = append(opts, etcd.Prefix(cfg.Prefix))
+	}
+	if len(cfg.Encoding) > 0 {
+		c, ok := etcd.GetCodec(cfg.Encoding)
+		if !ok {
+			return &RegistryError{Err: fmt.Errorf("unknown etcd encoding %q", cfg.Encoding)}
+		}
+		opts = append(opts, etcd.Encoding(c))
+	}
+	if len(cfg.Username) > 0 {
+		opts = append(opts, etcd.Auth(cfg.Username, cfg.Password))
+	}
+	if tls := cfg.TLS; len(tls.CAFile) > 0 || len(tls.CertFile) > 0 {
+		opts = append(opts, etcd.TLSFiles(tls.CAFile, tls.CertFile, tls.KeyFile))
+	}
+	if cfg.Timeout > 0 {
+		opts = append(opts, registry.Timeout(cfg.Timeout))
+	}
+
+	r := etcd.NewRegistry()
+	if err := r.Init(opts...); err != nil {
+		return &RegistryError{Err: err}
+	}
+	a.registry = r
+	return nil
+}
+
+// tracer returns the tracer used by the app interceptors
+func (a *App) tracer() opentracing.Tracer {
+	if a.opts.Tracer != nil {
+		return a.opts.Tracer
+	}
+	return opentracing.GlobalTracer()
+}
+
+// runHooks runs every hook, stopping at the first error
+func runHooks(hooks []func() error) error {
+	for _, fn := range hooks {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (a *App) GetConfig() *Config {
 	return a.config
 }
 
+// Run starts the servers and blocks until a signal is received or the
+// context is cancelled. Once the servers started they are always stopped,
+// even if a hook fails, so the node doesn't stay registered.
 func (a *App) Run() error {
 	log.Infof("Starting [service] %s", a.Name())
-	if a.server != nil {
-		if err := a.server.Start(); err != nil {
-			return err
-		}
+
+	if err := runHooks(a.opts.BeforeStart); err != nil {
+		return err
 	}
 
-	if a.webServer != nil {
-		if err := a.webServer.Start(); err != nil {
-			return err
-		}
+	if err := a.start(); err != nil {
+		return a.stop(err)
 	}
+
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 
@@ -131,13 +324,69 @@ func (a *App) Run() error {
 	case <-a.opts.Context.Done():
 	}
 
+	return a.stop(runHooks(a.opts.BeforeStop))
+}
+
+// start starts the servers then runs the after start hooks
+func (a *App) start() error {
 	if a.server != nil {
-		a.server.Stop()
+		if err := a.server.Start(); err != nil {
+			return err
+		}
 	}
 
 	if a.webServer != nil {
-		a.webServer.Stop()
+		if err := a.webServer.Start(); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return runHooks(a.opts.AfterStart)
+}
+
+// stop stops the servers and runs the after stop hooks. err is the error
+// which ended the run, it is returned along with the stop error if any.
+func (a *App) stop(err error) error {
+	// drain both servers at once so the shutdown takes at most the
+	// configured timeout rather than the sum of both
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+
+	if a.server != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- a.server.Stop()
+		}()
+	}
+
+	if a.webServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- a.webServer.Stop()
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	var stopErr error
+	for serr := range errs {
+		if serr != nil && stopErr == nil {
+			stopErr = serr
+		}
+	}
+
+	if herr := runHooks(a.opts.AfterStop); herr != nil && stopErr == nil {
+		stopErr = herr
+	}
+
+	switch {
+	case err == nil:
+		return stopErr
+	case stopErr == nil:
+		return err
+	}
+	return &RunError{Err: err, StopErr: stopErr}
 }
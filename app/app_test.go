@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/registry/memory"
+	"github.com/fztcjjl/tiger/trpc/server"
+)
+
+func TestNewAppWithoutConfig(t *testing.T) {
+	a, err := NewApp(ConfigPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.registry == nil || a.registry.String() != "mdns" {
+		t.Fatalf("Expected mdns registry got %v", a.registry)
+	}
+}
+
+func TestNewAppConfigError(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.yaml"), []byte("app: [name"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewApp(ConfigPath(dir))
+
+	var cerr *ConfigError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("Expected config error got %v", err)
+	}
+}
+
+func TestNewAppConfig(t *testing.T) {
+	dir := t.TempDir()
+	cfg := []byte(`{"app": {"name": "test", "version": "1.0.0"}}`)
+	if err := ioutil.WriteFile(filepath.Join(dir, "app"), cfg, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewApp(ConfigPath(dir), ConfigName("app"), ConfigType("json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Name() != "test" {
+		t.Fatalf("Expected name test got %s", a.Name())
+	}
+	if v := a.GetServer().Options().Version; v != "1.0.0" {
+		t.Fatalf("Expected version 1.0.0 got %s", v)
+	}
+}
+
+func TestRunHookError(t *testing.T) {
+	hookErr := errors.New("hook failed")
+
+	for name, opt := range map[string]func(fn func() error) Option{
+		"AfterStart": AfterStart,
+		"BeforeStop": BeforeStop,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := []byte(`{"app": {"name": "test"}}`)
+			if err := ioutil.WriteFile(filepath.Join(dir, "app"), cfg, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			var stopped bool
+			r := memory.NewRegistry()
+			defer r.Stop()
+			a, err := NewApp(
+				ConfigPath(dir), ConfigName("app"), ConfigType("json"),
+				Context(ctx),
+				Registry(r),
+				ServerOptions(server.Address("127.0.0.1:0")),
+				opt(func() error { return hookErr }),
+				AfterStop(func() error {
+					stopped = true
+					return nil
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := a.Run(); err != hookErr {
+				t.Fatalf("Expected hook error got %v", err)
+			}
+			if !stopped {
+				t.Fatal("Expected the after stop hooks to run")
+			}
+			if _, err := r.GetService("srv.test"); err != registry.ErrNotFound {
+				t.Fatalf("Expected the node to be deregistered got %v", err)
+			}
+		})
+	}
+}
@@ -1,9 +1,111 @@
 package app
 
 import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/go-playground/validator/v10"
 	"github.com/spf13/viper"
 )
 
+// EnvPrefix prefixes the environment variables overriding config keys,
+// e.g. TIGER_APP_NAME overrides app.name
+const EnvPrefix = "TIGER"
+
+var validate = validator.New()
+
 type Config struct {
 	*viper.Viper
+
+	sync.Mutex
+	// watchers and the last seen values keyed by config key
+	watchers map[string][]func(old, new interface{})
+	values   map[string]interface{}
+}
+
+func newConfig(v *viper.Viper) *Config {
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	return &Config{
+		Viper:    v,
+		watchers: make(map[string][]func(old, new interface{})),
+		values:   make(map[string]interface{}),
+	}
+}
+
+// Watch calls fn with the old and new value of key every time a change
+// of the config file changes it
+func (c *Config) Watch(key string, fn func(old, new interface{})) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.values[key]; !ok {
+		c.values[key] = c.Get(key)
+	}
+	c.watchers[key] = append(c.watchers[key], fn)
+}
+
+// Scan unmarshals the section under key into dst and validates it using
+// the validate struct tags. An empty key scans the whole config.
+func (c *Config) Scan(key string, dst interface{}) error {
+	var err error
+	if len(key) == 0 {
+		err = c.Unmarshal(dst)
+	} else {
+		err = c.UnmarshalKey(key, dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(dst)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	return validate.Struct(dst)
+}
+
+// watchFile starts watching the config file for changes
+func (c *Config) watchFile() {
+	c.OnConfigChange(c.onChange)
+	c.WatchConfig()
+}
+
+func (c *Config) onChange(e fsnotify.Event) {
+	log.Infof("Config file %s changed", e.Name)
+
+	type change struct {
+		old, new interface{}
+		fns      []func(old, new interface{})
+	}
+
+	var changes []change
+
+	c.Lock()
+	for key, fns := range c.watchers {
+		old := c.values[key]
+		v := c.Get(key)
+		if reflect.DeepEqual(old, v) {
+			continue
+		}
+		c.values[key] = v
+		changes = append(changes, change{old: old, new: v, fns: fns})
+	}
+	c.Unlock()
+
+	// call outside the lock so watchers can use the config
+	for _, ch := range changes {
+		for _, fn := range ch.fns {
+			fn(ch.old, ch.new)
+		}
+	}
 }
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func testConfig(t *testing.T, data string) (*Config, string) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v := viper.New()
+	v.SetConfigFile(file)
+	c := newConfig(v)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	return c, file
+}
+
+func TestConfigScan(t *testing.T) {
+	c, _ := testConfig(t, "db:\n  addr: 127.0.0.1:3306\n  pool: 10\n")
+
+	var db struct {
+		Addr string `validate:"required"`
+		Pool int    `validate:"min=1"`
+		User string `validate:"required"`
+	}
+
+	if err := c.Scan("db", &db); err == nil {
+		t.Fatal("Expected validation error for missing user")
+	}
+	if db.Addr != "127.0.0.1:3306" || db.Pool != 10 {
+		t.Fatalf("Unexpected scan result %+v", db)
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	c, _ := testConfig(t, "app:\n  name: test\n")
+
+	os.Setenv("TIGER_APP_NAME", "env")
+	defer os.Unsetenv("TIGER_APP_NAME")
+
+	if n := c.GetString("app.name"); n != "env" {
+		t.Fatalf("Expected env override got %s", n)
+	}
+}
+
+func TestConfigWatch(t *testing.T) {
+	c, file := testConfig(t, "logger:\n  level: info\n")
+
+	changed := make(chan interface{}, 10)
+	c.Watch("logger.level", func(old, new interface{}) {
+		select {
+		case changed <- new:
+		default:
+		}
+	})
+	c.watchFile()
+
+	if err := ioutil.WriteFile(file, []byte("logger:\n  level: debug\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file may be seen half written before the final change
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case v := <-changed:
+			if v == "debug" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for config change")
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package app
+
+// ConfigError is returned by NewApp when the config file exists but
+// can't be read
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return "app: load config: " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// RegistryError is returned by NewApp when the registry can't be set up
+type RegistryError struct {
+	Err error
+}
+
+func (e *RegistryError) Error() string {
+	return "app: init registry: " + e.Err.Error()
+}
+
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// TracerError is returned by NewApp when the tracer can't be set up
+type TracerError struct {
+	Err error
+}
+
+func (e *TracerError) Error() string {
+	return "app: init tracer: " + e.Err.Error()
+}
+
+func (e *TracerError) Unwrap() error {
+	return e.Err
+}
+
+// RunError is returned by Run when a hook or server failed and stopping
+// the servers failed as well
+type RunError struct {
+	Err     error
+	StopErr error
+}
+
+func (e *RunError) Error() string {
+	return "app: run: " + e.Err.Error() + ", stop: " + e.StopErr.Error()
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
@@ -2,6 +2,14 @@ package app
 
 import (
 	"context"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/server"
+	"github.com/fztcjjl/tiger/trpc/web"
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
 )
 
 type Options struct {
@@ -9,6 +17,41 @@ type Options struct {
 	//WebServer  *web.Server
 	EnableHttp bool
 
+	// Config file lookup, conf/config.{yaml,json,...} by default
+	ConfigPaths []string
+	ConfigName  string
+	ConfigType  string
+
+	// ShutdownTimeout bounds the wait for in-flight requests on stop,
+	// the app.shutdown_timeout config key is used when not set
+	ShutdownTimeout time.Duration
+	// GracePeriod to wait after deregistering before refusing requests,
+	// the app.grace_period config key is used when not set
+	GracePeriod time.Duration
+
+	// Registry replaces the registry built from the etcd config key
+	Registry registry.Registry
+	// Logger replaces the default logger
+	Logger logger.Logger
+	// Tracer replaces the jaeger tracer built from the jaeger config keys
+	Tracer opentracing.Tracer
+
+	// Interceptors installed after the default ones
+	UnaryInterceptors        []grpc.UnaryServerInterceptor
+	StreamInterceptors       []grpc.StreamServerInterceptor
+	ClientUnaryInterceptors  []grpc.UnaryClientInterceptor
+	ClientStreamInterceptors []grpc.StreamClientInterceptor
+
+	// Extra options applied after the ones derived from the config
+	ServerOptions []server.Option
+	WebOptions    []web.Option
+
+	// Lifecycle hooks
+	BeforeStart []func() error
+	AfterStart  []func() error
+	BeforeStop  []func() error
+	AfterStop   []func() error
+
 	// Other options for implementations of the interface
 	// can be stored in a context
 	Context context.Context
@@ -17,18 +60,28 @@ type Options struct {
 func newOptions(opt ...Option) Options {
 	opts := Options{
 		//Server:  server.DefaultServer,
-		Context: context.Background(),
+		ConfigName: DefaultConfigName,
+		Context:    context.Background(),
 	}
 
 	for _, o := range opt {
 		o(&opts)
 	}
 
+	if len(opts.ConfigPaths) == 0 {
+		opts.ConfigPaths = []string{DefaultConfigPath}
+	}
+
 	return opts
 }
 
 type Option func(*Options)
 
+var (
+	DefaultConfigPath = "conf"
+	DefaultConfigName = "config"
+)
+
 func Context(ctx context.Context) Option {
 	return func(o *Options) {
 		o.Context = ctx
@@ -40,3 +93,133 @@ func WithHttp(enable bool) Option {
 		o.EnableHttp = enable
 	}
 }
+
+// ConfigPath adds a directory to search the config file in, the
+// directories are searched in the order they were added
+func ConfigPath(path string) Option {
+	return func(o *Options) {
+		o.ConfigPaths = append(o.ConfigPaths, path)
+	}
+}
+
+// ConfigName of the config file without extension
+func ConfigName(name string) Option {
+	return func(o *Options) {
+		o.ConfigName = name
+	}
+}
+
+// ConfigType of the config file e.g. yaml or json, needed when the
+// file has no extension
+func ConfigType(typ string) Option {
+	return func(o *Options) {
+		o.ConfigType = typ
+	}
+}
+
+// ShutdownTimeout to wait for in-flight requests before the servers are
+// stopped forcefully
+func ShutdownTimeout(t time.Duration) Option {
+	return func(o *Options) {
+		o.ShutdownTimeout = t
+	}
+}
+
+// GracePeriod to wait after deregistering so clients stop routing to
+// the servers before they refuse new requests
+func GracePeriod(t time.Duration) Option {
+	return func(o *Options) {
+		o.GracePeriod = t
+	}
+}
+
+// Registry used by the servers and clients instead of the configured one
+func Registry(r registry.Registry) Option {
+	return func(o *Options) {
+		o.Registry = r
+	}
+}
+
+// Logger to use as the default logger
+func Logger(l logger.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// Tracer to use instead of the configured jaeger tracer
+func Tracer(t opentracing.Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = t
+	}
+}
+
+// Interceptors to chain after the default unary server interceptors
+func Interceptors(interceptors ...grpc.UnaryServerInterceptor) Option {
+	return func(o *Options) {
+		o.UnaryInterceptors = append(o.UnaryInterceptors, interceptors...)
+	}
+}
+
+// StreamInterceptors to chain after the default stream server interceptors
+func StreamInterceptors(interceptors ...grpc.StreamServerInterceptor) Option {
+	return func(o *Options) {
+		o.StreamInterceptors = append(o.StreamInterceptors, interceptors...)
+	}
+}
+
+// ClientInterceptors to chain after the default unary client interceptors
+func ClientInterceptors(interceptors ...grpc.UnaryClientInterceptor) Option {
+	return func(o *Options) {
+		o.ClientUnaryInterceptors = append(o.ClientUnaryInterceptors, interceptors...)
+	}
+}
+
+// ClientStreamInterceptors to chain after the default stream client interceptors
+func ClientStreamInterceptors(interceptors ...grpc.StreamClientInterceptor) Option {
+	return func(o *Options) {
+		o.ClientStreamInterceptors = append(o.ClientStreamInterceptors, interceptors...)
+	}
+}
+
+// ServerOptions are applied to the grpc server after the app defaults
+func ServerOptions(opts ...server.Option) Option {
+	return func(o *Options) {
+		o.ServerOptions = append(o.ServerOptions, opts...)
+	}
+}
+
+// WebOptions are applied to the web server after the app defaults
+func WebOptions(opts ...web.Option) Option {
+	return func(o *Options) {
+		o.WebOptions = append(o.WebOptions, opts...)
+	}
+}
+
+// BeforeStart runs fn before the servers start
+func BeforeStart(fn func() error) Option {
+	return func(o *Options) {
+		o.BeforeStart = append(o.BeforeStart, fn)
+	}
+}
+
+// AfterStart runs fn once the servers started
+func AfterStart(fn func() error) Option {
+	return func(o *Options) {
+		o.AfterStart = append(o.AfterStart, fn)
+	}
+}
+
+// BeforeStop runs fn before the servers stop
+func BeforeStop(fn func() error) Option {
+	return func(o *Options) {
+		o.BeforeStop = append(o.BeforeStop, fn)
+	}
+}
+
+// AfterStop runs fn once the servers stopped
+func AfterStop(fn func() error) Option {
+	return func(o *Options) {
+		o.AfterStop = append(o.AfterStop, fn)
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"github.com/fztcjjl/tiger/app"
 	pb "github.com/fztcjjl/tiger/examples/proto"
+	"github.com/fztcjjl/tiger/pkg/middleware/gin/logging"
 	"github.com/fztcjjl/tiger/pkg/middleware/gin/trace"
 	"github.com/fztcjjl/tiger/trpc/client"
+	"github.com/fztcjjl/tiger/trpc/logger"
 	"github.com/fztcjjl/tiger/trpc/registry"
 	"github.com/fztcjjl/tiger/trpc/registry/etcd"
 	"github.com/fztcjjl/tiger/trpc/web"
@@ -17,7 +19,10 @@ import (
 )
 
 func main() {
-	a := app.NewApp(app.WithHttp(true))
+	a, err := app.NewApp(app.WithHttp(true))
+	if err != nil {
+		log.Fatal(err)
+	}
 	srv := a.GetServer()
 	webSrv := a.GetWebServer()
 	webSrv.Init(web.Handler(handler()))
@@ -30,6 +35,7 @@ type Greeter struct {
 }
 
 func (g *Greeter) SayHello(ctx context.Context, req *pb.HelloRequest) (rsp *pb.HelloReply, err error) {
+	logger.Ctx(ctx).Infof("SayHello %s", req.Name)
 	rsp = &pb.HelloReply{Message: "Hello " + req.Name}
 	return
 }
@@ -37,7 +43,7 @@ func (g *Greeter) SayHello(ctx context.Context, req *pb.HelloRequest) (rsp *pb.H
 func handler() http.Handler {
 	route := gin.New()
 
-	route.Use(trace.Trace())
+	route.Use(trace.Trace(), logging.Logging())
 	route.GET("/hello", sayHello)
 	return route
 }
@@ -58,6 +64,6 @@ func sayHello(ctx *gin.Context) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Greeting: %s", rsp.Message)
+	logger.Ctx(ctx.Request.Context()).Infof("Greeting: %s", rsp.Message)
 	ctx.Writer.WriteString(rsp.Message)
 }
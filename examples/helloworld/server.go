@@ -13,7 +13,10 @@ import (
 )
 
 func main() {
-	a := app.NewApp(app.WithHttp(true))
+	a, err := app.NewApp(app.WithHttp(true))
+	if err != nil {
+		log.Fatal(err)
+	}
 	srv := a.GetServer()
 	webSrv := a.GetWebServer()
 	webSrv.HandleFunc("/hello", SayHello)
@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"github.com/fztcjjl/tiger/pkg/middleware/gin/trace"
+	"github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/gin-gonic/gin"
+
+	tigertrace "github.com/fztcjjl/tiger/pkg/trace"
+)
+
+// RequestIDHeader is the header holding the id of the request
+const RequestIDHeader = "X-Request-Id"
+
+// Logging stores a logger with the request fields in the context of the
+// request, read it back with logger.Ctx(c.Request.Context()). It must be
+// used after trace.Trace for the trace ids to be found.
+func Logging() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fields := map[string]interface{}{
+			"method": c.Request.Method,
+			"path":   c.Request.URL.Path,
+			"peer":   c.ClientIP(),
+		}
+
+		if traceID, spanID, ok := tigertrace.IDs(trace.ContextWithSpan(c)); ok {
+			fields["trace_id"] = traceID
+			fields["span_id"] = spanID
+		}
+		if id := c.GetHeader(RequestIDHeader); len(id) > 0 {
+			fields["request_id"] = id
+		}
+
+		// the default logger is read on every request as the app may
+		// replace it
+		ctx := logger.NewContext(c.Request.Context(), logger.DefaultLogger.Fields(fields))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
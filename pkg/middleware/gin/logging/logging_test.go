@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fztcjjl/tiger/pkg/middleware/gin/trace"
+	"github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+)
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	old := logger.DefaultLogger
+	logger.DefaultLogger = logger.NewHelper(logger.NewLogger(logger.WithOutput(&buf), logger.WithFormat(logger.JSON)))
+	defer func() { logger.DefaultLogger = old }()
+
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewInMemoryReporter())
+	defer closer.Close()
+	oldTracer := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(oldTracer)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(trace.Trace(), Logging())
+
+	var sc jaeger.SpanContext
+	r.GET("/hello", func(c *gin.Context) {
+		sc = opentracing.SpanFromContext(trace.ContextWithSpan(c)).Context().(jaeger.SpanContext)
+		logger.Ctx(c.Request.Context()).Info("hello")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set(RequestIDHeader, "req-1")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	var e map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("invalid json %q: %v", buf.String(), err)
+	}
+
+	for k, want := range map[string]string{
+		"trace_id":   sc.TraceID().String(),
+		"span_id":    sc.SpanID().String(),
+		"method":     http.MethodGet,
+		"path":       "/hello",
+		"peer":       "10.0.0.1",
+		"request_id": "req-1",
+		"msg":        "hello",
+	} {
+		if e[k] != want {
+			t.Errorf("expected %s=%s got %v", k, want, e[k])
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"context"
+
+	"github.com/fztcjjl/tiger/pkg/trace"
+	"github.com/fztcjjl/tiger/trpc/logger"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// RequestIDKey is the metadata key holding the id of the request
+const RequestIDKey = "x-request-id"
+
+// UnaryServerInterceptor stores a logger with the request fields in the
+// context of the handler, read it back with logger.Ctx. It must come after
+// the tracing interceptor for the trace ids to be found.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(newContext(ctx, info.FullMethod), req)
+	}
+}
+
+// StreamServerInterceptor is the stream counterpart of UnaryServerInterceptor
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		wrapped := grpc_middleware.WrapServerStream(stream)
+		wrapped.WrappedContext = newContext(stream.Context(), info.FullMethod)
+		return handler(srv, wrapped)
+	}
+}
+
+// newContext derives the request logger from the default one, which is
+// read on every request as the app may replace it
+func newContext(ctx context.Context, method string) context.Context {
+	fields := map[string]interface{}{"method": method}
+
+	if traceID, spanID, ok := trace.IDs(ctx); ok {
+		fields["trace_id"] = traceID
+		fields["span_id"] = spanID
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		fields["peer"] = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(RequestIDKey); len(v) > 0 {
+			fields["request_id"] = v[0]
+		}
+	}
+
+	return logger.NewContext(ctx, logger.DefaultLogger.Fields(fields))
+}
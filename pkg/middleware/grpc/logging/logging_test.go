@@ -0,0 +1,96 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// testStream is a server stream carrying ctx
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+// setup logs to a buffer in json, returning the request context along with
+// the ids of its span
+func setup(t *testing.T) (*bytes.Buffer, context.Context, jaeger.SpanContext) {
+	var buf bytes.Buffer
+	old := logger.DefaultLogger
+	logger.DefaultLogger = logger.NewHelper(logger.NewLogger(logger.WithOutput(&buf), logger.WithFormat(logger.JSON)))
+	t.Cleanup(func() { logger.DefaultLogger = old })
+
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewInMemoryReporter())
+	t.Cleanup(func() { closer.Close() })
+	sp := tracer.StartSpan("test")
+	t.Cleanup(sp.Finish)
+
+	ctx := opentracing.ContextWithSpan(context.Background(), sp)
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(RequestIDKey, "req-1"))
+
+	return &buf, ctx, sp.Context().(jaeger.SpanContext)
+}
+
+func checkEntry(t *testing.T, buf *bytes.Buffer, sc jaeger.SpanContext) {
+	var e map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("invalid json %q: %v", buf.String(), err)
+	}
+
+	for k, want := range map[string]string{
+		"trace_id":   sc.TraceID().String(),
+		"span_id":    sc.SpanID().String(),
+		"method":     "/greeter.Greeter/Hello",
+		"peer":       "10.0.0.1:1234",
+		"request_id": "req-1",
+		"msg":        "hello",
+	} {
+		if e[k] != want {
+			t.Errorf("expected %s=%s got %v", k, want, e[k])
+		}
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	buf, ctx, sc := setup(t)
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/greeter.Greeter/Hello"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		logger.Ctx(ctx).Info("hello")
+		return nil, nil
+	}
+	if _, err := UnaryServerInterceptor()(ctx, nil, info, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntry(t, buf, sc)
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	buf, ctx, sc := setup(t)
+
+	info := &grpc.StreamServerInfo{FullMethod: "/greeter.Greeter/Hello", IsServerStream: true}
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		logger.Ctx(stream.Context()).Info("hello")
+		return nil
+	}
+	if err := StreamServerInterceptor()(nil, &testStream{ctx: ctx}, info, handler); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEntry(t, buf, sc)
+}
@@ -0,0 +1,23 @@
+package trace
+
+import (
+	"context"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+)
+
+// IDs returns the trace and span ids of the jaeger span carried by ctx, so
+// that log lines can be joined with the traces
+func IDs(ctx context.Context) (traceID, spanID string, ok bool) {
+	sp := opentracing.SpanFromContext(ctx)
+	if sp == nil {
+		return "", "", false
+	}
+
+	sc, ok := sp.Context().(jaeger.SpanContext)
+	if !ok || !sc.IsValid() {
+		return "", "", false
+	}
+	return sc.TraceID().String(), sc.SpanID().String(), true
+}
@@ -0,0 +1,32 @@
+package trace
+
+import (
+	"context"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+)
+
+func TestIDs(t *testing.T) {
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewInMemoryReporter())
+	defer closer.Close()
+
+	sp := tracer.StartSpan("test")
+	defer sp.Finish()
+	sc := sp.Context().(jaeger.SpanContext)
+
+	traceID, spanID, ok := IDs(opentracing.ContextWithSpan(context.Background(), sp))
+	if !ok || traceID != sc.TraceID().String() || spanID != sc.SpanID().String() {
+		t.Fatalf("unexpected ids %s %s %v", traceID, spanID, ok)
+	}
+
+	if _, _, ok := IDs(context.Background()); ok {
+		t.Fatal("expected no ids without a span")
+	}
+
+	noop := opentracing.NoopTracer{}.StartSpan("test")
+	if _, _, ok := IDs(opentracing.ContextWithSpan(context.Background(), noop)); ok {
+		t.Fatal("expected no ids for a span not created by jaeger")
+	}
+}
@@ -0,0 +1,162 @@
+// Package balancer provides the gRPC load balancers shipped with tiger.
+// The balancers read the registry node metadata attached to each address
+// by the client resolver.
+package balancer
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/fztcjjl/tiger/trpc/client/resolver"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	gresolver "google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+const (
+	// RoundRobin is the round robin balancer shipped with grpc
+	RoundRobin = "round_robin"
+	// WeightedRoundRobin balances by the weight node metadata
+	WeightedRoundRobin = "tiger_weighted_round_robin"
+	// ZoneAware prefers nodes in the local zone
+	ZoneAware = "tiger_zone_aware"
+	// ConsistentHash hashes a request metadata key onto the nodes
+	ConsistentHash = "tiger_consistent_hash"
+)
+
+const (
+	// WeightKey is the node metadata key holding the node weight
+	WeightKey = "weight"
+	// ZoneKey is the node metadata key holding the node zone
+	ZoneKey = "zone"
+	// DefaultWeight is used for nodes without a valid weight
+	DefaultWeight = 1
+)
+
+func init() {
+	balancer.Register(newBuilder(WeightedRoundRobin, newWeightedPicker))
+	balancer.Register(newBuilder(ZoneAware, newZonePicker))
+	balancer.Register(newBuilder(ConsistentHash, newHashPicker))
+}
+
+// Config is the load balancing config of the tiger balancers
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	// Zone is the local zone preferred by the zone aware balancer
+	Zone string `json:"zone,omitempty"`
+	// HashKey is the request metadata key used by the consistent hash balancer
+	HashKey string `json:"hashKey,omitempty"`
+}
+
+type newPickerFunc func(cfg *Config, scs []subConn) balancer.V2Picker
+
+type subConn struct {
+	sc   balancer.SubConn
+	addr gresolver.Address
+}
+
+// Metadata returns the registry node metadata of the sub conn address
+func (s subConn) Metadata() map[string]string {
+	return resolver.AddressMetadata(s.addr)
+}
+
+// Weight returns the weight of the sub conn address
+func (s subConn) Weight() int {
+	w, err := strconv.Atoi(s.Metadata()[WeightKey])
+	if err != nil || w <= 0 {
+		return DefaultWeight
+	}
+	return w
+}
+
+type builder struct {
+	name      string
+	newPicker newPickerFunc
+}
+
+func newBuilder(name string, fn newPickerFunc) balancer.Builder {
+	return &builder{name: name, newPicker: fn}
+}
+
+// Build creates a base balancer per client conn so every conn keeps its
+// own load balancing config
+func (b *builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &pickerBuilder{newPicker: b.newPicker, cfg: &Config{}}
+	bb := base.NewBalancerBuilderV2(b.name, pb, base.Config{HealthCheck: true})
+	bal := bb.Build(cc, opts)
+	return &configBalancer{
+		Balancer: bal,
+		v2:       bal.(balancer.V2Balancer),
+		pb:       pb,
+	}
+}
+
+func (b *builder) Name() string {
+	return b.name
+}
+
+func (b *builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &Config{}
+	if err := json.Unmarshal(js, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configBalancer hands the load balancing config to the picker builder
+// before the base balancer processes the new state
+type configBalancer struct {
+	balancer.Balancer
+	v2 balancer.V2Balancer
+	pb *pickerBuilder
+}
+
+func (b *configBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*Config); ok && cfg != nil {
+		b.pb.setConfig(cfg)
+	}
+	return b.v2.UpdateClientConnState(s)
+}
+
+func (b *configBalancer) ResolverError(err error) {
+	b.v2.ResolverError(err)
+}
+
+func (b *configBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	b.v2.UpdateSubConnState(sc, state)
+}
+
+type pickerBuilder struct {
+	newPicker newPickerFunc
+
+	sync.RWMutex
+	cfg *Config
+}
+
+func (p *pickerBuilder) setConfig(cfg *Config) {
+	p.Lock()
+	p.cfg = cfg
+	p.Unlock()
+}
+
+func (p *pickerBuilder) Build(info base.PickerBuildInfo) balancer.V2Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(balancer.ErrNoSubConnAvailable)
+	}
+
+	scs := make([]subConn, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		scs = append(scs, subConn{sc: sc, addr: sci.Address})
+	}
+	sort.Slice(scs, func(i, j int) bool { return scs[i].addr.Addr < scs[j].addr.Addr })
+
+	p.RLock()
+	cfg := p.cfg
+	p.RUnlock()
+
+	return p.newPicker(cfg, scs)
+}
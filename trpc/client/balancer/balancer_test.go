@@ -0,0 +1,150 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fztcjjl/tiger/trpc/client/resolver"
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/metadata"
+	gresolver "google.golang.org/grpc/resolver"
+)
+
+type testSubConn struct {
+	addr string
+}
+
+func (s *testSubConn) UpdateAddresses([]gresolver.Address) {}
+
+func (s *testSubConn) Connect() {}
+
+// newSubConns builds ready sub conns through the resolver so the
+// addresses carry node metadata like they do in a real client conn
+func newSubConns(t *testing.T, nodes ...*registry.Node) []subConn {
+	cc := &testClientConn{ch: make(chan gresolver.State, 1)}
+	b := resolver.NewBuilder(&testRegistry{nodes: nodes})
+	r, err := b.Build(gresolver.Target{Endpoint: "test"}, cc, gresolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	state := <-cc.ch
+	var scs []subConn
+	for _, addr := range state.Addresses {
+		scs = append(scs, subConn{sc: &testSubConn{addr: addr.Addr}, addr: addr})
+	}
+	return scs
+}
+
+func pick(t *testing.T, p balancer.V2Picker, ctx context.Context) string {
+	res, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.SubConn.(*testSubConn).addr
+}
+
+func TestWeightedPicker(t *testing.T) {
+	scs := newSubConns(t,
+		&registry.Node{Id: "1", Address: "10.0.0.1:1", Metadata: map[string]string{WeightKey: "3"}},
+		&registry.Node{Id: "2", Address: "10.0.0.2:1", Metadata: map[string]string{WeightKey: "1"}},
+	)
+
+	p := newWeightedPicker(&Config{}, scs)
+	counts := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		counts[pick(t, p, context.Background())]++
+	}
+
+	if counts["10.0.0.1:1"] != 300 || counts["10.0.0.2:1"] != 100 {
+		t.Fatalf("Expected 300/100 picks got %v", counts)
+	}
+}
+
+func TestZonePicker(t *testing.T) {
+	scs := newSubConns(t,
+		&registry.Node{Id: "1", Address: "10.0.0.1:1", Metadata: map[string]string{ZoneKey: "a"}},
+		&registry.Node{Id: "2", Address: "10.0.0.2:1", Metadata: map[string]string{ZoneKey: "b"}},
+	)
+
+	p := newZonePicker(&Config{Zone: "b"}, scs)
+	for i := 0; i < 10; i++ {
+		if addr := pick(t, p, context.Background()); addr != "10.0.0.2:1" {
+			t.Fatalf("Expected local zone node got %s", addr)
+		}
+	}
+
+	// no node in the zone, fall back to every node
+	p = newZonePicker(&Config{Zone: "c"}, scs)
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		counts[pick(t, p, context.Background())]++
+	}
+	if len(counts) != 2 {
+		t.Fatalf("Expected picks across zones got %v", counts)
+	}
+}
+
+func TestHashPicker(t *testing.T) {
+	scs := newSubConns(t,
+		&registry.Node{Id: "1", Address: "10.0.0.1:1"},
+		&registry.Node{Id: "2", Address: "10.0.0.2:1"},
+		&registry.Node{Id: "3", Address: "10.0.0.3:1"},
+	)
+
+	p := newHashPicker(&Config{HashKey: "user"}, scs)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "user", "42")
+
+	addr := pick(t, p, ctx)
+	for i := 0; i < 10; i++ {
+		if v := pick(t, p, ctx); v != addr {
+			t.Fatalf("Expected %s got %s", addr, v)
+		}
+	}
+
+	// removing another node must not move the key
+	var target subConn
+	var others []subConn
+	for _, sc := range scs {
+		if sc.addr.Addr == addr {
+			target = sc
+		} else {
+			others = append(others, sc)
+		}
+	}
+	p = newHashPicker(&Config{HashKey: "user"}, []subConn{target, others[0]})
+	if v := pick(t, p, ctx); v != addr {
+		t.Fatalf("Expected %s after removing a node got %s", addr, v)
+	}
+}
+
+type testClientConn struct {
+	gresolver.ClientConn
+	ch chan gresolver.State
+}
+
+func (c *testClientConn) UpdateState(s gresolver.State) {
+	select {
+	case c.ch <- s:
+	default:
+	}
+}
+
+type testRegistry struct {
+	registry.Registry
+	nodes []*registry.Node
+}
+
+func (r *testRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	return []*registry.Service{{Name: name, Version: "latest", Nodes: r.nodes}}, nil
+}
+
+func (r *testRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return nil, registry.ErrWatcherStopped
+}
+
+func (r *testRegistry) String() string {
+	return "test"
+}
@@ -0,0 +1,73 @@
+package balancer
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// DefaultHashKey is the request metadata key hashed when none is configured
+	DefaultHashKey = "x-hash-key"
+	// replicas is the number of virtual nodes per weight unit on the ring
+	replicas = 160
+)
+
+// hashPicker maps the value of a request metadata key onto a hash ring
+// so requests carrying the same value land on the same node. Requests
+// without the key are balanced by weight.
+type hashPicker struct {
+	key    string
+	hashes []uint32
+	ring   map[uint32]balancer.SubConn
+	next   balancer.V2Picker
+}
+
+func newHashPicker(cfg *Config, scs []subConn) balancer.V2Picker {
+	p := &hashPicker{
+		key:  cfg.HashKey,
+		ring: make(map[uint32]balancer.SubConn),
+		next: newWeightedPicker(cfg, scs),
+	}
+	if len(p.key) == 0 {
+		p.key = DefaultHashKey
+	}
+
+	for _, sc := range scs {
+		n := replicas * sc.Weight()
+		for i := 0; i < n; i++ {
+			h := crc32.ChecksumIEEE([]byte(sc.addr.Addr + "#" + strconv.Itoa(i)))
+			if _, ok := p.ring[h]; ok {
+				continue
+			}
+			p.ring[h] = sc.sc
+			p.hashes = append(p.hashes, h)
+		}
+	}
+	sort.Slice(p.hashes, func(i, j int) bool { return p.hashes[i] < p.hashes[j] })
+
+	return p
+}
+
+func (p *hashPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	md, ok := metadata.FromOutgoingContext(info.Ctx)
+	if !ok {
+		return p.next.Pick(info)
+	}
+
+	vals := md.Get(p.key)
+	if len(vals) == 0 || len(vals[0]) == 0 {
+		return p.next.Pick(info)
+	}
+
+	h := crc32.ChecksumIEEE([]byte(vals[0]))
+	i := sort.Search(len(p.hashes), func(i int) bool { return p.hashes[i] >= h })
+	if i == len(p.hashes) {
+		i = 0
+	}
+
+	return balancer.PickResult{SubConn: p.ring[p.hashes[i]]}, nil
+}
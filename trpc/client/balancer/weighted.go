@@ -0,0 +1,46 @@
+package balancer
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+)
+
+// weightedPicker implements smooth weighted round robin, nodes are
+// picked in proportion to their weight without bursts to a single node
+type weightedPicker struct {
+	mu      sync.Mutex
+	scs     []subConn
+	weights []int
+	current []int
+	total   int
+}
+
+func newWeightedPicker(cfg *Config, scs []subConn) balancer.V2Picker {
+	p := &weightedPicker{
+		scs:     scs,
+		weights: make([]int, len(scs)),
+		current: make([]int, len(scs)),
+	}
+	for i, sc := range scs {
+		p.weights[i] = sc.Weight()
+		p.total += p.weights[i]
+	}
+	return p
+}
+
+func (p *weightedPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	best := 0
+	for i := range p.scs {
+		p.current[i] += p.weights[i]
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	sc := p.scs[best].sc
+	p.mu.Unlock()
+
+	return balancer.PickResult{SubConn: sc}, nil
+}
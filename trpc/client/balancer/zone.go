@@ -0,0 +1,26 @@
+package balancer
+
+import (
+	"google.golang.org/grpc/balancer"
+)
+
+// newZonePicker balances by weight over the nodes in the local zone and
+// only falls back to the other zones when none of them is ready
+func newZonePicker(cfg *Config, scs []subConn) balancer.V2Picker {
+	if len(cfg.Zone) == 0 {
+		return newWeightedPicker(cfg, scs)
+	}
+
+	var local []subConn
+	for _, sc := range scs {
+		if sc.Metadata()[ZoneKey] == cfg.Zone {
+			local = append(local, sc)
+		}
+	}
+
+	if len(local) == 0 {
+		return newWeightedPicker(cfg, scs)
+	}
+
+	return newWeightedPicker(cfg, local)
+}
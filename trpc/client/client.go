@@ -1,10 +1,14 @@
 package client
 
 import (
+	"encoding/json"
+
+	"github.com/fztcjjl/tiger/trpc/client/balancer"
 	"github.com/fztcjjl/tiger/trpc/client/resolver"
 	log "github.com/fztcjjl/tiger/trpc/logger"
 	"github.com/fztcjjl/tiger/trpc/registry"
 	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/health"
 )
 
 type Client struct {
@@ -17,15 +21,19 @@ func NewClient(service string, opt ...Option) *Client {
 	opts := newOptions(opt...)
 	client := Client{opts: opts}
 
-	resolver.Register(opts.Registry)
-	target := opts.Registry.String() + ":///" + service
+	builder := resolver.NewBuilder(opts.Registry, client.getResolverOptions()...)
+	target := builder.Scheme() + ":///" + service
 
 	grpcDialOptions := []grpc.DialOption{
-		grpc.WithDefaultServiceConfig(`{"loadBalancingPolicy":"round_robin"}`),
+		grpc.WithResolvers(builder),
+		grpc.WithDefaultServiceConfig(client.getServiceConfig()),
 	}
 	if interceptors := client.getInterceptors(); interceptors != nil {
 		grpcDialOptions = append(grpcDialOptions, grpc.WithChainUnaryInterceptor(interceptors...))
 	}
+	if interceptors := client.getStreamInterceptors(); interceptors != nil {
+		grpcDialOptions = append(grpcDialOptions, grpc.WithChainStreamInterceptor(interceptors...))
+	}
 
 	grpcDialOptions = append(grpcDialOptions, opts.DialOptions...)
 	conn, err := grpc.Dial(target, grpcDialOptions...)
@@ -51,3 +59,71 @@ func (s *Client) getInterceptors() []grpc.UnaryClientInterceptor {
 	}
 	return nil
 }
+
+func (s *Client) getStreamInterceptors() []grpc.StreamClientInterceptor {
+	if s.opts.Context != nil {
+		if v, ok := s.opts.Context.Value(streamClientInterceptors{}).([]grpc.StreamClientInterceptor); ok && v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *Client) getResolverOptions() []resolver.Option {
+	if s.opts.Context == nil {
+		return nil
+	}
+
+	var opts []resolver.Option
+	if v, ok := s.opts.Context.Value(versionKey{}).(string); ok && len(v) > 0 {
+		opts = append(opts, resolver.Version(v))
+	}
+	if fn, ok := s.opts.Context.Value(versionSelectorKey{}).(func([]*registry.Service) []*registry.Service); ok && fn != nil {
+		opts = append(opts, resolver.VersionSelector(fn))
+	}
+	if fn, ok := s.opts.Context.Value(nodeFilterKey{}).(func(*registry.Node) bool); ok && fn != nil {
+		opts = append(opts, resolver.NodeFilter(fn))
+	}
+	return opts
+}
+
+func (s *Client) getServiceConfig() string {
+	name := balancer.RoundRobin
+	cfg := &balancer.Config{}
+
+	if s.opts.Context != nil {
+		if v, ok := s.opts.Context.Value(balancerKey{}).(string); ok && len(v) > 0 {
+			name = v
+		}
+		if v, ok := s.opts.Context.Value(zoneKey{}).(string); ok {
+			cfg.Zone = v
+		}
+		if v, ok := s.opts.Context.Value(hashKeyKey{}).(string); ok {
+			cfg.HashKey = v
+		}
+	}
+
+	sc := make(map[string]interface{})
+	if name == balancer.RoundRobin {
+		sc["loadBalancingPolicy"] = name
+	} else {
+		sc["loadBalancingConfig"] = []map[string]interface{}{{name: cfg}}
+	}
+
+	// client side health checking watches the overall server status
+	if s.healthCheck() {
+		sc["healthCheckConfig"] = map[string]string{"serviceName": ""}
+	}
+
+	b, _ := json.Marshal(sc)
+	return string(b)
+}
+
+func (s *Client) healthCheck() bool {
+	if s.opts.Context != nil {
+		if v, ok := s.opts.Context.Value(healthCheckKey{}).(bool); ok {
+			return v
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/fztcjjl/tiger/trpc/client/resolver"
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/registry/memory"
+)
+
+func TestResolverOptions(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Stop()
+
+	var selected, filtered bool
+	c := &Client{opts: newOptions(
+		Registry(r),
+		WithVersion("v2"),
+		WithVersionSelector(func(s []*registry.Service) []*registry.Service {
+			selected = true
+			return s
+		}),
+		WithNodeFilter(func(*registry.Node) bool {
+			filtered = true
+			return true
+		}),
+	)}
+
+	var opts resolver.Options
+	for _, o := range c.getResolverOptions() {
+		o(&opts)
+	}
+
+	if opts.Version != "v2" {
+		t.Fatalf("Expected version v2 got %q", opts.Version)
+	}
+	if opts.VersionSelector == nil || opts.NodeFilter == nil {
+		t.Fatal("Expected the version selector and the node filter")
+	}
+	opts.VersionSelector(nil)
+	opts.NodeFilter(&registry.Node{})
+	if !selected || !filtered {
+		t.Fatal("Expected the functions of the client options")
+	}
+
+	if opts := (&Client{opts: newOptions(Registry(r))}).getResolverOptions(); len(opts) != 0 {
+		t.Fatalf("Expected no resolver options got %d", len(opts))
+	}
+}
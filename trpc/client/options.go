@@ -44,7 +44,59 @@ func newOptions(opt ...Option) Options {
 }
 
 type unaryClientInterceptors struct{}
+type streamClientInterceptors struct{}
+type versionKey struct{}
+type versionSelectorKey struct{}
+type nodeFilterKey struct{}
+type balancerKey struct{}
+type zoneKey struct{}
+type hashKeyKey struct{}
+type healthCheckKey struct{}
 
+// Interceptors to chain around every unary call
 func Interceptors(interceptors ...grpc.UnaryClientInterceptor) Option {
 	return setClientOption(unaryClientInterceptors{}, interceptors)
 }
+
+// StreamInterceptors to chain around every streaming call
+func StreamInterceptors(interceptors ...grpc.StreamClientInterceptor) Option {
+	return setClientOption(streamClientInterceptors{}, interceptors)
+}
+
+// WithVersion only routes requests to nodes of the given service version
+func WithVersion(v string) Option {
+	return setClientOption(versionKey{}, v)
+}
+
+// WithVersionSelector picks the service versions requests are routed to,
+// it is called with every version currently registered
+func WithVersionSelector(fn func([]*registry.Service) []*registry.Service) Option {
+	return setClientOption(versionSelectorKey{}, fn)
+}
+
+// WithNodeFilter only routes requests to nodes for which fn returns true
+func WithNodeFilter(fn func(*registry.Node) bool) Option {
+	return setClientOption(nodeFilterKey{}, fn)
+}
+
+// Balancer selects the load balancing policy by name, round_robin by default.
+// See the balancer package for the policies shipped with tiger.
+func Balancer(name string) Option {
+	return setClientOption(balancerKey{}, name)
+}
+
+// Zone sets the local zone preferred by the zone aware balancer
+func Zone(z string) Option {
+	return setClientOption(zoneKey{}, z)
+}
+
+// HashKey sets the request metadata key used by the consistent hash balancer
+func HashKey(k string) Option {
+	return setClientOption(hashKeyKey{}, k)
+}
+
+// HealthCheck enables gRPC client side health checking, it is on by default
+// so nodes reporting NOT_SERVING stop receiving requests
+func HealthCheck(enable bool) Option {
+	return setClientOption(healthCheckKey{}, enable)
+}
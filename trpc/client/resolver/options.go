@@ -0,0 +1,48 @@
+package resolver
+
+import (
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+type Option func(*Options)
+
+type Options struct {
+	// Version restricts routing to nodes of a single service version
+	Version string
+	// VersionSelector picks the service versions to route to
+	VersionSelector func([]*registry.Service) []*registry.Service
+	// NodeFilter drops every node it returns false for
+	NodeFilter func(*registry.Node) bool
+}
+
+func newOptions(opt ...Option) Options {
+	opts := Options{}
+
+	for _, o := range opt {
+		o(&opts)
+	}
+
+	return opts
+}
+
+// Version only routes to nodes of the given service version
+func Version(v string) Option {
+	return func(o *Options) {
+		o.Version = v
+	}
+}
+
+// VersionSelector is called with every known version of the service
+// and returns the ones to route to
+func VersionSelector(fn func([]*registry.Service) []*registry.Service) Option {
+	return func(o *Options) {
+		o.VersionSelector = fn
+	}
+}
+
+// NodeFilter only routes to nodes for which fn returns true
+func NodeFilter(fn func(*registry.Node) bool) Option {
+	return func(o *Options) {
+		o.NodeFilter = fn
+	}
+}
@@ -2,17 +2,54 @@ package resolver
 
 import (
 	"context"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/fztcjjl/tiger/trpc/logger"
 	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/util/backoff"
+	hash "github.com/mitchellh/hashstructure"
+	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/resolver"
-	"time"
 )
 
-func Register(r registry.Registry) {
-	resolver.Register(&trpcResolverBuilder{registry: r})
+type versionKey struct{}
+type metadataKey struct{}
+
+// Register registers a resolver for r globally, the options apply to every
+// client conn dialing the registry scheme
+func Register(r registry.Registry, opt ...Option) {
+	resolver.Register(NewBuilder(r, opt...))
+}
+
+// NewBuilder returns a resolver builder for r. It can be passed to
+// grpc.WithResolvers so the options only apply to a single client conn.
+func NewBuilder(r registry.Registry, opt ...Option) resolver.Builder {
+	return &trpcResolverBuilder{registry: r, opts: newOptions(opt...)}
+}
+
+// AddressVersion returns the service version of the node behind addr
+func AddressVersion(addr resolver.Address) string {
+	if addr.Attributes == nil {
+		return ""
+	}
+	v, _ := addr.Attributes.Value(versionKey{}).(string)
+	return v
+}
+
+// AddressMetadata returns the registry metadata of the node behind addr
+func AddressMetadata(addr resolver.Address) map[string]string {
+	if addr.Attributes == nil {
+		return nil
+	}
+	md, _ := addr.Attributes.Value(metadataKey{}).(map[string]string)
+	return md
 }
 
 type trpcResolverBuilder struct {
 	registry registry.Registry
+	opts     Options
 }
 
 func (b *trpcResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
@@ -23,6 +60,9 @@ func (b *trpcResolverBuilder) Build(target resolver.Target, cc resolver.ClientCo
 		ctx:    ctx,
 		cancel: cancel,
 		r:      b.registry,
+		opts:   b.opts,
+		rn:     make(chan struct{}, 1),
+		nodes:  make(map[string]*registry.Service),
 	}
 
 	go r.watch()
@@ -40,38 +80,276 @@ type trpcResolver struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 	r      registry.Registry
+	opts   Options
+
+	// rn is signalled by ResolveNow to force an immediate refresh
+	rn chan struct{}
+
+	sync.Mutex
+	// nodes currently known for the target keyed by node id, each
+	// held in a single node copy of the service it was registered with
+	nodes map[string]*registry.Service
+	// hash of the addresses last pushed to the client conn
+	hash    uint64
+	updated bool
+	// attributes last pushed per address. Balancers key sub conns by
+	// address so the same pointer must be reused while a node is unchanged.
+	attrs map[string]*addrAttrs
 }
 
+type addrAttrs struct {
+	hash       uint64
+	attributes *attributes.Attributes
+}
+
+// watch keeps the client conn in sync with the registry. It subscribes to
+// the registry watcher and applies events incrementally, falling back to
+// polling with backoff while the watcher can't be established.
 func (r *trpcResolver) watch() {
-	r.update()
-	ticker := time.NewTicker(time.Second)
+	r.refresh()
+
+	var attempts int
 	for {
+		w, err := r.r.Watch(registry.WatchService(r.target.Endpoint))
+		if err != nil {
+			log.Errorf("Resolver [%s] watch %s error: %v", r.r.String(), r.target.Endpoint, err)
+		} else if r.next(w) {
+			// the watcher delivered events before failing so start over
+			attempts = 0
+		}
+
 		select {
 		case <-r.ctx.Done():
-			ticker.Stop()
 			return
-		case <-ticker.C:
-			r.update()
+		default:
+		}
+
+		attempts++
+		if !r.poll(backoff.Do(attempts)) {
+			return
 		}
 	}
 }
 
-func (*trpcResolver) ResolveNow(o resolver.ResolveNowOptions) {
+// next applies watcher results until the watcher fails or the resolver
+// is closed. It reports whether any result was received.
+func (r *trpcResolver) next(w registry.Watcher) bool {
+	defer w.Stop()
+
+	results := make(chan *registry.Result)
+	errs := make(chan error, 1)
+
+	go func() {
+		for {
+			res, err := w.Next()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case results <- res:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
 
+	var received bool
+	for {
+		select {
+		case <-r.ctx.Done():
+			return received
+		case <-r.rn:
+			r.refresh()
+		case res := <-results:
+			received = true
+			r.apply(res)
+		case err := <-errs:
+			log.Errorf("Resolver [%s] watcher for %s stopped: %v", r.r.String(), r.target.Endpoint, err)
+			return received
+		}
+	}
+}
+
+// poll waits for d before the watcher is re-created, refreshing the
+// node list once the wait is over or whenever ResolveNow is called.
+// It returns false if the resolver was closed.
+func (r *trpcResolver) poll(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return false
+		case <-r.rn:
+			r.refresh()
+		case <-t.C:
+			r.refresh()
+			return true
+		}
+	}
+}
+
+func (r *trpcResolver) ResolveNow(o resolver.ResolveNowOptions) {
+	select {
+	case r.rn <- struct{}{}:
+	default:
+	}
 }
 
 func (r *trpcResolver) Close() {
 	r.cancel()
 }
 
-func (r *trpcResolver) update() {
-	var addrs []resolver.Address
-	svcs, _ := r.r.GetService(r.target.Endpoint)
+// refresh replaces the known nodes with a full lookup from the registry
+func (r *trpcResolver) refresh() {
+	svcs, err := r.r.GetService(r.target.Endpoint)
+	if err != nil && err != registry.ErrNotFound {
+		// keep the last known nodes rather than dropping every connection
+		log.Errorf("Resolver [%s] get service %s error: %v", r.r.String(), r.target.Endpoint, err)
+		return
+	}
+
+	nodes := make(map[string]*registry.Service)
 	for _, svc := range svcs {
 		for _, node := range svc.Nodes {
-			addr := resolver.Address{Addr: node.Address}
-			addrs = append(addrs, addr)
+			nodes[node.Id] = withNode(svc, node)
+		}
+	}
+
+	r.Lock()
+	r.nodes = nodes
+	r.Unlock()
+
+	r.update()
+}
+
+// apply merges a single watcher result into the known nodes
+func (r *trpcResolver) apply(res *registry.Result) {
+	if res == nil || res.Service == nil || res.Service.Name != r.target.Endpoint {
+		return
+	}
+
+	r.Lock()
+	for _, node := range res.Service.Nodes {
+		switch res.Action {
+		case "create", "update":
+			r.nodes[node.Id] = withNode(res.Service, node)
+		case "delete":
+			delete(r.nodes, node.Id)
 		}
 	}
-	r.cc.UpdateState(resolver.State{Addresses: addrs})
+	r.Unlock()
+
+	r.update()
+}
+
+// update pushes the selected nodes to the client conn if they changed.
+// The user callbacks and the client conn are called without holding the
+// lock so a slow or re-entrant callback doesn't block the resolver.
+func (r *trpcResolver) update() {
+	r.Lock()
+	services := r.services()
+	r.Unlock()
+
+	if len(r.opts.Version) > 0 {
+		var selected []*registry.Service
+		for _, svc := range services {
+			if svc.Version == r.opts.Version {
+				selected = append(selected, svc)
+			}
+		}
+		services = selected
+	}
+	if r.opts.VersionSelector != nil {
+		services = r.opts.VersionSelector(services)
+	}
+
+	type key struct {
+		Addr     string
+		Version  string
+		Metadata map[string]string
+	}
+
+	var keys []key
+	for _, svc := range services {
+		for _, node := range svc.Nodes {
+			if r.opts.NodeFilter != nil && !r.opts.NodeFilter(node) {
+				continue
+			}
+			keys = append(keys, key{Addr: node.Address, Version: svc.Version, Metadata: node.Metadata})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Addr < keys[j].Addr })
+
+	h, err := hash.Hash(keys, nil)
+
+	r.Lock()
+	if err == nil && r.updated && h == r.hash {
+		r.Unlock()
+		return
+	}
+	r.hash = h
+	r.updated = true
+
+	attrs := make(map[string]*addrAttrs, len(keys))
+	state := resolver.State{Addresses: make([]resolver.Address, 0, len(keys))}
+	for _, k := range keys {
+		kh, _ := hash.Hash(k, nil)
+		a, ok := r.attrs[k.Addr]
+		if !ok || a.hash != kh {
+			a = &addrAttrs{
+				hash:       kh,
+				attributes: attributes.New(versionKey{}, k.Version, metadataKey{}, k.Metadata),
+			}
+		}
+		attrs[k.Addr] = a
+		state.Addresses = append(state.Addresses, resolver.Address{
+			Addr:       k.Addr,
+			Attributes: a.attributes,
+		})
+	}
+	r.attrs = attrs
+	r.Unlock()
+
+	r.cc.UpdateState(state)
+}
+
+// services groups the known nodes by version, sorted by version. It must
+// be called with the lock held.
+func (r *trpcResolver) services() []*registry.Service {
+	versions := make(map[string]*registry.Service)
+	for _, sn := range r.nodes {
+		svc, ok := versions[sn.Version]
+		if !ok {
+			svc = &registry.Service{
+				Name:      sn.Name,
+				Version:   sn.Version,
+				Metadata:  sn.Metadata,
+				Endpoints: sn.Endpoints,
+			}
+			versions[sn.Version] = svc
+		}
+		svc.Nodes = append(svc.Nodes, sn.Nodes...)
+	}
+
+	services := make([]*registry.Service, 0, len(versions))
+	for _, svc := range versions {
+		services = append(services, svc)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Version < services[j].Version })
+
+	return services
+}
+
+// withNode returns a copy of s holding only node
+func withNode(s *registry.Service, node *registry.Node) *registry.Service {
+	return &registry.Service{
+		Name:      s.Name,
+		Version:   s.Version,
+		Metadata:  s.Metadata,
+		Endpoints: s.Endpoints,
+		Nodes:     []*registry.Node{node},
+	}
 }
@@ -0,0 +1,357 @@
+package resolver
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/registry/memory"
+	"google.golang.org/grpc/resolver"
+)
+
+var errWatch = errors.New("watch failed")
+
+// testRegistry is a memory registry whose watches can fail or stay silent
+type testRegistry struct {
+	memory.Registry
+
+	mtx sync.Mutex
+	// Watch fails while set
+	failWatch bool
+	// Watch returns a watcher which never sends a result while set
+	silent bool
+	// the number of GetService calls
+	gets int
+
+	// signalled when a watch is started
+	watching chan struct{}
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		Registry: memory.NewRegistry(),
+		watching: make(chan struct{}, 1),
+	}
+	t.Cleanup(r.Stop)
+	return r
+}
+
+func (r *testRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	r.mtx.Lock()
+	r.gets++
+	r.mtx.Unlock()
+	return r.Registry.GetService(name, opts...)
+}
+
+func (r *testRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	r.mtx.Lock()
+	fail, silent := r.failWatch, r.silent
+	r.mtx.Unlock()
+
+	if fail {
+		return nil, errWatch
+	}
+
+	var w registry.Watcher
+	if silent {
+		w = &silentWatcher{exit: make(chan struct{})}
+	} else {
+		var err error
+		if w, err = r.Registry.Watch(opts...); err != nil {
+			return nil, err
+		}
+	}
+
+	select {
+	case r.watching <- struct{}{}:
+	default:
+	}
+	return w, nil
+}
+
+func (r *testRegistry) getCount() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.gets
+}
+
+// silentWatcher never sends a result
+type silentWatcher struct {
+	once sync.Once
+	exit chan struct{}
+}
+
+func (w *silentWatcher) Next() (*registry.Result, error) {
+	<-w.exit
+	return nil, registry.ErrWatcherStopped
+}
+
+func (w *silentWatcher) Stop() {
+	w.once.Do(func() { close(w.exit) })
+}
+
+// testClientConn records the states pushed by the resolver
+type testClientConn struct {
+	resolver.ClientConn
+	states chan resolver.State
+}
+
+func (cc *testClientConn) UpdateState(s resolver.State) {
+	cc.states <- s
+}
+
+// build starts a resolver of the foo service
+func build(t *testing.T, r registry.Registry, opts ...Option) (resolver.Resolver, *testClientConn) {
+	cc := &testClientConn{states: make(chan resolver.State, 16)}
+	res, err := NewBuilder(r, opts...).Build(resolver.Target{Endpoint: "foo"}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(res.Close)
+	return res, cc
+}
+
+// nextAddrs returns the sorted addresses of the next state
+func nextAddrs(t *testing.T, cc *testClientConn) []string {
+	t.Helper()
+
+	select {
+	case s := <-cc.states:
+		addrs := make([]string, 0, len(s.Addresses))
+		for _, a := range s.Addresses {
+			addrs = append(addrs, a.Addr)
+		}
+		sort.Strings(addrs)
+		return addrs
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for a state")
+		return nil
+	}
+}
+
+func expectAddrs(t *testing.T, cc *testClientConn, want ...string) {
+	t.Helper()
+
+	got := nextAddrs(t, cc)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected %v got %v", want, got)
+		}
+	}
+}
+
+func expectNoState(t *testing.T, cc *testClientConn) {
+	t.Helper()
+
+	select {
+	case s := <-cc.states:
+		t.Fatalf("unexpected state %v", s)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func waitWatch(t *testing.T, r *testRegistry) {
+	t.Helper()
+
+	select {
+	case <-r.watching:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the watch")
+	}
+}
+
+func testService(version string, md map[string]string, nodes ...*registry.Node) *registry.Service {
+	return &registry.Service{Name: "foo", Version: version, Metadata: md, Nodes: nodes}
+}
+
+func testNode(id, addr string) *registry.Node {
+	return &registry.Node{Id: id, Address: addr}
+}
+
+func TestResolverEvents(t *testing.T) {
+	r := newTestRegistry(t)
+	if err := r.Register(testService("1.0.0", nil, testNode("foo-1", "10.0.0.1:8080"))); err != nil {
+		t.Fatal(err)
+	}
+
+	_, cc := build(t, r)
+	expectAddrs(t, cc, "10.0.0.1:8080")
+	waitWatch(t, r)
+
+	// create
+	if err := r.Register(testService("1.0.0", nil, testNode("foo-2", "10.0.0.2:8080"))); err != nil {
+		t.Fatal(err)
+	}
+	expectAddrs(t, cc, "10.0.0.1:8080", "10.0.0.2:8080")
+
+	// update
+	if err := r.Register(testService("1.0.0", nil, testNode("foo-2", "10.0.0.3:8080"))); err != nil {
+		t.Fatal(err)
+	}
+	expectAddrs(t, cc, "10.0.0.1:8080", "10.0.0.3:8080")
+
+	// delete
+	if err := r.Deregister(testService("1.0.0", nil, testNode("foo-1", "10.0.0.1:8080"))); err != nil {
+		t.Fatal(err)
+	}
+	expectAddrs(t, cc, "10.0.0.3:8080")
+}
+
+func TestResolverUnchanged(t *testing.T) {
+	r := newTestRegistry(t)
+	if err := r.Register(testService("1.0.0", map[string]string{"a": "1"}, testNode("foo-1", "10.0.0.1:8080"))); err != nil {
+		t.Fatal(err)
+	}
+
+	res, cc := build(t, r)
+	expectAddrs(t, cc, "10.0.0.1:8080")
+	waitWatch(t, r)
+
+	// the service metadata isn't routed on so the update changes nothing
+	if err := r.Register(testService("1.0.0", map[string]string{"a": "2"}, testNode("foo-1", "10.0.0.1:8080"))); err != nil {
+		t.Fatal(err)
+	}
+	expectNoState(t, cc)
+
+	// nor does a refresh finding the same nodes
+	gets := r.getCount()
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	expectNoState(t, cc)
+	if r.getCount() == gets {
+		t.Fatal("Expected ResolveNow to look the service up")
+	}
+}
+
+func TestResolverResolveNow(t *testing.T) {
+	r := newTestRegistry(t)
+	r.silent = true
+
+	res, cc := build(t, r)
+	expectAddrs(t, cc)
+	waitWatch(t, r)
+
+	// the watcher misses the node, the refresh finds it
+	if err := r.Register(testService("1.0.0", nil, testNode("foo-1", "10.0.0.1:8080"))); err != nil {
+		t.Fatal(err)
+	}
+	expectNoState(t, cc)
+
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	expectAddrs(t, cc, "10.0.0.1:8080")
+}
+
+func TestResolverPollFallback(t *testing.T) {
+	r := newTestRegistry(t)
+	r.failWatch = true
+
+	_, cc := build(t, r)
+	expectAddrs(t, cc)
+
+	// polled while the watch fails
+	if err := r.Register(testService("1.0.0", nil, testNode("foo-1", "10.0.0.1:8080"))); err != nil {
+		t.Fatal(err)
+	}
+	expectAddrs(t, cc, "10.0.0.1:8080")
+
+	// back to watching once it works again
+	r.mtx.Lock()
+	r.failWatch = false
+	r.mtx.Unlock()
+	waitWatch(t, r)
+
+	// no lookup is needed once watching
+	gets := r.getCount()
+	if err := r.Register(testService("1.0.0", nil, testNode("foo-2", "10.0.0.2:8080"))); err != nil {
+		t.Fatal(err)
+	}
+	expectAddrs(t, cc, "10.0.0.1:8080", "10.0.0.2:8080")
+	if r.getCount() != gets {
+		t.Fatal("Expected the node to come from the watcher rather than a lookup")
+	}
+}
+
+func TestResolverFilters(t *testing.T) {
+	r := newTestRegistry(t)
+	a := &registry.Node{Id: "a", Address: "10.0.0.1:8080", Metadata: map[string]string{"zone": "x"}}
+	b := &registry.Node{Id: "b", Address: "10.0.0.2:8080", Metadata: map[string]string{"zone": "y"}}
+	c := &registry.Node{Id: "c", Address: "10.0.0.3:8080", Metadata: map[string]string{"zone": "x"}}
+	if err := r.Register(testService("v1", nil, a, b)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(testService("v2", nil, c)); err != nil {
+		t.Fatal(err)
+	}
+
+	latest := func(svcs []*registry.Service) []*registry.Service {
+		return svcs[len(svcs)-1:]
+	}
+	none := func([]*registry.Service) []*registry.Service {
+		return nil
+	}
+	zone := func(n *registry.Node) bool {
+		return n.Metadata["zone"] == "x"
+	}
+	drop := func(*registry.Node) bool {
+		return false
+	}
+
+	for _, test := range []struct {
+		name  string
+		opts  []Option
+		addrs []string
+	}{
+		{"all", nil, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}},
+		{"version", []Option{Version("v1")}, []string{"10.0.0.1:8080", "10.0.0.2:8080"}},
+		{"unknown version", []Option{Version("v3")}, []string{}},
+		{"selector", []Option{VersionSelector(latest)}, []string{"10.0.0.3:8080"}},
+		{"selector drops all", []Option{VersionSelector(none)}, []string{}},
+		{"filter", []Option{NodeFilter(zone)}, []string{"10.0.0.1:8080", "10.0.0.3:8080"}},
+		{"filter drops all", []Option{NodeFilter(drop)}, []string{}},
+		{"version and filter", []Option{Version("v1"), NodeFilter(zone)}, []string{"10.0.0.1:8080"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, cc := build(t, r, test.opts...)
+			expectAddrs(t, cc, test.addrs...)
+		})
+	}
+}
+
+func TestResolverAttributes(t *testing.T) {
+	r := newTestRegistry(t)
+	md := map[string]string{"zone": "x"}
+	if err := r.Register(testService("v1", nil, &registry.Node{Id: "a", Address: "10.0.0.1:8080", Metadata: md})); err != nil {
+		t.Fatal(err)
+	}
+
+	_, cc := build(t, r)
+
+	var s resolver.State
+	select {
+	case s = <-cc.states:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for a state")
+	}
+	if len(s.Addresses) != 1 {
+		t.Fatalf("Expected a single address got %v", s.Addresses)
+	}
+
+	addr := s.Addresses[0]
+	if v := AddressVersion(addr); v != "v1" {
+		t.Fatalf("Expected version v1 got %q", v)
+	}
+	if got := AddressMetadata(addr); got["zone"] != "x" {
+		t.Fatalf("Expected the node metadata got %v", got)
+	}
+
+	// addresses built elsewhere carry no attributes
+	empty := resolver.Address{Addr: "10.0.0.1:8080"}
+	if AddressVersion(empty) != "" || AddressMetadata(empty) != nil {
+		t.Fatal("Expected no version or metadata without attributes")
+	}
+}
@@ -4,11 +4,40 @@ import "context"
 
 type loggerKey struct{}
 
+// FromContext returns the logger stored in ctx, if any
 func FromContext(ctx context.Context) (Logger, bool) {
 	l, ok := ctx.Value(loggerKey{}).(Logger)
 	return l, ok
 }
 
+// NewContext returns a copy of ctx which carries l
 func NewContext(ctx context.Context, l Logger) context.Context {
 	return context.WithValue(ctx, loggerKey{}, l)
 }
+
+// Ctx returns a helper logging through the logger of ctx, the default
+// logger if ctx carries none. The server and web middleware store a logger
+// with the trace and request fields in the context of every request.
+func Ctx(ctx context.Context) *Helper {
+	if ctx != nil {
+		if l, ok := FromContext(ctx); ok {
+			if h, ok := l.(*Helper); ok {
+				return h
+			}
+			return NewHelper(l)
+		}
+	}
+	if h, ok := DefaultLogger.(*Helper); ok {
+		return h
+	}
+	return NewHelper(DefaultLogger)
+}
+
+// ContextWithFields returns a copy of ctx whose logger also writes fields
+func ContextWithFields(ctx context.Context, fields map[string]interface{}) context.Context {
+	l, ok := FromContext(ctx)
+	if !ok {
+		l = DefaultLogger
+	}
+	return NewContext(ctx, l.Fields(fields))
+}
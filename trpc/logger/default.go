@@ -1,18 +1,18 @@
 package logger
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
 	"runtime"
-	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 func init() {
-	lvl, err := GetLevel(os.Getenv("MICRO_LOG_LEVEL"))
+	lvl, err := GetLevel(os.Getenv("TIGER_LOG_LEVEL"))
 	if err != nil {
 		lvl = InfoLevel
 	}
@@ -23,10 +23,16 @@ func init() {
 type defaultLogger struct {
 	sync.RWMutex
 	opts Options
+
+	// serializes the writes to Out, shared with the derived loggers
+	outLock *sync.Mutex
 }
 
 // Init(opts...) should only overwrite provided options
 func (l *defaultLogger) Init(opts ...Option) error {
+	l.Lock()
+	defer l.Unlock()
+
 	for _, o := range opts {
 		o(&l.opts)
 	}
@@ -37,11 +43,18 @@ func (l *defaultLogger) String() string {
 	return "default"
 }
 
+// Fields returns a logger which writes the fields of l along with the given
+// ones, l itself is left as is so loggers can be derived per request
 func (l *defaultLogger) Fields(fields map[string]interface{}) Logger {
-	l.Lock()
-	l.opts.Fields = copyFields(fields)
-	l.Unlock()
-	return l
+	l.RLock()
+	opts := l.opts
+	opts.Fields = copyFields(l.opts.Fields)
+	l.RUnlock()
+
+	for k, v := range fields {
+		opts.Fields[k] = v
+	}
+	return &defaultLogger{opts: opts, outLock: l.outLock}
 }
 
 func copyFields(src map[string]interface{}) map[string]interface{} {
@@ -78,67 +91,68 @@ func logCallerfilePath(loggingFilePath string) string {
 
 func (l *defaultLogger) Log(level Level, v ...interface{}) {
 	// TODO decide does we need to write message if log level not used?
-	if !l.opts.Level.Enabled(level) {
+	if !l.enabled(level) {
 		return
 	}
+	l.write(level, l.caller(), fmt.Sprint(v...))
+}
 
-	l.RLock()
-	fields := copyFields(l.opts.Fields)
-	l.RUnlock()
-
-	fields["level"] = level.String()
-
-	if _, file, line, ok := runtime.Caller(l.opts.CallerSkipCount); ok {
-		fields["file"] = fmt.Sprintf("%s:%d", logCallerfilePath(file), line)
+func (l *defaultLogger) Logf(level Level, format string, v ...interface{}) {
+	//	 TODO decide does we need to write message if log level not used?
+	if !l.enabled(level) {
+		return
 	}
+	l.write(level, l.caller(), fmt.Sprintf(format, v...))
+}
 
-	keys := make([]string, 0, len(fields))
-
-	for k, _ := range fields {
-		keys = append(keys, k)
-	}
+func (l *defaultLogger) enabled(level Level) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.opts.Level.Enabled(level)
+}
 
-	sort.Strings(keys)
-	metadata := ""
+// caller returns the file:line of the Log or Logf caller
+func (l *defaultLogger) caller() string {
+	l.RLock()
+	skip := l.opts.CallerSkipCount
+	l.RUnlock()
 
-	for _, k := range keys {
-		metadata += fmt.Sprintf(" %s=%v", k, fields[k])
+	// skip this frame too
+	if _, file, line, ok := runtime.Caller(skip + 1); ok {
+		return fmt.Sprintf("%s:%d", logCallerfilePath(file), line)
 	}
-
-	t := time.Now().Format("2006-01-02 15:04:05")
-	fmt.Printf("%s %s %v\n", t, metadata, fmt.Sprint(v...))
+	return ""
 }
 
-func (l *defaultLogger) Logf(level Level, format string, v ...interface{}) {
-	//	 TODO decide does we need to write message if log level not used?
-	if level < l.opts.Level {
-		return
-	}
-
+// write encodes the entry in the configured format to Out
+func (l *defaultLogger) write(level Level, file, msg string) {
 	l.RLock()
 	fields := copyFields(l.opts.Fields)
+	out := l.opts.Out
+	format := l.opts.Format
 	l.RUnlock()
 
-	fields["level"] = level.String()
-
-	if _, file, line, ok := runtime.Caller(l.opts.CallerSkipCount); ok {
-		fields["file"] = fmt.Sprintf("%s:%d", logCallerfilePath(file), line)
+	if len(file) > 0 {
+		fields["file"] = file
 	}
 
-	keys := make([]string, 0, len(fields))
-	for k, _ := range fields {
-		keys = append(keys, k)
+	e := &entry{
+		time:   time.Now(),
+		level:  level,
+		fields: fields,
+		msg:    msg,
 	}
 
-	sort.Strings(keys)
-	metadata := ""
-
-	for _, k := range keys {
-		metadata += fmt.Sprintf(" %s=%v", k, fields[k])
+	var buf bytes.Buffer
+	if format == JSON {
+		encodeJSON(&buf, e)
+	} else {
+		encodeText(&buf, e)
 	}
 
-	t := time.Now().Format("2006-01-02 15:04:05")
-	fmt.Printf("%s %s %v\n", t, metadata, fmt.Sprintf(format, v...))
+	l.outLock.Lock()
+	out.Write(buf.Bytes())
+	l.outLock.Unlock()
 }
 
 func (l *defaultLogger) Options() Options {
@@ -161,7 +175,7 @@ func NewLogger(opts ...Option) Logger {
 		Context:         context.Background(),
 	}
 
-	l := &defaultLogger{opts: options}
+	l := &defaultLogger{opts: options, outLock: &sync.Mutex{}}
 	if err := l.Init(opts...); err != nil {
 		l.Log(FatalLevel, err)
 	}
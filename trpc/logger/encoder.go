@@ -0,0 +1,138 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Format is the encoding of the entries written by the default logger
+type Format int
+
+const (
+	// Text writes an entry as logfmt key=value pairs
+	Text Format = iota
+	// JSON writes an entry as a json object
+	JSON
+)
+
+func (f Format) String() string {
+	switch f {
+	case Text:
+		return "text"
+	case JSON:
+		return "json"
+	}
+	return ""
+}
+
+// entry is a line written by the default logger
+type entry struct {
+	time   time.Time
+	level  Level
+	fields map[string]interface{}
+	msg    string
+}
+
+// keys returns the sorted field keys, leaving out the ones written first
+func (e *entry) keys() []string {
+	keys := make([]string, 0, len(e.fields))
+	for k := range e.fields {
+		switch k {
+		case "time", "level", "msg":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// encodeText writes e in logfmt, quoting the values which need it
+func encodeText(buf *bytes.Buffer, e *entry) {
+	buf.WriteString("time=")
+	writeTextValue(buf, e.time.Format("2006-01-02 15:04:05"))
+	buf.WriteString(" level=")
+	buf.WriteString(e.level.String())
+
+	for _, k := range e.keys() {
+		buf.WriteByte(' ')
+		writeTextKey(buf, k)
+		buf.WriteByte('=')
+		writeTextValue(buf, fmt.Sprint(e.fields[k]))
+	}
+
+	buf.WriteString(" msg=")
+	writeTextValue(buf, e.msg)
+	buf.WriteByte('\n')
+}
+
+// writeTextKey writes k replacing the characters a logfmt key can't hold
+func writeTextKey(buf *bytes.Buffer, k string) {
+	if len(k) == 0 {
+		buf.WriteByte('_')
+		return
+	}
+	for _, r := range k {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f {
+			r = '_'
+		}
+		buf.WriteRune(r)
+	}
+}
+
+func writeTextValue(buf *bytes.Buffer, v string) {
+	if needsQuoting(v) {
+		buf.WriteString(strconv.Quote(v))
+		return
+	}
+	buf.WriteString(v)
+}
+
+func needsQuoting(v string) bool {
+	if len(v) == 0 {
+		return true
+	}
+	for _, r := range v {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f || r == utf8.RuneError {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeJSON writes e as a json object on a single line
+func encodeJSON(buf *bytes.Buffer, e *entry) {
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, e.time.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, e.level.String())
+
+	for _, k := range e.keys() {
+		buf.WriteByte(',')
+		writeJSONValue(buf, k)
+		buf.WriteByte(':')
+		writeJSONValue(buf, e.fields[k])
+	}
+
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, e.msg)
+	buf.WriteString("}\n")
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	// errors marshal as empty objects
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
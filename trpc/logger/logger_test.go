@@ -1,6 +1,12 @@
 package logger
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -16,3 +22,123 @@ func TestLogger(t *testing.T) {
 
 	l.Fields(map[string]interface{}{"key3": "val4"}).Log(InfoLevel, "test_msg")
 }
+
+func TestLoggerOutput(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewHelper(NewLogger(WithOutput(&buf))).WithFields(map[string]interface{}{
+		"service": "greeter",
+		"peer":    "10.0.0.1 port=80",
+		"empty":   "",
+	})
+
+	l.Infof("hello %s", "world")
+
+	line := buf.String()
+	if !strings.HasPrefix(line, "time=\"") || !strings.HasSuffix(line, "\n") {
+		t.Fatalf("unexpected line %q", line)
+	}
+	for _, want := range []string{
+		" level=info ",
+		` empty="" `,
+		` peer="10.0.0.1 port=80" `,
+		" service=greeter ",
+		" file=logger/logger_test.go:",
+		` msg="hello world"`,
+	} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("expected %q in %q", want, line)
+		}
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(WithOutput(&buf), WithFormat(JSON), WithFields(map[string]interface{}{
+		"error": errors.New("failed"),
+		"count": 2,
+	}))
+
+	l.Log(WarnLevel, "done")
+
+	var e map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("invalid json %q: %v", buf.String(), err)
+	}
+	if e["level"] != "warn" || e["msg"] != "done" || e["error"] != "failed" || e["count"] != float64(2) {
+		t.Fatalf("unexpected entry %v", e)
+	}
+	if _, ok := e["time"]; !ok {
+		t.Fatalf("expected time in %v", e)
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(WithOutput(&buf), WithLevel(WarnLevel))
+
+	l.Log(InfoLevel, "info")
+	l.Logf(InfoLevel, "info %d", 1)
+	l.Logf(ErrorLevel, "error %d", 1)
+
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Fatalf("expected 1 line got %d: %q", n, buf.String())
+	}
+}
+
+func TestLoggerContext(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(WithOutput(&buf), WithFields(map[string]interface{}{"service": "greeter"}))
+
+	ctx := NewContext(context.Background(), l.Fields(map[string]interface{}{"trace_id": "abc"}))
+	ctx = ContextWithFields(ctx, map[string]interface{}{"request_id": "1"})
+	Ctx(ctx).Infof("hello %s", "world")
+
+	line := buf.String()
+	for _, want := range []string{" service=greeter ", " trace_id=abc ", " request_id=1 ", " file=logger/logger_test.go:"} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("expected %q in %q", want, line)
+		}
+	}
+
+	// the request fields are not written by the parent logger
+	buf.Reset()
+	NewHelper(l).Info("parent")
+	if strings.Contains(buf.String(), "trace_id") || !strings.Contains(buf.String(), " service=greeter ") {
+		t.Fatalf("unexpected parent line %q", buf.String())
+	}
+}
+
+func TestLoggerContextDefault(t *testing.T) {
+	if Ctx(context.Background()) != DefaultLogger {
+		t.Fatal("expected the default logger without a logger in the context")
+	}
+}
+
+func TestLoggerConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(WithOutput(&buf))
+
+	// the loggers derived per request share the writes to Out
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := NewContext(context.Background(), l.Fields(map[string]interface{}{"worker": i}))
+			for j := 0; j < 50; j++ {
+				Ctx(ctx).Infof("line %d", j)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 400 {
+		t.Fatalf("expected 400 lines got %d", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "time=\"") || !strings.Contains(line, " worker=") || !strings.Contains(line, ` msg="line `) {
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+}
@@ -14,6 +14,8 @@ type Options struct {
 	Fields map[string]interface{}
 	// It's common to set this to a file, or leave it default which is `os.Stderr`
 	Out io.Writer
+	// The encoding of the entries, default is `Text`
+	Format Format
 	// Caller skip frame count for file:line info
 	CallerSkipCount int
 	// Alternative options
@@ -41,6 +43,13 @@ func WithOutput(out io.Writer) Option {
 	}
 }
 
+// WithFormat set the encoding of the entries written by the logger
+func WithFormat(f Format) Option {
+	return func(args *Options) {
+		args.Format = f
+	}
+}
+
 // WithCallerSkipCount set frame count to skip
 func WithCallerSkipCount(c int) Option {
 	return func(args *Options) {
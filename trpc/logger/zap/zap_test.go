@@ -1,9 +1,14 @@
 package zap
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/fztcjjl/tiger/trpc/logger"
+	"go.uber.org/zap"
 )
 
 func TestName(t *testing.T) {
@@ -42,3 +47,30 @@ func TestSetLevel(t *testing.T) {
 	logger.Init(logger.WithLevel(logger.InfoLevel))
 	l.Logf(logger.DebugLevel, "test non-show debug: %s", "debug msg")
 }
+
+func TestContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zap.log")
+	cfg := zap.NewProductionConfig()
+	cfg.OutputPaths = []string{path}
+
+	l, err := NewLogger(WithConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := logger.NewContext(context.Background(), l.Fields(map[string]interface{}{"trace_id": "abc"}))
+	ctx = logger.ContextWithFields(ctx, map[string]interface{}{"request_id": "1"})
+	logger.Ctx(ctx).Infof("hello %s", "world")
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e map[string]interface{}
+	if err := json.Unmarshal(b, &e); err != nil {
+		t.Fatalf("invalid json %q: %v", b, err)
+	}
+	if e["trace_id"] != "abc" || e["request_id"] != "1" || e["msg"] != "hello world" {
+		t.Fatalf("unexpected entry %v", e)
+	}
+}
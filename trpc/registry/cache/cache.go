@@ -0,0 +1,290 @@
+// Package cache provides a registry which caches the lookups of another one
+package cache
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/util/backoff"
+)
+
+// StaleKey is set to "true" in the metadata of services served past their
+// ttl because the registry couldn't be reached
+const StaleKey = "cache.stale"
+
+// Cache is a registry which caches service lookups
+type Cache interface {
+	registry.Registry
+	// Stop the cache watchers
+	Stop()
+}
+
+type cache struct {
+	registry.Registry
+	opts Options
+
+	sync.RWMutex
+	// entries keyed by domain then service name
+	entries map[string]map[string]*entry
+	// domains with a running watcher
+	watched map[string]bool
+	// lookups in flight keyed by domain and service
+	calls map[string]*call
+
+	exit chan bool
+}
+
+type entry struct {
+	services []*registry.Service
+	expiry   time.Time
+}
+
+type call struct {
+	wg       sync.WaitGroup
+	services []*registry.Service
+	err      error
+}
+
+// New returns a cache wrapping r. Every lookup is cached for the ttl and
+// kept up to date by watching the registry.
+func New(r registry.Registry, opt ...Option) Cache {
+	return &cache{
+		Registry: r,
+		opts:     newOptions(opt...),
+		entries:  make(map[string]map[string]*entry),
+		watched:  make(map[string]bool),
+		calls:    make(map[string]*call),
+		exit:     make(chan bool),
+	}
+}
+
+func (c *cache) quit() bool {
+	select {
+	case <-c.exit:
+		return true
+	default:
+		return false
+	}
+}
+
+// get returns the cached entry of service in domain
+func (c *cache) get(domain, service string) (*entry, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	e, ok := c.entries[domain][service]
+	return e, ok
+}
+
+func (c *cache) set(domain, service string, services []*registry.Service) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.entries[domain]; !ok {
+		c.entries[domain] = make(map[string]*entry)
+	}
+	c.entries[domain][service] = &entry{
+		services: registry.Copy(services),
+		expiry:   time.Now().Add(c.opts.TTL),
+	}
+}
+
+func (c *cache) del(domain, service string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.entries[domain], service)
+}
+
+// lookup gets service from the registry, concurrent lookups of the same
+// service share a single registry call
+func (c *cache) lookup(domain, service string) ([]*registry.Service, error) {
+	key := domain + "/" + service
+
+	c.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.Unlock()
+		cl.wg.Wait()
+		return cl.services, cl.err
+	}
+
+	cl := new(call)
+	cl.wg.Add(1)
+	c.calls[key] = cl
+	c.Unlock()
+
+	cl.services, cl.err = c.Registry.GetService(service, registry.GetDomain(domain))
+
+	c.Lock()
+	delete(c.calls, key)
+	c.Unlock()
+	cl.wg.Done()
+
+	return cl.services, cl.err
+}
+
+func (c *cache) GetService(service string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	var options registry.GetOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if len(options.Domain) == 0 {
+		options.Domain = registry.DefaultDomain
+	}
+
+	e, cached := c.get(options.Domain, service)
+	if cached && time.Now().Before(e.expiry) {
+		return registry.Copy(e.services), nil
+	}
+
+	services, err := c.lookup(options.Domain, service)
+	switch {
+	case err == nil:
+		c.set(options.Domain, service, services)
+		c.watch(options.Domain)
+		return registry.Copy(services), nil
+	case err == registry.ErrNotFound:
+		c.del(options.Domain, service)
+		return nil, err
+	}
+
+	// serve the last known nodes while the registry is unreachable
+	if cached && time.Since(e.expiry) < c.opts.MaxStale {
+		log.Debugf("Registry [cache] serving stale %s: %v", service, err)
+		return stale(e.services), nil
+	}
+
+	return nil, err
+}
+
+// stale returns a copy of services marked as stale
+func stale(services []*registry.Service) []*registry.Service {
+	services = registry.Copy(services)
+	for _, s := range services {
+		md := make(map[string]string, len(s.Metadata)+1)
+		for k, v := range s.Metadata {
+			md[k] = v
+		}
+		md[StaleKey] = "true"
+		s.Metadata = md
+	}
+	return services
+}
+
+// update applies a watcher result to the cached services
+func (c *cache) update(domain string, res *registry.Result) {
+	if res == nil || res.Service == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[domain][res.Service.Name]
+	// only keep services which were looked up
+	if !ok {
+		return
+	}
+
+	var services []*registry.Service
+	switch res.Action {
+	case "create", "update":
+		services = registry.Merge(e.services, []*registry.Service{res.Service})
+	case "delete":
+		services = registry.Remove(e.services, []*registry.Service{res.Service})
+	default:
+		return
+	}
+
+	if len(services) == 0 {
+		delete(c.entries[domain], res.Service.Name)
+		return
+	}
+
+	c.entries[domain][res.Service.Name] = &entry{
+		services: services,
+		expiry:   time.Now().Add(c.opts.TTL),
+	}
+}
+
+// watch starts watching domain unless already watched
+func (c *cache) watch(domain string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.watched[domain] || c.quit() {
+		return
+	}
+	c.watched[domain] = true
+
+	go c.run(domain)
+}
+
+// run keeps the entries of domain up to date, recreating the watcher
+// with backoff until the cache is stopped
+func (c *cache) run(domain string) {
+	var attempts int
+
+	for {
+		if c.quit() {
+			return
+		}
+
+		w, err := c.Registry.Watch(registry.WatchDomain(domain))
+		if err != nil {
+			log.Errorf("Registry [cache] watch %s error: %v", domain, err)
+		} else if c.next(domain, w) {
+			attempts = 0
+		}
+
+		attempts++
+		select {
+		case <-c.exit:
+			return
+		case <-time.After(backoff.Do(attempts)):
+		}
+	}
+}
+
+// next applies watcher results until the watcher fails. It reports
+// whether any result was received.
+func (c *cache) next(domain string, w registry.Watcher) bool {
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		select {
+		case <-c.exit:
+		case <-done:
+		}
+		w.Stop()
+	}()
+
+	var received bool
+	for {
+		res, err := w.Next()
+		if err != nil {
+			if !c.quit() {
+				log.Errorf("Registry [cache] watcher for %s stopped: %v", domain, err)
+			}
+			return received
+		}
+		received = true
+		c.update(domain, res)
+	}
+}
+
+func (c *cache) Stop() {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.quit() {
+		close(c.exit)
+	}
+}
+
+func (c *cache) String() string {
+	return "cache"
+}
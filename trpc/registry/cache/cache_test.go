@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/registry/memory"
+)
+
+var errUnavailable = errors.New("registry unavailable")
+
+// testRegistry counts lookups and fails them while down is set
+type testRegistry struct {
+	memory.Registry
+	lookups int32
+	down    int32
+	delay   time.Duration
+}
+
+func (r *testRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	time.Sleep(r.delay)
+	if atomic.LoadInt32(&r.down) == 1 {
+		return nil, errUnavailable
+	}
+	return r.Registry.GetService(name, opts...)
+}
+
+var testService = &registry.Service{
+	Name:    "foo",
+	Version: "1.0.0",
+	Nodes: []*registry.Node{
+		{
+			Id:      "foo-1",
+			Address: "localhost:9999",
+		},
+	},
+}
+
+func TestCacheGetService(t *testing.T) {
+	r := &testRegistry{Registry: memory.NewRegistry()}
+	defer r.Stop()
+	if err := r.Register(testService); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(r)
+	defer c.Stop()
+
+	for i := 0; i < 3; i++ {
+		services, err := c.GetService("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services) != 1 || len(services[0].Nodes) != 1 {
+			t.Fatalf("Unexpected services %v", services)
+		}
+	}
+
+	if n := atomic.LoadInt32(&r.lookups); n != 1 {
+		t.Fatalf("Expected 1 registry lookup, got %d", n)
+	}
+
+	if _, err := c.GetService("bar"); err != registry.ErrNotFound {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+}
+
+func TestCacheConcurrentLookups(t *testing.T) {
+	r := &testRegistry{Registry: memory.NewRegistry(), delay: 50 * time.Millisecond}
+	defer r.Stop()
+	if err := r.Register(testService); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(r)
+	defer c.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.GetService("foo"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&r.lookups); n != 1 {
+		t.Fatalf("Expected concurrent lookups to share 1 registry call, got %d", n)
+	}
+}
+
+func TestCacheWatch(t *testing.T) {
+	r := &testRegistry{Registry: memory.NewRegistry()}
+	defer r.Stop()
+	if err := r.Register(testService); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(r)
+	defer c.Stop()
+
+	if _, err := c.GetService("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// give the watcher time to start
+	time.Sleep(50 * time.Millisecond)
+
+	node := &registry.Node{Id: "foo-2", Address: "localhost:8888"}
+	svc := registry.CopyService(testService)
+	svc.Nodes = []*registry.Node{node}
+	if err := r.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		services, err := c.GetService("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services[0].Nodes) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected watched node to be cached, got %d nodes", len(services[0].Nodes))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&r.lookups); n != 1 {
+		t.Fatalf("Expected watch events to update the cache without lookups, got %d", n)
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	r := &testRegistry{Registry: memory.NewRegistry()}
+	defer r.Stop()
+	if err := r.Register(testService); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(r, WithTTL(10*time.Millisecond), WithMaxStale(100*time.Millisecond))
+	defer c.Stop()
+
+	if _, err := c.GetService("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&r.down, 1)
+	time.Sleep(20 * time.Millisecond)
+
+	services, err := c.GetService("foo")
+	if err != nil {
+		t.Fatalf("Expected stale services, got %v", err)
+	}
+	if services[0].Metadata[StaleKey] != "true" {
+		t.Fatal("Expected services to be marked stale")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := c.GetService("foo"); err != errUnavailable {
+		t.Fatalf("Expected error past the stale bound, got %v", err)
+	}
+
+	atomic.StoreInt32(&r.down, 0)
+
+	services, err = c.GetService("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := services[0].Metadata[StaleKey]; ok {
+		t.Fatal("Expected fresh services not to be marked stale")
+	}
+}
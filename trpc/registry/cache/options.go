@@ -0,0 +1,46 @@
+package cache
+
+import "time"
+
+var (
+	// DefaultTTL is how long a lookup is served from the cache
+	DefaultTTL = time.Minute
+	// DefaultMaxStale is how long past its ttl a lookup is still served
+	// while the registry can't be reached
+	DefaultMaxStale = 5 * time.Minute
+)
+
+type Options struct {
+	// TTL is the cache ttl of a service lookup
+	TTL time.Duration
+	// MaxStale bounds how long expired entries are served when the
+	// registry returns an error, 0 means never serve expired entries
+	MaxStale time.Duration
+}
+
+type Option func(o *Options)
+
+// WithTTL sets the cache TTL
+func WithTTL(t time.Duration) Option {
+	return func(o *Options) {
+		o.TTL = t
+	}
+}
+
+// WithMaxStale sets how long expired entries may be served on error
+func WithMaxStale(t time.Duration) Option {
+	return func(o *Options) {
+		o.MaxStale = t
+	}
+}
+
+func newOptions(opt ...Option) Options {
+	opts := Options{
+		TTL:      DefaultTTL,
+		MaxStale: DefaultMaxStale,
+	}
+	for _, o := range opt {
+		o(&opts)
+	}
+	return opts
+}
@@ -0,0 +1,473 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/fztcjjl/tiger/trpc/registry"
+	hash "github.com/mitchellh/hashstructure"
+)
+
+var (
+	// DefaultAddress of the consul agent
+	DefaultAddress = "127.0.0.1:8500"
+	// DefaultDeregisterCriticalServiceAfter is how long consul keeps a
+	// node whose ttl check is failing
+	DefaultDeregisterCriticalServiceAfter = time.Minute
+	// DefaultWaitTime of blocking queries
+	DefaultWaitTime = 5 * time.Minute
+
+	errCheckNotFound = errors.New("check not found")
+)
+
+type consulRegistry struct {
+	opts registry.Options
+
+	sync.RWMutex
+	client *http.Client
+	// base url of the agent http api
+	address string
+	// hash of the last registration of each node keyed by domain and id,
+	// unchanged nodes only pass their ttl check
+	register map[string]uint64
+}
+
+// NewRegistry returns a registry backed by the consul agent http api
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	c := &consulRegistry{
+		opts: registry.Options{
+			Context: context.Background(),
+		},
+		register: make(map[string]uint64),
+	}
+	configure(c, opts...)
+	return c
+}
+
+// configure will setup the registry with new options
+func configure(c *consulRegistry, opts ...registry.Option) error {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, o := range opts {
+		o(&c.opts)
+	}
+
+	if c.opts.Timeout == 0 {
+		c.opts.Timeout = 5 * time.Second
+	}
+
+	addr := DefaultAddress
+	for _, a := range c.opts.Addrs {
+		if len(a) > 0 {
+			addr = a
+			break
+		}
+	}
+
+	scheme := "http"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.opts.Secure || c.opts.TLSConfig != nil {
+		scheme = "https"
+		tlsConfig := c.opts.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{
+				InsecureSkipVerify: true,
+			}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if !strings.Contains(addr, "://") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "8500")
+		}
+		addr = scheme + "://" + addr
+	}
+
+	c.address = strings.TrimSuffix(addr, "/")
+	// requests are bounded by their context, blocking queries take longer
+	// than the registry timeout
+	c.client = &http.Client{Transport: transport}
+
+	return nil
+}
+
+func (c *consulRegistry) value(k interface{}) interface{} {
+	c.RLock()
+	defer c.RUnlock()
+	if c.opts.Context == nil {
+		return nil
+	}
+	return c.opts.Context.Value(k)
+}
+
+func (c *consulRegistry) namespaces() bool {
+	b, _ := c.value(namespacesKey{}).(bool)
+	return b
+}
+
+func (c *consulRegistry) waitTime() time.Duration {
+	if d, ok := c.value(waitTimeKey{}).(time.Duration); ok && d > 0 {
+		return d
+	}
+	return DefaultWaitTime
+}
+
+func (c *consulRegistry) deregisterAfter() time.Duration {
+	if d, ok := c.value(deregisterAfterKey{}).(time.Duration); ok && d > 0 {
+		return d
+	}
+	return DefaultDeregisterCriticalServiceAfter
+}
+
+// domainQuery scopes a request to domain, either through the namespace or
+// the domain tag
+func (c *consulRegistry) domainQuery(domain string) url.Values {
+	q := url.Values{}
+	if c.namespaces() {
+		q.Set("ns", domain)
+	} else if domain != registry.WildcardDomain {
+		q.Set("tag", domainTag+domain)
+	}
+	return q
+}
+
+// do sends a request to the agent, decoding the response into out. It
+// returns the consul index of blocking queries.
+func (c *consulRegistry) do(ctx context.Context, method, path string, q url.Values, in, out interface{}) (uint64, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	c.RLock()
+	u := c.address + path
+	client := c.client
+	c.RUnlock()
+
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	if t, ok := c.value(tokenKey{}).(string); ok && len(t) > 0 {
+		req.Header.Set("X-Consul-Token", t)
+	}
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(rsp.Body)
+		if rsp.StatusCode == http.StatusNotFound && strings.HasPrefix(path, "/v1/agent/check/") {
+			return 0, errCheckNotFound
+		}
+		return 0, fmt.Errorf("consul: %s %s: %d %s", method, path, rsp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	index, _ := strconv.ParseUint(rsp.Header.Get("X-Consul-Index"), 10, 64)
+
+	if out != nil {
+		if err := json.NewDecoder(rsp.Body).Decode(out); err != nil {
+			return 0, err
+		}
+	}
+
+	return index, nil
+}
+
+func (c *consulRegistry) Init(opts ...registry.Option) error {
+	return configure(c, opts...)
+}
+
+func (c *consulRegistry) Options() registry.Options {
+	c.RLock()
+	defer c.RUnlock()
+	return c.opts
+}
+
+func (c *consulRegistry) timeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.Options().Timeout)
+}
+
+func (c *consulRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("Require at least one node")
+	}
+
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if len(options.Domain) == 0 {
+		options.Domain = registry.DefaultDomain
+	}
+
+	for _, node := range s.Nodes {
+		if err := c.registerNode(s, node, options); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *consulRegistry) registerNode(s *registry.Service, node *registry.Node, options registry.RegisterOptions) error {
+	svc, err := toAgentService(s, node, options.Domain, !c.namespaces())
+	if err != nil {
+		return err
+	}
+
+	if options.TTL > 0 {
+		svc.Check = &agentCheck{
+			CheckID:                        checkID(node.Id),
+			TTL:                            options.TTL.String(),
+			DeregisterCriticalServiceAfter: c.deregisterAfter().String(),
+		}
+	}
+
+	h, err := hash.Hash(svc, nil)
+	if err != nil {
+		return err
+	}
+
+	key := options.Domain + "/" + node.Id
+
+	c.RLock()
+	v, ok := c.register[key]
+	c.RUnlock()
+
+	q := url.Values{}
+	if c.namespaces() {
+		q.Set("ns", options.Domain)
+	}
+
+	// the node is unchanged so only pass its check
+	if ok && v == h {
+		if options.TTL == 0 {
+			return nil
+		}
+		err := c.pass(node.Id, q)
+		if err == nil {
+			return nil
+		}
+		if err != errCheckNotFound {
+			return err
+		}
+		// the agent lost the node, register it again
+		log.Infof("Registry [consul] check of %s not found, registering again", node.Id)
+	}
+
+	ctx, cancel := c.timeout()
+	defer cancel()
+
+	if _, err := c.do(ctx, http.MethodPut, "/v1/agent/service/register", q, svc, nil); err != nil {
+		return err
+	}
+
+	// ttl checks start critical so pass them straight away
+	if options.TTL > 0 {
+		if err := c.pass(node.Id, q); err != nil {
+			return err
+		}
+	}
+
+	c.Lock()
+	c.register[key] = h
+	c.Unlock()
+
+	return nil
+}
+
+func checkID(id string) string {
+	return "service:" + id
+}
+
+// pass marks the ttl check of node as passing
+func (c *consulRegistry) pass(id string, q url.Values) error {
+	ctx, cancel := c.timeout()
+	defer cancel()
+
+	_, err := c.do(ctx, http.MethodPut, "/v1/agent/check/pass/"+url.PathEscape(checkID(id)), q, nil, nil)
+	return err
+}
+
+func (c *consulRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	if len(s.Nodes) == 0 {
+		return errors.New("Require at least one node")
+	}
+
+	var options registry.DeregisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if len(options.Domain) == 0 {
+		options.Domain = registry.DefaultDomain
+	}
+
+	q := url.Values{}
+	if c.namespaces() {
+		q.Set("ns", options.Domain)
+	}
+
+	for _, node := range s.Nodes {
+		c.Lock()
+		delete(c.register, options.Domain+"/"+node.Id)
+		c.Unlock()
+
+		ctx, cancel := c.timeout()
+		_, err := c.do(ctx, http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(node.Id), q, nil, nil)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// health returns the passing entries of service, blocking until the index
+// changes if index is set
+func (c *consulRegistry) health(ctx context.Context, service, domain string, index uint64) ([]*serviceEntry, uint64, error) {
+	q := c.domainQuery(domain)
+	q.Set("passing", "1")
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", c.waitTime().String())
+	}
+
+	var entries []*serviceEntry
+	idx, err := c.do(ctx, http.MethodGet, "/v1/health/service/"+url.PathEscape(service), q, nil, &entries)
+	return entries, idx, err
+}
+
+func (c *consulRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	var options registry.GetOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if len(options.Domain) == 0 {
+		options.Domain = registry.DefaultDomain
+	}
+
+	ctx, cancel := c.timeout()
+	defer cancel()
+
+	entries, _, err := c.health(ctx, name, options.Domain, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	return toServices(entries), nil
+}
+
+// catalog returns the service names of domain, blocking until the index
+// changes if index is set
+func (c *consulRegistry) catalog(ctx context.Context, domain string, index uint64) ([]string, uint64, error) {
+	q := url.Values{}
+	if c.namespaces() {
+		q.Set("ns", domain)
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", c.waitTime().String())
+	}
+
+	var rsp map[string][]string
+	idx, err := c.do(ctx, http.MethodGet, "/v1/catalog/services", q, nil, &rsp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var names []string
+	for name, tags := range rsp {
+		// skip consul itself
+		if name == "consul" {
+			continue
+		}
+		if c.namespaces() || domain == registry.WildcardDomain || hasTag(tags, domainTag+domain) {
+			names = append(names, name)
+		}
+	}
+
+	return names, idx, nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *consulRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	var options registry.ListOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if len(options.Domain) == 0 {
+		options.Domain = registry.DefaultDomain
+	}
+
+	ctx, cancel := c.timeout()
+	defer cancel()
+
+	names, _, err := c.catalog(ctx, options.Domain, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]*registry.Service, 0, len(names))
+	for _, name := range names {
+		services = append(services, &registry.Service{Name: name})
+	}
+
+	return services, nil
+}
+
+func (c *consulRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+	if len(wo.Domain) == 0 {
+		wo.Domain = registry.DefaultDomain
+	}
+
+	return newConsulWatcher(c, wo), nil
+}
+
+func (c *consulRegistry) String() string {
+	return "consul"
+}
@@ -0,0 +1,413 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+// fakeConsul implements the parts of the consul http api used by the registry
+type fakeConsul struct {
+	sync.Mutex
+	index uint64
+	// the index of the last change of the service list, health changes
+	// don't move it
+	catalogIndex uint64
+	changed      chan struct{}
+	services     map[string]*fakeService
+	tokens       []string
+}
+
+type fakeService struct {
+	ns      string
+	svc     *agentService
+	passing bool
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:        1,
+		catalogIndex: 1,
+		changed:      make(chan struct{}),
+		services:     make(map[string]*fakeService),
+	}
+}
+
+// bump moves the index and wakes up blocking queries, called with the lock held
+func (f *fakeConsul) bump() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// setPassing changes the health of a service as a ttl check would
+func (f *fakeConsul) setPassing(id string, passing bool) {
+	f.Lock()
+	defer f.Unlock()
+	if s, ok := f.services[id]; ok && s.passing != passing {
+		s.passing = passing
+		f.bump()
+	}
+}
+
+// block waits for index to move past the index of the query, index is
+// called with the lock held
+func (f *fakeConsul) block(r *http.Request, index func() uint64) {
+	idx, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+	timeout := time.After(wait)
+
+	for {
+		f.Lock()
+		if idx == 0 || idx != index() {
+			f.Unlock()
+			return
+		}
+		ch := f.changed
+		f.Unlock()
+
+		select {
+		case <-ch:
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ns := q.Get("ns")
+
+	f.Lock()
+	f.tokens = append(f.tokens, r.Header.Get("X-Consul-Token"))
+	f.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/agent/service/register":
+		var svc agentService
+		if err := json.NewDecoder(r.Body).Decode(&svc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.Lock()
+		f.services[svc.ID] = &fakeService{ns: ns, svc: &svc, passing: svc.Check == nil}
+		f.bump()
+		f.catalogIndex = f.index
+		f.Unlock()
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		f.Lock()
+		delete(f.services, id)
+		f.bump()
+		f.catalogIndex = f.index
+		f.Unlock()
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/agent/check/pass/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/pass/service:")
+		f.Lock()
+		defer f.Unlock()
+		s, ok := f.services[id]
+		if !ok || s.svc.Check == nil {
+			http.Error(w, "Unknown check", http.StatusNotFound)
+			return
+		}
+		if !s.passing {
+			s.passing = true
+			f.bump()
+		}
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		f.block(r, func() uint64 { return f.index })
+		name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		tag := q.Get("tag")
+
+		f.Lock()
+		entries := []*serviceEntry{}
+		for _, s := range f.services {
+			if s.svc.Name != name || (len(ns) > 0 && ns != "*" && s.ns != ns) {
+				continue
+			}
+			if len(tag) > 0 && !hasTag(s.svc.Tags, tag) {
+				continue
+			}
+			if len(q.Get("passing")) > 0 && !s.passing {
+				continue
+			}
+			e := new(serviceEntry)
+			e.Node.Address = "127.0.0.1"
+			e.Service.ID = s.svc.ID
+			e.Service.Service = s.svc.Name
+			e.Service.Tags = s.svc.Tags
+			e.Service.Address = s.svc.Address
+			e.Service.Port = s.svc.Port
+			e.Service.Meta = s.svc.Meta
+			entries = append(entries, e)
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		f.Unlock()
+
+		json.NewEncoder(w).Encode(entries)
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/catalog/services":
+		f.block(r, func() uint64 { return f.catalogIndex })
+
+		f.Lock()
+		rsp := map[string][]string{"consul": {}}
+		for _, s := range f.services {
+			if len(ns) > 0 && ns != "*" && s.ns != ns {
+				continue
+			}
+			rsp[s.svc.Name] = append(rsp[s.svc.Name], s.svc.Tags...)
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.catalogIndex, 10))
+		f.Unlock()
+
+		json.NewEncoder(w).Encode(rsp)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+var testService = &registry.Service{
+	Name:     "foo",
+	Version:  "1.0.0",
+	Metadata: map[string]string{"owner": "bar"},
+	Endpoints: []*registry.Endpoint{
+		{
+			Name:     "Foo.Bar",
+			Request:  &registry.Value{Name: "Request", Type: "Request"},
+			Response: &registry.Value{Name: "Response", Type: "Response"},
+		},
+	},
+	Nodes: []*registry.Node{
+		{
+			Id:       "foo-1",
+			Address:  "10.0.0.1:9000",
+			Metadata: map[string]string{"zone": "a"},
+		},
+	},
+}
+
+func newTestRegistry(t *testing.T, opts ...registry.Option) (*fakeConsul, registry.Registry) {
+	f := newFakeConsul()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	opts = append([]registry.Option{registry.Addrs(srv.URL), WaitTime(time.Second)}, opts...)
+	return f, NewRegistry(opts...)
+}
+
+func TestConsulRegistry(t *testing.T) {
+	f, r := newTestRegistry(t, Token("secret"))
+
+	if err := r.Register(testService, registry.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Lock()
+	s := f.services["foo-1"]
+	f.Unlock()
+	if s == nil || s.svc.Check == nil || s.svc.Check.TTL != "1m0s" || !s.passing {
+		t.Fatalf("Expected passing ttl check, got %+v", s)
+	}
+	if s.svc.Meta["zone"] != "a" || s.svc.Meta[serviceMetaPrefix+"owner"] != "bar" {
+		t.Fatalf("Expected metadata in consul meta, got %v", s.svc.Meta)
+	}
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("Expected 1 service, got %d", len(services))
+	}
+	svc := services[0]
+	if svc.Version != "1.0.0" || svc.Metadata["owner"] != "bar" {
+		t.Fatalf("Unexpected service %+v", svc)
+	}
+	if len(svc.Endpoints) != 1 || svc.Endpoints[0].Name != "Foo.Bar" {
+		t.Fatalf("Expected endpoints to round trip, got %v", svc.Endpoints)
+	}
+	if len(svc.Nodes) != 1 || svc.Nodes[0].Address != "10.0.0.1:9000" || svc.Nodes[0].Metadata["zone"] != "a" {
+		t.Fatalf("Unexpected nodes %v", svc.Nodes)
+	}
+
+	list, err := r.ListServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "foo" {
+		t.Fatalf("Expected only foo to be listed, got %v", list)
+	}
+
+	if err := r.Deregister(testService); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	for _, tok := range f.tokens {
+		if tok != "secret" {
+			t.Fatalf("Expected token on every request, got %q", tok)
+		}
+	}
+}
+
+func TestConsulRegistryReregister(t *testing.T) {
+	f, r := newTestRegistry(t)
+
+	if err := r.Register(testService, registry.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the agent forgets the node, e.g. after a restart
+	f.Lock()
+	delete(f.services, "foo-1")
+	f.Unlock()
+
+	if err := r.Register(testService, registry.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.GetService("foo"); err != nil {
+		t.Fatalf("Expected the node to be registered again, got %v", err)
+	}
+}
+
+func TestConsulRegistryDomains(t *testing.T) {
+	for _, namespaces := range []bool{false, true} {
+		var opts []registry.Option
+		if namespaces {
+			opts = append(opts, Namespaces())
+		}
+		_, r := newTestRegistry(t, opts...)
+
+		for _, d := range []string{"foo", "bar"} {
+			svc := registry.CopyService(testService)
+			svc.Version = d
+			svc.Nodes[0].Id = "foo-" + d
+			if err := r.Register(svc, registry.RegisterDomain(d)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := r.GetService("foo"); err != registry.ErrNotFound {
+			t.Fatalf("Expected not found in the default domain, got %v", err)
+		}
+
+		services, err := r.GetService("foo", registry.GetDomain("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services) != 1 || services[0].Version != "bar" {
+			t.Fatalf("Expected only the bar version, got %v", services)
+		}
+
+		services, err = r.GetService("foo", registry.GetDomain(registry.WildcardDomain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services) != 2 {
+			t.Fatalf("Expected 2 versions across domains, got %d", len(services))
+		}
+	}
+}
+
+func TestConsulWatcher(t *testing.T) {
+	_, r := newTestRegistry(t)
+
+	if err := r.Register(testService); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range [][]registry.WatchOption{{registry.WatchService("foo")}, nil} {
+		w, err := r.Watch(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next := func(action string) *registry.Service {
+			res, err := w.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Action != action {
+				t.Fatalf("Expected %s got %s", action, res.Action)
+			}
+			return res.Service
+		}
+
+		// the current nodes come first
+		if svc := next("create"); svc.Nodes[0].Id != "foo-1" {
+			t.Fatalf("Expected create of foo-1, got %v", svc.Nodes[0])
+		}
+
+		updated := registry.CopyService(testService)
+		updated.Nodes[0].Metadata = map[string]string{"zone": "b"}
+		if err := r.Register(updated); err != nil {
+			t.Fatal(err)
+		}
+		if svc := next("update"); svc.Nodes[0].Metadata["zone"] != "b" {
+			t.Fatalf("Expected update to zone b, got %v", svc.Nodes[0].Metadata)
+		}
+
+		if err := r.Deregister(updated); err != nil {
+			t.Fatal(err)
+		}
+		next("delete")
+
+		w.Stop()
+		if _, err := w.Next(); err != registry.ErrWatcherStopped {
+			t.Fatalf("Expected watcher stopped, got %v", err)
+		}
+
+		if err := r.Register(testService); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConsulWatcherHealth(t *testing.T) {
+	f, r := newTestRegistry(t)
+
+	if err := r.Register(testService, registry.RegisterTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range [][]registry.WatchOption{{registry.WatchService("foo")}, nil} {
+		w, err := r.Watch(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next := func(action string) {
+			res, err := w.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Action != action || res.Service.Nodes[0].Id != "foo-1" {
+				t.Fatalf("Expected %s of foo-1, got %s of %v", action, res.Action, res.Service.Nodes[0])
+			}
+		}
+
+		next("create")
+
+		// the check going critical doesn't change the catalog
+		f.setPassing("foo-1", false)
+		next("delete")
+
+		f.setPassing("foo-1", true)
+		next("create")
+
+		w.Stop()
+	}
+}
@@ -0,0 +1,198 @@
+package consul
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+const (
+	// meta key holding the service version
+	versionMeta = "tiger_version"
+	// prefix of the meta keys holding service metadata, node metadata
+	// is stored without a prefix
+	serviceMetaPrefix = "tiger_svc_"
+
+	// tag holding the registry domain
+	domainTag = "tiger-domain="
+	// tag holding the encoded endpoints
+	endpointsTag = "tiger-endpoints="
+)
+
+// agentService is the registration of a node with the consul agent
+type agentService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Address string            `json:"Address,omitempty"`
+	Port    int               `json:"Port,omitempty"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Check   *agentCheck       `json:"Check,omitempty"`
+}
+
+type agentCheck struct {
+	CheckID                        string `json:"CheckID,omitempty"`
+	TTL                            string `json:"TTL,omitempty"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+// serviceEntry is an entry of the health endpoint
+type serviceEntry struct {
+	Node struct {
+		Node    string `json:"Node"`
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Tags    []string          `json:"Tags"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+	} `json:"Service"`
+}
+
+// toAgentService maps a single node of s to a consul registration
+func toAgentService(s *registry.Service, node *registry.Node, domain string, tagDomain bool) (*agentService, error) {
+	host, port, err := net.SplitHostPort(node.Address)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := make(map[string]string, len(s.Metadata)+len(node.Metadata)+1)
+	for k, v := range node.Metadata {
+		meta[k] = v
+	}
+	for k, v := range s.Metadata {
+		meta[serviceMetaPrefix+k] = v
+	}
+	meta[versionMeta] = s.Version
+
+	var tags []string
+	if tagDomain {
+		tags = append(tags, domainTag+domain)
+	}
+	if len(s.Endpoints) > 0 {
+		ep, err := encodeEndpoints(s.Endpoints)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, endpointsTag+ep)
+	}
+
+	return &agentService{
+		ID:      node.Id,
+		Name:    s.Name,
+		Tags:    tags,
+		Address: host,
+		Port:    p,
+		Meta:    meta,
+	}, nil
+}
+
+// toServices groups health entries into services by version
+func toServices(entries []*serviceEntry) []*registry.Service {
+	versions := make(map[string]*registry.Service)
+	var services []*registry.Service
+
+	for _, e := range entries {
+		version := e.Service.Meta[versionMeta]
+
+		svc, ok := versions[version]
+		if !ok {
+			svc = &registry.Service{
+				Name:     e.Service.Service,
+				Version:  version,
+				Metadata: make(map[string]string),
+			}
+			versions[version] = svc
+			services = append(services, svc)
+		}
+
+		md := make(map[string]string)
+		for k, v := range e.Service.Meta {
+			switch {
+			case k == versionMeta:
+			case strings.HasPrefix(k, serviceMetaPrefix):
+				svc.Metadata[strings.TrimPrefix(k, serviceMetaPrefix)] = v
+			default:
+				md[k] = v
+			}
+		}
+
+		for _, tag := range e.Service.Tags {
+			if strings.HasPrefix(tag, endpointsTag) && svc.Endpoints == nil {
+				if eps, err := decodeEndpoints(strings.TrimPrefix(tag, endpointsTag)); err == nil {
+					svc.Endpoints = eps
+				}
+			}
+		}
+
+		// the service address falls back to the agent address
+		host := e.Service.Address
+		if len(host) == 0 {
+			host = e.Node.Address
+		}
+
+		svc.Nodes = append(svc.Nodes, &registry.Node{
+			Id:       e.Service.ID,
+			Address:  net.JoinHostPort(host, strconv.Itoa(e.Service.Port)),
+			Metadata: md,
+		})
+	}
+
+	return services
+}
+
+func encodeEndpoints(eps []*registry.Endpoint) (string, error) {
+	b, err := json.Marshal(eps)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeEndpoints(s string) ([]*registry.Endpoint, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	rb, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	var eps []*registry.Endpoint
+	if err := json.Unmarshal(rb, &eps); err != nil {
+		return nil, err
+	}
+	return eps, nil
+}
@@ -0,0 +1,45 @@
+// Package consul provides a consul service registry
+package consul
+
+import (
+	"context"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+type tokenKey struct{}
+type namespacesKey struct{}
+type deregisterAfterKey struct{}
+type waitTimeKey struct{}
+
+// Token sets the ACL token sent with every request
+func Token(t string) registry.Option {
+	return setOption(tokenKey{}, t)
+}
+
+// Namespaces maps registry domains to consul namespaces, which requires
+// consul enterprise. By default domains are kept in a service tag.
+func Namespaces() registry.Option {
+	return setOption(namespacesKey{}, true)
+}
+
+// DeregisterCriticalServiceAfter sets how long consul keeps a node whose
+// ttl check is failing before removing it
+func DeregisterCriticalServiceAfter(d time.Duration) registry.Option {
+	return setOption(deregisterAfterKey{}, d)
+}
+
+// WaitTime sets how long the blocking queries of a watcher wait for changes
+func WaitTime(d time.Duration) registry.Option {
+	return setOption(waitTimeKey{}, d)
+}
+
+func setOption(k, v interface{}) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
@@ -0,0 +1,209 @@
+package consul
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+// consulWatcher turns the blocking queries of the health and catalog
+// endpoints into results. It sends the current nodes first and then the
+// nodes which changed each time the consul index moves. Every watched
+// service has its own health query since a failing check doesn't move the
+// catalog index.
+type consulWatcher struct {
+	c  *consulRegistry
+	wo registry.WatchOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	next chan *registry.Result
+	errs chan error
+
+	// guards nodes and serializes the results of the health queries
+	sync.Mutex
+	// nodes last seen keyed by service name then node id, each held in a
+	// single node copy of its service
+	nodes map[string]map[string]*registry.Service
+}
+
+func newConsulWatcher(c *consulRegistry, wo registry.WatchOptions) *consulWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &consulWatcher{
+		c:      c,
+		wo:     wo,
+		ctx:    ctx,
+		cancel: cancel,
+		next:   make(chan *registry.Result),
+		errs:   make(chan error, 1),
+		nodes:  make(map[string]map[string]*registry.Service),
+	}
+
+	if len(wo.Service) > 0 {
+		go w.watchHealth(ctx, wo.Service)
+	} else {
+		go w.watchCatalog()
+	}
+
+	return w
+}
+
+// watchHealth follows the health of a single service until ctx is done
+func (w *consulWatcher) watchHealth(ctx context.Context, name string) {
+	var index uint64
+	for {
+		entries, idx, err := w.c.health(ctx, name, w.wo.Domain, index)
+		if err != nil {
+			if ctx.Err() == nil {
+				w.fail(err)
+			}
+			return
+		}
+		if !w.update(ctx, name, toServices(entries)) {
+			return
+		}
+		index = nextIndex(index, idx)
+	}
+}
+
+// watchCatalog follows the service list, starting a health query for
+// every service added and stopping it once the service is gone
+func (w *consulWatcher) watchCatalog() {
+	watches := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range watches {
+			cancel()
+		}
+	}()
+
+	var index uint64
+	for {
+		names, idx, err := w.c.catalog(w.ctx, w.wo.Domain, index)
+		if err != nil {
+			w.fail(err)
+			return
+		}
+
+		seen := make(map[string]bool, len(names))
+		for _, name := range names {
+			seen[name] = true
+			if _, ok := watches[name]; ok {
+				continue
+			}
+			ctx, cancel := context.WithCancel(w.ctx)
+			watches[name] = cancel
+			go w.watchHealth(ctx, name)
+		}
+
+		// services gone from the catalog
+		for name, cancel := range watches {
+			if seen[name] {
+				continue
+			}
+			cancel()
+			delete(watches, name)
+			if !w.update(w.ctx, name, nil) {
+				return
+			}
+		}
+
+		index = nextIndex(index, idx)
+	}
+}
+
+// nextIndex returns the index of the next blocking query, resetting it
+// if the consul index went backwards
+func nextIndex(prev, idx uint64) uint64 {
+	if idx < prev {
+		return 0
+	}
+	return idx
+}
+
+// update sends the difference between the nodes last seen for name and
+// services. It returns false if ctx is done. The results are sent with the
+// lock held so those of a service stopped in the meantime can't follow
+// its delete.
+func (w *consulWatcher) update(ctx context.Context, name string, services []*registry.Service) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	nodes := make(map[string]*registry.Service)
+	for _, svc := range services {
+		for _, n := range svc.Nodes {
+			nodes[n.Id] = &registry.Service{
+				Name:      svc.Name,
+				Version:   svc.Version,
+				Metadata:  svc.Metadata,
+				Endpoints: svc.Endpoints,
+				Nodes:     []*registry.Node{n},
+			}
+		}
+	}
+
+	old := w.nodes[name]
+
+	var results []*registry.Result
+	for id, svc := range nodes {
+		prev, ok := old[id]
+		switch {
+		case !ok:
+			results = append(results, &registry.Result{Action: "create", Service: svc})
+		case !reflect.DeepEqual(prev, svc):
+			results = append(results, &registry.Result{Action: "update", Service: svc})
+		}
+	}
+	for id, svc := range old {
+		if _, ok := nodes[id]; !ok {
+			results = append(results, &registry.Result{Action: "delete", Service: svc})
+		}
+	}
+
+	if len(nodes) == 0 {
+		delete(w.nodes, name)
+	} else {
+		w.nodes[name] = nodes
+	}
+
+	for _, r := range results {
+		select {
+		case w.next <- r:
+		case <-w.ctx.Done():
+			return false
+		}
+	}
+
+	return true
+}
+
+// fail reports err to Next, only the first error of the health and
+// catalog queries is kept
+func (w *consulWatcher) fail(err error) {
+	select {
+	case <-w.ctx.Done():
+	case w.errs <- err:
+	default:
+	}
+}
+
+func (w *consulWatcher) Next() (*registry.Result, error) {
+	select {
+	case r := <-w.next:
+		return r, nil
+	case err := <-w.errs:
+		return nil, err
+	case <-w.ctx.Done():
+		return nil, registry.ErrWatcherStopped
+	}
+}
+
+func (w *consulWatcher) Stop() {
+	w.cancel()
+}
@@ -0,0 +1,169 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+var (
+	// DefaultPort is the port of nodes resolved through A/AAAA records
+	DefaultPort = 8080
+	// DefaultRefreshInterval is how often watched services are resolved
+	DefaultRefreshInterval = 30 * time.Second
+	// DefaultTimeout of a lookup
+	DefaultTimeout = 5 * time.Second
+)
+
+// Resolver looks up dns records, it is satisfied by *net.Resolver
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// dnsRegistry resolves service names into nodes. Names starting with an
+// underscore, e.g. _grpc._tcp.foo.default.svc.cluster.local, are looked up
+// as SRV records, any other name as A/AAAA records. A port in the name,
+// e.g. foo.default.svc.cluster.local:9000, overrides the default port.
+type dnsRegistry struct {
+	sync.RWMutex
+	opts registry.Options
+}
+
+// NewRegistry returns a registry resolving services through dns. The
+// records are managed outside of the registry so registering is a noop.
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	d := &dnsRegistry{
+		opts: registry.Options{
+			Context: context.Background(),
+			Timeout: DefaultTimeout,
+		},
+	}
+	d.Init(opts...)
+	return d
+}
+
+func (d *dnsRegistry) Init(opts ...registry.Option) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, o := range opts {
+		o(&d.opts)
+	}
+	return nil
+}
+
+func (d *dnsRegistry) Options() registry.Options {
+	d.RLock()
+	defer d.RUnlock()
+	return d.opts
+}
+
+func (d *dnsRegistry) resolver() Resolver {
+	if r, ok := d.Options().Context.Value(resolverKey{}).(Resolver); ok && r != nil {
+		return r
+	}
+	return net.DefaultResolver
+}
+
+func (d *dnsRegistry) port() int {
+	if p, ok := d.Options().Context.Value(portKey{}).(int); ok && p > 0 {
+		return p
+	}
+	return DefaultPort
+}
+
+func (d *dnsRegistry) refreshInterval() time.Duration {
+	if r, ok := d.Options().Context.Value(refreshKey{}).(time.Duration); ok && r > 0 {
+		return r
+	}
+	return DefaultRefreshInterval
+}
+
+func (d *dnsRegistry) Register(*registry.Service, ...registry.RegisterOption) error {
+	return nil
+}
+
+func (d *dnsRegistry) Deregister(*registry.Service, ...registry.DeregisterOption) error {
+	return nil
+}
+
+func (d *dnsRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	timeout := d.Options().Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var addrs []string
+
+	if strings.HasPrefix(name, "_") {
+		_, srvs, err := d.resolver().LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, lookupError(err)
+		}
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	} else {
+		host, port := name, strconv.Itoa(d.port())
+		if h, p, err := net.SplitHostPort(name); err == nil {
+			host, port = h, p
+		}
+		hosts, err := d.resolver().LookupHost(ctx, host)
+		if err != nil {
+			return nil, lookupError(err)
+		}
+		for _, h := range hosts {
+			addrs = append(addrs, net.JoinHostPort(h, port))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, registry.ErrNotFound
+	}
+	sort.Strings(addrs)
+
+	svc := &registry.Service{Name: name}
+	for _, addr := range addrs {
+		svc.Nodes = append(svc.Nodes, &registry.Node{
+			Id:      name + "-" + addr,
+			Address: addr,
+		})
+	}
+
+	return []*registry.Service{svc}, nil
+}
+
+// lookupError maps a name without records to ErrNotFound
+func lookupError(err error) error {
+	if derr, ok := err.(*net.DNSError); ok && derr.IsNotFound {
+		return registry.ErrNotFound
+	}
+	return err
+}
+
+// ListServices is not supported, dns can't enumerate services
+func (d *dnsRegistry) ListServices(...registry.ListOption) ([]*registry.Service, error) {
+	return []*registry.Service{}, nil
+}
+
+func (d *dnsRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+	return newWatcher(d, wo), nil
+}
+
+func (d *dnsRegistry) String() string {
+	return "dns"
+}
@@ -0,0 +1,118 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+type testResolver struct {
+	sync.Mutex
+	hosts map[string][]string
+	srvs  map[string][]*net.SRV
+}
+
+func (r *testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *testResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.Lock()
+	defer r.Unlock()
+	srvs, ok := r.srvs[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, srvs, nil
+}
+
+func (r *testResolver) setHosts(host string, addrs []string) {
+	r.Lock()
+	r.hosts[host] = addrs
+	r.Unlock()
+}
+
+func newTestResolver() *testResolver {
+	return &testResolver{
+		hosts: map[string][]string{
+			"foo.default.svc": {"10.0.0.2", "10.0.0.1", "fd00::1"},
+		},
+		srvs: map[string][]*net.SRV{
+			"_grpc._tcp.bar.default.svc": {
+				{Target: "bar-0.bar.default.svc.", Port: 9000},
+				{Target: "bar-1.bar.default.svc.", Port: 9001},
+			},
+		},
+	}
+}
+
+func TestGetService(t *testing.T) {
+	r := NewRegistry(WithResolver(newTestResolver()), Port(9000))
+
+	testData := []struct {
+		name  string
+		addrs []string
+	}{
+		{"foo.default.svc", []string{"10.0.0.1:9000", "10.0.0.2:9000", "[fd00::1]:9000"}},
+		{"foo.default.svc:7000", []string{"10.0.0.1:7000", "10.0.0.2:7000", "[fd00::1]:7000"}},
+		{"_grpc._tcp.bar.default.svc", []string{"bar-0.bar.default.svc:9000", "bar-1.bar.default.svc:9001"}},
+	}
+
+	for _, d := range testData {
+		services, err := r.GetService(d.name)
+		if err != nil {
+			t.Fatalf("Unexpected error resolving %s: %v", d.name, err)
+		}
+		if len(services) != 1 || len(services[0].Nodes) != len(d.addrs) {
+			t.Fatalf("Expected %d nodes for %s, got %v", len(d.addrs), d.name, services)
+		}
+		for i, n := range services[0].Nodes {
+			if n.Address != d.addrs[i] {
+				t.Fatalf("Expected address %s for %s, got %s", d.addrs[i], d.name, n.Address)
+			}
+		}
+	}
+
+	if _, err := r.GetService("baz.default.svc"); err != registry.ErrNotFound {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	res := newTestResolver()
+	r := NewRegistry(WithResolver(res), RefreshInterval(10*time.Millisecond))
+
+	w, err := r.Watch(registry.WatchService("foo.default.svc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	next, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Action != "create" || len(next.Service.Nodes) != 3 {
+		t.Fatalf("Expected create of 3 nodes, got %s of %d", next.Action, len(next.Service.Nodes))
+	}
+
+	res.setHosts("foo.default.svc", []string{"10.0.0.1"})
+
+	next, err = w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Action != "delete" || len(next.Service.Nodes) != 2 {
+		t.Fatalf("Expected delete of 2 nodes, got %s of %d", next.Action, len(next.Service.Nodes))
+	}
+}
@@ -0,0 +1,38 @@
+// Package dns provides a registry resolving services through dns
+package dns
+
+import (
+	"context"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+type portKey struct{}
+type resolverKey struct{}
+type refreshKey struct{}
+
+// Port sets the port of the nodes resolved through A/AAAA records
+func Port(p int) registry.Option {
+	return setOption(portKey{}, p)
+}
+
+// WithResolver sets the resolver used for lookups, net.DefaultResolver
+// by default
+func WithResolver(r Resolver) registry.Option {
+	return setOption(resolverKey{}, r)
+}
+
+// RefreshInterval sets how often watched services are resolved again
+func RefreshInterval(d time.Duration) registry.Option {
+	return setOption(refreshKey{}, d)
+}
+
+func setOption(k, v interface{}) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, k, v)
+	}
+}
@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"time"
+
+	log "github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+// dnsWatcher resolves the watched service on an interval and sends the
+// nodes which appeared or went away
+type dnsWatcher struct {
+	d    *dnsRegistry
+	wo   registry.WatchOptions
+	next chan *registry.Result
+	exit chan bool
+	// nodes last resolved keyed by id
+	nodes map[string]*registry.Node
+}
+
+func newWatcher(d *dnsRegistry, wo registry.WatchOptions) *dnsWatcher {
+	w := &dnsWatcher{
+		d:     d,
+		wo:    wo,
+		next:  make(chan *registry.Result),
+		exit:  make(chan bool),
+		nodes: make(map[string]*registry.Node),
+	}
+
+	// without a service there is nothing to resolve
+	if len(wo.Service) > 0 {
+		go w.run()
+	}
+
+	return w
+}
+
+func (w *dnsWatcher) run() {
+	t := time.NewTicker(w.d.refreshInterval())
+	defer t.Stop()
+
+	for {
+		w.resolve()
+
+		select {
+		case <-w.exit:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (w *dnsWatcher) resolve() {
+	services, err := w.d.GetService(w.wo.Service)
+	if err != nil && err != registry.ErrNotFound {
+		// keep the last nodes until the name resolves again
+		log.Errorf("Registry [dns] resolve %s error: %v", w.wo.Service, err)
+		return
+	}
+
+	nodes := make(map[string]*registry.Node)
+	for _, svc := range services {
+		for _, n := range svc.Nodes {
+			nodes[n.Id] = n
+		}
+	}
+
+	var created, deleted []*registry.Node
+	for id, n := range nodes {
+		if _, ok := w.nodes[id]; !ok {
+			created = append(created, n)
+		}
+	}
+	for id, n := range w.nodes {
+		if _, ok := nodes[id]; !ok {
+			deleted = append(deleted, n)
+		}
+	}
+	w.nodes = nodes
+
+	if len(created) > 0 {
+		w.send("create", created)
+	}
+	if len(deleted) > 0 {
+		w.send("delete", deleted)
+	}
+}
+
+func (w *dnsWatcher) send(action string, nodes []*registry.Node) {
+	select {
+	case w.next <- &registry.Result{
+		Action:  action,
+		Service: &registry.Service{Name: w.wo.Service, Nodes: nodes},
+	}:
+	case <-w.exit:
+	}
+}
+
+func (w *dnsWatcher) Next() (*registry.Result, error) {
+	select {
+	case r := <-w.next:
+		return r, nil
+	case <-w.exit:
+		return nil, registry.ErrWatcherStopped
+	}
+}
+
+func (w *dnsWatcher) Stop() {
+	select {
+	case <-w.exit:
+	default:
+		close(w.exit)
+	}
+}
@@ -0,0 +1,136 @@
+package etcd
+
+import (
+	"encoding/json"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/registry/etcd/registrypb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes the services stored as values in etcd. Values written as
+// JSON are always readable so a prefix can move to another codec.
+type Codec interface {
+	Marshal(*registry.Service) ([]byte, error)
+	Unmarshal([]byte) (*registry.Service, error)
+	String() string
+}
+
+var (
+	// JSONCodec encodes services as JSON, the default
+	JSONCodec Codec = jsonCodec{}
+	// ProtoCodec encodes services as the registrypb.Service message
+	ProtoCodec Codec = protoCodec{}
+)
+
+// codecs by the names used in config
+var codecs = map[string]Codec{
+	JSONCodec.String():  JSONCodec,
+	ProtoCodec.String(): ProtoCodec,
+}
+
+// GetCodec returns the codec called name
+func GetCodec(name string) (Codec, bool) {
+	c, ok := codecs[name]
+	return c, ok
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(s *registry.Service) ([]byte, error) {
+	return json.Marshal(s)
+}
+
+func (jsonCodec) Unmarshal(b []byte) (*registry.Service, error) {
+	var s *registry.Service
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (jsonCodec) String() string {
+	return "json"
+}
+
+type protoCodec struct{}
+
+func (protoCodec) String() string {
+	return "proto"
+}
+
+func (protoCodec) Marshal(s *registry.Service) ([]byte, error) {
+	ps := &registrypb.Service{
+		Name:     s.Name,
+		Version:  s.Version,
+		Metadata: s.Metadata,
+	}
+	for _, e := range s.Endpoints {
+		ps.Endpoints = append(ps.Endpoints, &registrypb.Endpoint{
+			Name:     e.Name,
+			Request:  toValue(e.Request),
+			Response: toValue(e.Response),
+			Metadata: e.Metadata,
+		})
+	}
+	for _, n := range s.Nodes {
+		ps.Nodes = append(ps.Nodes, &registrypb.Node{
+			Id:       n.Id,
+			Address:  n.Address,
+			Metadata: n.Metadata,
+		})
+	}
+	// sort the map entries so equal services encode equally
+	return proto.MarshalOptions{Deterministic: true}.Marshal(ps)
+}
+
+func (protoCodec) Unmarshal(b []byte) (*registry.Service, error) {
+	var ps registrypb.Service
+	if err := proto.Unmarshal(b, &ps); err != nil {
+		return nil, err
+	}
+
+	s := &registry.Service{
+		Name:     ps.Name,
+		Version:  ps.Version,
+		Metadata: ps.Metadata,
+	}
+	for _, e := range ps.Endpoints {
+		s.Endpoints = append(s.Endpoints, &registry.Endpoint{
+			Name:     e.Name,
+			Request:  fromValue(e.Request),
+			Response: fromValue(e.Response),
+			Metadata: e.Metadata,
+		})
+	}
+	for _, n := range ps.Nodes {
+		s.Nodes = append(s.Nodes, &registry.Node{
+			Id:       n.Id,
+			Address:  n.Address,
+			Metadata: n.Metadata,
+		})
+	}
+	return s, nil
+}
+
+func toValue(v *registry.Value) *registrypb.Value {
+	if v == nil {
+		return nil
+	}
+	pv := &registrypb.Value{Name: v.Name, Type: v.Type}
+	for _, vv := range v.Values {
+		pv.Values = append(pv.Values, toValue(vv))
+	}
+	return pv
+}
+
+func fromValue(pv *registrypb.Value) *registry.Value {
+	if pv == nil {
+		return nil
+	}
+	v := &registry.Value{Name: pv.Name, Type: pv.Type}
+	for _, vv := range pv.Values {
+		v.Values = append(v.Values, fromValue(vv))
+	}
+	return v
+}
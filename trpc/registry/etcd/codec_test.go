@@ -0,0 +1,116 @@
+package etcd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+func testService() *registry.Service {
+	return &registry.Service{
+		Name:     "foo",
+		Version:  "1.0.0",
+		Metadata: map[string]string{"a": "b"},
+		Endpoints: []*registry.Endpoint{{
+			Name: "Foo.Bar",
+			Request: &registry.Value{
+				Name:   "Request",
+				Type:   "Request",
+				Values: []*registry.Value{{Name: "id", Type: "string"}},
+			},
+			Metadata: map[string]string{"stream": "false"},
+		}},
+		Nodes: []*registry.Node{{
+			Id:       "foo-1",
+			Address:  "10.0.0.1:8080",
+			Metadata: map[string]string{"domain": "tiger"},
+		}},
+	}
+}
+
+func TestProtoCodec(t *testing.T) {
+	s := testService()
+
+	b, err := ProtoCodec.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ProtoCodec.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, got) {
+		t.Fatalf("expected %+v, got %+v", s, got)
+	}
+
+	if _, err := ProtoCodec.Unmarshal([]byte{0xff}); err == nil {
+		t.Fatal("expected an error for an invalid value")
+	}
+}
+
+func TestDecodeJSONFallback(t *testing.T) {
+	s := testService()
+
+	// values written before moving to protobuf are still read
+	got := decode(ProtoCodec, []byte(encode(JSONCodec, s)))
+	if !reflect.DeepEqual(s, got) {
+		t.Fatalf("expected %+v, got %+v", s, got)
+	}
+
+	if c, ok := GetCodec("proto"); !ok || c != ProtoCodec {
+		t.Fatal("expected the proto codec")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	s := testService()
+
+	for _, test := range []struct {
+		name  string
+		codec Codec
+		value string
+		ok    bool
+	}{
+		{"json", JSONCodec, encode(JSONCodec, s), true},
+		{"proto", ProtoCodec, encode(ProtoCodec, s), true},
+		{"json as proto", ProtoCodec, encode(JSONCodec, s), true},
+		// only values written before moving away from JSON are read as JSON
+		{"proto as json", JSONCodec, encode(ProtoCodec, s), false},
+		{"invalid", ProtoCodec, "\xff", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := decode(test.codec, []byte(test.value))
+			if !test.ok {
+				if got != nil {
+					t.Fatalf("expected no service, got %+v", got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(s, got) {
+				t.Fatalf("expected %+v, got %+v", s, got)
+			}
+		})
+	}
+}
+
+func TestProtoCodecDeterministic(t *testing.T) {
+	s := testService()
+	for i := 0; i < 10; i++ {
+		s.Metadata[string(rune('c'+i))] = "x"
+	}
+
+	b, err := ProtoCodec.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		bb, err := ProtoCodec.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != string(bb) {
+			t.Fatal("expected equal services to encode equally")
+		}
+	}
+}
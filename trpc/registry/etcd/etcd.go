@@ -4,8 +4,11 @@ package etcd
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"net"
 	"path"
 	"sort"
@@ -15,6 +18,7 @@ import (
 
 	log "github.com/fztcjjl/tiger/trpc/logger"
 	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/util/backoff"
 	hash "github.com/mitchellh/hashstructure"
 	"go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
@@ -23,29 +27,40 @@ import (
 )
 
 const (
-	prefix        = "/tiger/registry/"
+	defaultPrefix = "/tiger/registry/"
 	defaultDomain = "tiger"
 )
 
 type etcdRegistry struct {
 	client  *clientv3.Client
 	options registry.Options
+	// prefix of every key
+	prefix string
+	codec  Codec
 
-	// register and leases are grouped by domain
 	sync.RWMutex
-	register map[string]register
-	leases   map[string]leases
+	// registered nodes keyed by their key
+	nodes map[string]*leaseNode
 }
 
-type register map[string]uint64
-type leases map[string]clientv3.LeaseID
+// leaseNode is a registered node and the lease keeping it alive
+type leaseNode struct {
+	key     string
+	value   string
+	ttl     time.Duration
+	hash    uint64
+	service *registry.Service
+	// id of the current lease, guarded by the registry lock
+	id clientv3.LeaseID
+	// cancel stops the keepalive loop
+	cancel context.CancelFunc
+}
 
 // NewRegistry returns an initialized etcd registry
 func NewRegistry(opts ...registry.Option) registry.Registry {
 	e := &etcdRegistry{
-		options:  registry.Options{},
-		register: make(map[string]register),
-		leases:   make(map[string]leases),
+		options: registry.Options{},
+		nodes:   make(map[string]*leaseNode),
 	}
 	configure(e, opts...)
 	return e
@@ -60,16 +75,11 @@ func newClient(e *etcdRegistry) (*clientv3.Client, error) {
 		e.options.Timeout = 5 * time.Second
 	}
 
-	if e.options.Secure || e.options.TLSConfig != nil {
-		tlsConfig := e.options.TLSConfig
-		if tlsConfig == nil {
-			tlsConfig = &tls.Config{
-				InsecureSkipVerify: true,
-			}
-		}
-
-		config.TLS = tlsConfig
+	tlsConfig, err := newTLSConfig(e.options)
+	if err != nil {
+		return nil, err
 	}
+	config.TLS = tlsConfig
 
 	if e.options.Context != nil {
 		u, ok := e.options.Context.Value(authKey{}).(*authCreds)
@@ -121,24 +131,83 @@ func newClient(e *etcdRegistry) (*clientv3.Client, error) {
 	return cli, nil
 }
 
+// newTLSConfig returns the tls config of the client, nil if the
+// connection is not secure. The certificate files are loaded on top of
+// the TLSConfig option.
+func newTLSConfig(options registry.Options) (*tls.Config, error) {
+	var files *tlsFiles
+	if options.Context != nil {
+		files, _ = options.Context.Value(tlsFilesKey{}).(*tlsFiles)
+	}
+
+	if !options.Secure && options.TLSConfig == nil && files == nil {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if options.TLSConfig != nil {
+		config = options.TLSConfig.Clone()
+	}
+	if files == nil {
+		return config, nil
+	}
+
+	if len(files.CAFile) > 0 {
+		ca, err := ioutil.ReadFile(files.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", files.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(files.CertFile) > 0 || len(files.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
 // configure will setup the registry with new options
 func configure(e *etcdRegistry, opts ...registry.Option) error {
 	for _, o := range opts {
 		o(&e.options)
 	}
 
+	e.prefix = defaultPrefix
+	e.codec = JSONCodec
+	if e.options.Context != nil {
+		if p, ok := e.options.Context.Value(prefixKey{}).(string); ok && len(p) > 0 {
+			e.prefix = "/" + strings.Trim(p, "/") + "/"
+		}
+		if c, ok := e.options.Context.Value(codecKey{}).(Codec); ok && c != nil {
+			e.codec = c
+		}
+	}
+
 	// setup the client
 	cli, err := newClient(e)
 	if err != nil {
 		return err
 	}
 
-	if e.client != nil {
-		e.client.Close()
-	}
-
 	// setup new client
+	e.Lock()
+	old := e.client
 	e.client = cli
+	e.Unlock()
+
+	// keepalive streams on the old client move to the new one
+	if old != nil {
+		old.Close()
+	}
 
 	return nil
 }
@@ -170,32 +239,43 @@ func getName(key, prefix string) (string, string, bool) {
 	return parts[0], parts[1], true
 }
 
-func encode(s *registry.Service) string {
-	b, _ := json.Marshal(s)
+func encode(c Codec, s *registry.Service) string {
+	b, _ := c.Marshal(s)
 	return string(b)
 }
 
-func decode(ds []byte) *registry.Service {
-	var s *registry.Service
-	json.Unmarshal(ds, &s)
+// decode reads a value written with c. Values c can't read are read as
+// JSON, which is how they were written before moving to another codec.
+func decode(c Codec, ds []byte) *registry.Service {
+	s, err := c.Unmarshal(ds)
+	if err == nil {
+		return s
+	}
+	if c == JSONCodec {
+		return nil
+	}
+	s, err = JSONCodec.Unmarshal(ds)
+	if err != nil {
+		return nil
+	}
 	return s
 }
 
-func nodePath(domain, s, id string) string {
+func nodePath(prefix, domain, s, id string) string {
 	service := strings.Replace(s, "/", "-", -1)
 	node := strings.Replace(id, "/", "-", -1)
-	return path.Join(prefixWithDomain(domain), service, node)
+	return path.Join(prefixWithDomain(prefix, domain), service, node)
 }
 
-func servicePath(domain, s string) string {
-	return path.Join(prefixWithDomain(domain), serializeServiceName(s))
+func servicePath(prefix, domain, s string) string {
+	return path.Join(prefixWithDomain(prefix, domain), serializeServiceName(s))
 }
 
 func serializeServiceName(s string) string {
 	return strings.ReplaceAll(s, "/", "-")
 }
 
-func prefixWithDomain(domain string) string {
+func prefixWithDomain(prefix, domain string) string {
 	return path.Join(prefix, domain)
 }
 
@@ -207,6 +287,9 @@ func (e *etcdRegistry) Options() registry.Options {
 	return e.options
 }
 
+// registerNode writes the node and hands its lease to a keepalive loop.
+// Registering an unchanged node again is a noop, the keepalive loop keeps
+// it registered until it is deregistered.
 func (e *etcdRegistry) registerNode(s *registry.Service, node *registry.Node, opts ...registry.RegisterOption) error {
 	if len(s.Nodes) == 0 {
 		return errors.New("Require at least one node")
@@ -221,156 +304,211 @@ func (e *etcdRegistry) registerNode(s *registry.Service, node *registry.Node, op
 		options.Domain = defaultDomain
 	}
 
-	if s.Metadata == nil {
-		s.Metadata = map[string]string{}
+	md := make(map[string]string, len(s.Metadata)+1)
+	for k, v := range s.Metadata {
+		md[k] = v
 	}
-	if node.Metadata == nil {
-		node.Metadata = map[string]string{}
+	nmd := make(map[string]string, len(node.Metadata)+1)
+	for k, v := range node.Metadata {
+		nmd[k] = v
 	}
 
 	// set the domain in metadata so it can be retrieved by wildcard queries
-	s.Metadata["domain"] = options.Domain
-	node.Metadata["domain"] = options.Domain
+	md["domain"] = options.Domain
+	nmd["domain"] = options.Domain
 
-	e.Lock()
-	// ensure the leases and registers are setup for this domain
-	if _, ok := e.leases[options.Domain]; !ok {
-		e.leases[options.Domain] = make(leases)
-	}
-	if _, ok := e.register[options.Domain]; !ok {
-		e.register[options.Domain] = make(register)
+	service := &registry.Service{
+		Name:      s.Name,
+		Version:   s.Version,
+		Metadata:  md,
+		Endpoints: s.Endpoints,
+		Nodes: []*registry.Node{{
+			Id:       node.Id,
+			Address:  node.Address,
+			Metadata: nmd,
+		}},
+	}
+
+	// create hash of the registration; uint64
+	h, err := hash.Hash(struct {
+		Service *registry.Service
+		TTL     time.Duration
+	}{service, options.TTL}, nil)
+	if err != nil {
+		return err
 	}
 
-	// check to see if we already have a lease cached
-	leaseID, ok := e.leases[options.Domain][s.Name+node.Id]
-	e.Unlock()
+	key := nodePath(e.prefix, options.Domain, s.Name, node.Id)
 
-	if !ok {
-		// missing lease, check if the key exists
-		ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
-		defer cancel()
+	e.RLock()
+	old, ok := e.nodes[key]
+	e.RUnlock()
 
-		// look for the existing key
-		key := nodePath(options.Domain, s.Name, node.Id)
-		rsp, err := e.client.Get(ctx, key, clientv3.WithSerializable())
-		if err != nil {
-			return err
-		}
+	// the node is unchanged and kept alive, skip registering
+	if ok && old.hash == h {
+		log.Tracef("Service %s node %s unchanged skipping registration", s.Name, node.Id)
+		return nil
+	}
 
-		// get the existing lease
-		for _, kv := range rsp.Kvs {
-			if kv.Lease > 0 {
-				leaseID = clientv3.LeaseID(kv.Lease)
+	ctx, cancel := context.WithCancel(context.Background())
+	ln := &leaseNode{
+		key:     key,
+		value:   encode(e.codec, service),
+		ttl:     options.TTL,
+		hash:    h,
+		service: service,
+		cancel:  cancel,
+	}
 
-				// decode the existing node
-				srv := decode(kv.Value)
-				if srv == nil || len(srv.Nodes) == 0 {
-					continue
-				}
+	if err := e.putNode(ctx, ln); err != nil {
+		cancel()
+		return err
+	}
 
-				// create hash of service; uint64
-				h, err := hash.Hash(srv.Nodes[0], nil)
-				if err != nil {
-					continue
-				}
+	e.Lock()
+	e.nodes[key] = ln
+	e.Unlock()
 
-				// save the info
-				e.Lock()
-				e.leases[options.Domain][s.Name+node.Id] = leaseID
-				e.register[options.Domain][s.Name+node.Id] = h
-				e.Unlock()
+	if ln.ttl > 0 {
+		go e.keepAlive(ctx, ln)
+	}
 
-				break
-			}
-		}
+	// the node changed, stop the previous registration
+	if ok {
+		e.release(old)
 	}
 
-	var leaseNotFound bool
+	return nil
+}
 
-	// renew the lease if it exists
-	if leaseID > 0 {
-		log.Tracef("Renewing existing lease for %s %d", s.Name, leaseID)
+// putNode grants a new lease for ln if it has a ttl and writes its key
+func (e *etcdRegistry) putNode(ctx context.Context, ln *leaseNode) error {
+	ctx, cancel := context.WithTimeout(ctx, e.options.Timeout)
+	defer cancel()
 
-		if _, err := e.client.KeepAliveOnce(context.TODO(), leaseID); err != nil {
-			if err != rpctypes.ErrLeaseNotFound {
-				return err
-			}
+	client := e.getClient()
 
-			log.Tracef("Lease not found for %s %d", s.Name, leaseID)
+	var putOpts []clientv3.OpOption
+	var id clientv3.LeaseID
 
-			// lease not found do register
-			leaseNotFound = true
+	if ln.ttl > 0 {
+		// get a lease used to expire keys since we have a ttl
+		ttl := int64(math.Ceil(ln.ttl.Seconds()))
+		lgr, err := client.Grant(ctx, ttl)
+		if err != nil {
+			return err
 		}
+		id = lgr.ID
+		putOpts = append(putOpts, clientv3.WithLease(id))
+		log.Tracef("Registering %s with leaseID %v and ttl %v", ln.key, id, ln.ttl)
+	} else {
+		log.Tracef("Registering %s without lease", ln.key)
 	}
 
-	// create hash of service; uint64
-	h, err := hash.Hash(node, nil)
-	if err != nil {
+	if _, err := client.Put(ctx, ln.key, ln.value, putOpts...); err != nil {
 		return err
 	}
 
-	// get existing hash for the service node
-	e.RLock()
-	v, ok := e.register[options.Domain][s.Name+node.Id]
-	e.RUnlock()
+	e.Lock()
+	ln.id = id
+	e.Unlock()
 
-	// the service is unchanged, skip registering
-	if ok && v == h && !leaseNotFound {
-		log.Tracef("Service %s node %s unchanged skipping registration", s.Name, node.Id)
-		return nil
-	}
+	return nil
+}
 
-	// add domain to the service metadata so it can be determined when doing wildcard queries
-	if s.Metadata == nil {
-		s.Metadata = map[string]string{"domain": options.Domain}
-	} else {
-		s.Metadata["domain"] = options.Domain
-	}
+// keepAlive keeps the lease of ln alive over a single stream. The client
+// retries the stream on its own while the lease is valid, so the stream
+// only ends once the lease is lost, e.g. after a partition longer than
+// the ttl. The node is then written again with a new lease.
+func (e *etcdRegistry) keepAlive(ctx context.Context, ln *leaseNode) {
+	var attempts int
+	var lost bool
+
+	for {
+		e.RLock()
+		id := ln.id
+		e.RUnlock()
+
+		client := e.getClient()
+		ch, err := client.KeepAlive(ctx, id)
+		if err == nil {
+			for range ch {
+				if lost {
+					log.Infof("Registry [etcd] registration of %s restored", ln.key)
+					e.notify(ln, true)
+					lost = false
+				}
+				attempts = 0
+			}
+		}
 
-	service := &registry.Service{
-		Name:      s.Name,
-		Version:   s.Version,
-		Metadata:  s.Metadata,
-		Endpoints: s.Endpoints,
-		Nodes:     []*registry.Node{node},
-	}
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
 
-	ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
-	defer cancel()
+		// the client was replaced by Init, the lease is still valid
+		if client != e.getClient() {
+			continue
+		}
 
-	var lgr *clientv3.LeaseGrantResponse
-	if options.TTL.Seconds() > 0 {
-		// get a lease used to expire keys since we have a ttl
-		lgr, err = e.client.Grant(ctx, int64(options.TTL.Seconds()))
-		if err != nil {
-			return err
+		if !lost {
+			log.Errorf("Registry [etcd] lease %x of %s lost", id, ln.key)
+			e.notify(ln, false)
+			lost = true
+		}
+
+		attempts++
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Do(attempts)):
+		}
+
+		if err := e.putNode(ctx, ln); err != nil {
+			log.Errorf("Registry [etcd] re-registering %s error: %v", ln.key, err)
 		}
 	}
+}
 
-	// create an entry for the node
-	var putOpts []clientv3.OpOption
-	if lgr != nil {
-		putOpts = append(putOpts, clientv3.WithLease(lgr.ID))
-		log.Tracef("Registering %s id %s with lease %v and leaseID %v and ttl %v", service.Name, node.Id, lgr, lgr.ID, options.TTL)
-	} else {
-		log.Tracef("Registering %s id %s without lease", service.Name, node.Id)
+// notify calls the registration callback of the options
+func (e *etcdRegistry) notify(ln *leaseNode, registered bool) {
+	if e.options.Context == nil {
+		return
+	}
+	fn, ok := e.options.Context.Value(registrationKey{}).(func(*registry.Service, bool))
+	if !ok || fn == nil {
+		return
 	}
+	fn(registry.CopyService(ln.service), registered)
+}
 
-	key := nodePath(options.Domain, s.Name, node.Id)
-	if _, err = e.client.Put(ctx, key, encode(service), putOpts...); err != nil {
-		return err
+// release stops keeping ln alive and revokes its lease
+func (e *etcdRegistry) release(ln *leaseNode) {
+	ln.cancel()
+
+	e.RLock()
+	id := ln.id
+	e.RUnlock()
+
+	if id == 0 {
+		return
 	}
 
-	e.Lock()
-	// save our hash of the service
-	e.register[options.Domain][s.Name+node.Id] = h
-	// save our leaseID of the service
-	if lgr != nil {
-		e.leases[options.Domain][s.Name+node.Id] = lgr.ID
+	ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
+	defer cancel()
+
+	// revoking only deletes the keys still attached to the lease
+	if _, err := e.getClient().Revoke(ctx, id); err != nil && err != rpctypes.ErrLeaseNotFound {
+		log.Tracef("Revoking lease %x of %s error: %v", id, ln.key, err)
 	}
-	e.Unlock()
+}
 
-	return nil
+func (e *etcdRegistry) getClient() *clientv3.Client {
+	e.RLock()
+	defer e.RUnlock()
+	return e.client
 }
 
 func (e *etcdRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
@@ -388,30 +526,30 @@ func (e *etcdRegistry) Deregister(s *registry.Service, opts ...registry.Deregist
 	}
 
 	for _, node := range s.Nodes {
+		key := nodePath(e.prefix, options.Domain, s.Name, node.Id)
+
 		e.Lock()
-		// delete our hash of the service
-		nodes, ok := e.register[options.Domain]
-		if ok {
-			delete(nodes, s.Name+node.Id)
-			e.register[options.Domain] = nodes
-		}
+		ln, ok := e.nodes[key]
+		delete(e.nodes, key)
+		e.Unlock()
 
-		// delete our lease of the service
-		leases, ok := e.leases[options.Domain]
+		// stop keeping the node alive before deleting it
 		if ok {
-			delete(leases, s.Name+node.Id)
-			e.leases[options.Domain] = leases
+			ln.cancel()
 		}
-		e.Unlock()
 
 		ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
 		defer cancel()
 
 		log.Tracef("Deregistering %s id %s", s.Name, node.Id)
 
-		if _, err := e.client.Delete(ctx, nodePath(options.Domain, s.Name, node.Id)); err != nil {
+		if _, err := e.getClient().Delete(ctx, key); err != nil {
 			return err
 		}
+
+		if ok {
+			e.release(ln)
+		}
 	}
 
 	return nil
@@ -451,7 +589,7 @@ func (e *etcdRegistry) GetService(name string, opts ...registry.GetOption) ([]*r
 
 	// TODO: refactorout wildcard, this is an incredibly expensive operation
 	if options.Domain == registry.WildcardDomain {
-		rsp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSerializable())
+		rsp, err := e.client.Get(ctx, e.prefix, clientv3.WithPrefix(), clientv3.WithSerializable())
 		if err != nil {
 			return nil, err
 		}
@@ -459,7 +597,7 @@ func (e *etcdRegistry) GetService(name string, opts ...registry.GetOption) ([]*r
 		// filter the results for the key we care about
 		for _, kv := range rsp.Kvs {
 			// if the key does not contain the name then pass
-			_, service, ok := getName(string(kv.Key), prefix)
+			_, service, ok := getName(string(kv.Key), e.prefix)
 			if !ok || service != name {
 				continue
 			}
@@ -468,7 +606,7 @@ func (e *etcdRegistry) GetService(name string, opts ...registry.GetOption) ([]*r
 			results = append(results, kv)
 		}
 	} else {
-		prefix := servicePath(options.Domain, name) + "/"
+		prefix := servicePath(e.prefix, options.Domain, name) + "/"
 		rsp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSerializable())
 		if err != nil {
 			return nil, err
@@ -484,12 +622,12 @@ func (e *etcdRegistry) GetService(name string, opts ...registry.GetOption) ([]*r
 
 	for _, n := range results {
 		// only process the things we care about
-		domain, service, ok := getName(string(n.Key), prefix)
+		domain, service, ok := getName(string(n.Key), e.prefix)
 		if !ok || service != name {
 			continue
 		}
 
-		if sn := decode(n.Value); sn != nil {
+		if sn := decode(e.codec, n.Value); sn != nil {
 			// compose a key of name/version/domain
 			key := sn.Name + sn.Version + domain
 
@@ -529,9 +667,9 @@ func (e *etcdRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Se
 	// determine the prefix
 	var p string
 	if options.Domain == registry.WildcardDomain {
-		p = prefix
+		p = e.prefix
 	} else {
-		p = prefixWithDomain(options.Domain)
+		p = prefixWithDomain(e.prefix, options.Domain)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), e.options.Timeout)
@@ -547,12 +685,12 @@ func (e *etcdRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Se
 
 	versions := make(map[string]*registry.Service)
 	for _, n := range rsp.Kvs {
-		domain, service, ok := getName(string(n.Key), prefix)
+		domain, service, ok := getName(string(n.Key), e.prefix)
 		if !ok {
 			continue
 		}
 
-		sn := decode(n.Value)
+		sn := decode(e.codec, n.Value)
 		if sn == nil || sn.Name != service {
 			continue
 		}
@@ -586,7 +724,7 @@ func (e *etcdRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, er
 	if err != nil {
 		return nil, err
 	}
-	return newEtcdWatcher(cli, e.options.Timeout, opts...)
+	return newEtcdWatcher(cli, e.options.Timeout, e.prefix, e.codec, opts...)
 }
 
 func (e *etcdRegistry) String() string {
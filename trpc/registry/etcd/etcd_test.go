@@ -0,0 +1,417 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc"
+)
+
+// fakeEtcd implements the parts of the etcd grpc api used by the registry
+type fakeEtcd struct {
+	pb.UnimplementedKVServer
+	pb.UnimplementedWatchServer
+	pb.UnimplementedLeaseServer
+
+	sync.Mutex
+	rev int64
+	// the revisions up to compacted can't be watched anymore
+	compacted int64
+	kvs       map[string]*mvccpb.KeyValue
+	history   []*mvccpb.Event
+	changed   chan struct{}
+	// the keys attached to each lease
+	leases  map[int64]map[string]bool
+	leaseID int64
+
+	// if set the watches wait for it to be closed before being created
+	gate chan struct{}
+	// the number of events sent in a watch response
+	batch int
+	// if set the watch stream fails after sending that many responses,
+	// as it does when the member loses its leader
+	dropAfter int
+
+	addr string
+	srv  *grpc.Server
+}
+
+func newFakeEtcd(t *testing.T) *fakeEtcd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeEtcd{
+		rev:     1,
+		kvs:     make(map[string]*mvccpb.KeyValue),
+		leases:  make(map[int64]map[string]bool),
+		changed: make(chan struct{}),
+		batch:   1000,
+		addr:    l.Addr().String(),
+		srv:     grpc.NewServer(),
+	}
+	pb.RegisterKVServer(f.srv, f)
+	pb.RegisterWatchServer(f.srv, f)
+	pb.RegisterLeaseServer(f.srv, f)
+
+	go f.srv.Serve(l)
+	t.Cleanup(f.srv.Stop)
+
+	return f
+}
+
+func (f *fakeEtcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: f.rev}
+}
+
+// inRange returns whether key is in the range of a request
+func inRange(key, start, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(key, start)
+	case len(end) == 1 && end[0] == 0:
+		return bytes.Compare(key, start) >= 0
+	default:
+		return bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0
+	}
+}
+
+// record appends the events of a new revision and wakes up the watches,
+// called with the lock held
+func (f *fakeEtcd) record(evs ...*mvccpb.Event) {
+	f.history = append(f.history, evs...)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// put writes a key at a new revision, called with the lock held
+func (f *fakeEtcd) put(key, value string, lease int64) {
+	f.rev++
+	kv := &mvccpb.KeyValue{
+		Key:            []byte(key),
+		Value:          []byte(value),
+		CreateRevision: f.rev,
+		ModRevision:    f.rev,
+		Version:        1,
+		Lease:          lease,
+	}
+	prev := f.kvs[key]
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+		if keys, ok := f.leases[prev.Lease]; ok {
+			delete(keys, key)
+		}
+	}
+	if keys, ok := f.leases[lease]; ok {
+		keys[key] = true
+	}
+	f.kvs[key] = kv
+	f.record(&mvccpb.Event{Type: mvccpb.PUT, Kv: kv, PrevKv: prev})
+}
+
+// remove deletes keys at a new revision, called with the lock held
+func (f *fakeEtcd) remove(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	f.rev++
+	var evs []*mvccpb.Event
+	for _, key := range keys {
+		prev := f.kvs[key]
+		delete(f.kvs, key)
+		if prev != nil {
+			if lkeys, ok := f.leases[prev.Lease]; ok {
+				delete(lkeys, key)
+			}
+		}
+		evs = append(evs, &mvccpb.Event{
+			Type:   mvccpb.DELETE,
+			Kv:     &mvccpb.KeyValue{Key: []byte(key), ModRevision: f.rev},
+			PrevKv: prev,
+		})
+	}
+	f.record(evs...)
+}
+
+// compact drops the history up to the current revision
+func (f *fakeEtcd) compact() {
+	f.Lock()
+	defer f.Unlock()
+	f.compacted = f.rev
+	f.history = nil
+}
+
+// revoke drops a lease with its keys, as when it expires, called with
+// the lock held
+func (f *fakeEtcd) revoke(id int64) bool {
+	lkeys, ok := f.leases[id]
+	if !ok {
+		return false
+	}
+	var keys []string
+	for key := range lkeys {
+		keys = append(keys, key)
+	}
+	delete(f.leases, id)
+	f.remove(keys...)
+	return true
+}
+
+// keys returns the keys stored with the lease of each
+func (f *fakeEtcd) keys() map[string]int64 {
+	f.Lock()
+	defer f.Unlock()
+
+	keys := make(map[string]int64, len(f.kvs))
+	for key, kv := range f.kvs {
+		keys[key] = kv.Lease
+	}
+	return keys
+}
+
+func (f *fakeEtcd) Range(ctx context.Context, req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	rsp := &pb.RangeResponse{Header: f.header()}
+	for _, kv := range f.kvs {
+		if inRange(kv.Key, req.Key, req.RangeEnd) {
+			rsp.Kvs = append(rsp.Kvs, kv)
+		}
+	}
+	sort.Slice(rsp.Kvs, func(i, j int) bool { return bytes.Compare(rsp.Kvs[i].Key, rsp.Kvs[j].Key) < 0 })
+	rsp.Count = int64(len(rsp.Kvs))
+	return rsp, nil
+}
+
+func (f *fakeEtcd) Put(ctx context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.leases[req.Lease]; req.Lease != 0 && !ok {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	f.put(string(req.Key), string(req.Value), req.Lease)
+	return &pb.PutResponse{Header: f.header()}, nil
+}
+
+func (f *fakeEtcd) DeleteRange(ctx context.Context, req *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	var keys []string
+	for k, kv := range f.kvs {
+		if inRange(kv.Key, req.Key, req.RangeEnd) {
+			keys = append(keys, k)
+		}
+	}
+	f.remove(keys...)
+	return &pb.DeleteRangeResponse{Header: f.header(), Deleted: int64(len(keys))}, nil
+}
+
+func (f *fakeEtcd) LeaseGrant(ctx context.Context, req *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.leaseID++
+	f.leases[f.leaseID] = make(map[string]bool)
+	return &pb.LeaseGrantResponse{Header: f.header(), ID: f.leaseID, TTL: req.TTL}, nil
+}
+
+func (f *fakeEtcd) LeaseRevoke(ctx context.Context, req *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if !f.revoke(req.ID) {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	return &pb.LeaseRevokeResponse{Header: f.header()}, nil
+}
+
+// LeaseKeepAlive never expires the leases, they are only lost once revoked
+func (f *fakeEtcd) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+
+		f.Lock()
+		// a ttl of 0 tells the client the lease is gone
+		rsp := &pb.LeaseKeepAliveResponse{Header: f.header(), ID: req.ID}
+		if _, ok := f.leases[req.ID]; ok {
+			rsp.TTL = 1
+		}
+		f.Unlock()
+
+		if err := stream.Send(rsp); err != nil {
+			return err
+		}
+	}
+}
+
+// Watch serves a single watch per stream, which is all the watcher uses
+func (f *fakeEtcd) Watch(stream pb.Watch_WatchServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	cr := req.GetCreateRequest()
+	if cr == nil {
+		return nil
+	}
+
+	f.Lock()
+	err = stream.Send(&pb.WatchResponse{Header: f.header(), Created: true})
+	gate := f.gate
+	f.Unlock()
+	if err != nil {
+		return err
+	}
+	if gate != nil {
+		<-gate
+	}
+
+	f.Lock()
+	if cr.StartRevision > 0 && cr.StartRevision <= f.compacted {
+		rsp := &pb.WatchResponse{Header: f.header(), CompactRevision: f.compacted, Canceled: true}
+		f.Unlock()
+		return stream.Send(rsp)
+	}
+	next := cr.StartRevision
+	if next == 0 {
+		next = f.rev + 1
+	}
+	f.Unlock()
+
+	var sent int
+	for {
+		f.Lock()
+		var evs []*mvccpb.Event
+		for _, ev := range f.history {
+			if ev.Kv.ModRevision >= next && inRange(ev.Kv.Key, cr.Key, cr.RangeEnd) && len(evs) < f.batch {
+				evs = append(evs, ev)
+			}
+		}
+		changed := f.changed
+		// like etcd the header carries the store revision, not the one
+		// of the last event sent
+		rsp := &pb.WatchResponse{Header: f.header(), Events: evs}
+		f.Unlock()
+
+		if len(evs) == 0 {
+			select {
+			case <-changed:
+				continue
+			case <-stream.Context().Done():
+				return nil
+			}
+		}
+
+		if err := stream.Send(rsp); err != nil {
+			return err
+		}
+		next = evs[len(evs)-1].Kv.ModRevision + 1
+
+		sent++
+		f.Lock()
+		drop := f.dropAfter > 0 && sent >= f.dropAfter
+		if drop {
+			f.dropAfter = 0
+		}
+		f.Unlock()
+		if drop {
+			// the client drops the responses it didn't pass on yet when
+			// the stream fails
+			time.Sleep(50 * time.Millisecond)
+			return rpctypes.ErrGRPCNoLeader
+		}
+	}
+}
+
+func newTestRegistry(t *testing.T, f *fakeEtcd, opts ...registry.Option) registry.Registry {
+	r := NewRegistry(append([]registry.Option{registry.Addrs(f.addr)}, opts...)...)
+	t.Cleanup(func() { r.(*etcdRegistry).getClient().Close() })
+	return r
+}
+
+func testNode(id string) *registry.Service {
+	return &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes:   []*registry.Node{{Id: id, Address: "10.0.0.1:8080"}},
+	}
+}
+
+func TestRegistrationLost(t *testing.T) {
+	f := newFakeEtcd(t)
+
+	type event struct {
+		service    *registry.Service
+		registered bool
+	}
+	events := make(chan event, 4)
+	r := newTestRegistry(t, f, RegistrationCallback(func(s *registry.Service, registered bool) {
+		events <- event{s, registered}
+	}))
+
+	s := testNode("foo-1")
+	if err := r.Register(s, registry.RegisterTTL(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(s)
+
+	key := nodePath(defaultPrefix, defaultDomain, "foo", "foo-1")
+	lease, ok := f.keys()[key]
+	if !ok || lease == 0 {
+		t.Fatalf("Expected %s to be stored with a lease", key)
+	}
+
+	next := func(registered bool) {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.registered != registered {
+				t.Fatalf("Expected registered %v got %v", registered, ev.registered)
+			}
+			if ev.service.Name != "foo" || len(ev.service.Nodes) != 1 || ev.service.Nodes[0].Id != "foo-1" {
+				t.Fatalf("Expected the registered node got %+v", ev.service)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for registered %v", registered)
+		}
+	}
+
+	// the lease expires, e.g. after a partition longer than the ttl
+	f.Lock()
+	f.revoke(lease)
+	f.Unlock()
+
+	next(false)
+	next(true)
+
+	relet, ok := f.keys()[key]
+	if !ok {
+		t.Fatalf("Expected %s to be written again", key)
+	}
+	if relet == 0 || relet == lease {
+		t.Fatalf("Expected a new lease got %d", relet)
+	}
+
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected registered %v", ev.registered)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
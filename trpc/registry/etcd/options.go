@@ -11,6 +11,20 @@ type authKey struct{}
 
 type logConfigKey struct{}
 
+type registrationKey struct{}
+
+type prefixKey struct{}
+
+type codecKey struct{}
+
+type tlsFilesKey struct{}
+
+type tlsFiles struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
 type authCreds struct {
 	Username string
 	Password string
@@ -35,3 +49,47 @@ func LogConfig(config *zap.Config) registry.Option {
 		o.Context = context.WithValue(o.Context, logConfigKey{}, config)
 	}
 }
+
+// RegistrationCallback sets a function called with registered false when
+// the lease of a registered node is lost, and with registered true once
+// the node was written again with a new lease
+func RegistrationCallback(fn func(service *registry.Service, registered bool)) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, registrationKey{}, fn)
+	}
+}
+
+// TLSFiles loads the CA used to verify etcd and the client certificate and
+// key for mutual tls. Any of them can be empty.
+func TLSFiles(caFile, certFile, keyFile string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, tlsFilesKey{}, &tlsFiles{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	}
+}
+
+// Prefix sets the prefix of every key, /tiger/registry/ by default. Using
+// a prefix per environment lets them share one etcd cluster.
+func Prefix(p string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, prefixKey{}, p)
+	}
+}
+
+// Encoding sets the codec of the stored services, JSONCodec by default
+func Encoding(c Codec) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, codecKey{}, c)
+	}
+}
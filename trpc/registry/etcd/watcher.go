@@ -1,26 +1,45 @@
 package etcd
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"sync"
 	"time"
 
+	log "github.com/fztcjjl/tiger/trpc/logger"
 	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/util/backoff"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"go.etcd.io/etcd/client/v3"
 )
 
+// etcdWatcher follows the keys of the watched services. It remembers the
+// last revision seen so a broken watch resumes right after it, and the
+// nodes seen so a watch which fell behind a compaction can send the
+// difference with a fresh listing instead.
 type etcdWatcher struct {
-	w       clientv3.WatchChan
 	client  *clientv3.Client
 	timeout time.Duration
+	path    string
+	codec   Codec
 
-	mtx    sync.Mutex
-	stop   chan bool
+	ctx    context.Context
 	cancel func()
+
+	w clientv3.WatchChan
+	// last revision seen
+	rev int64
+	// values of the watched keys at rev
+	kvs map[string][]byte
+	// results not yet returned by Next
+	pending []*registry.Result
+
+	mtx  sync.Mutex
+	stop chan bool
 }
 
-func newEtcdWatcher(c *clientv3.Client, timeout time.Duration, opts ...registry.WatchOption) (registry.Watcher, error) {
+func newEtcdWatcher(c *clientv3.Client, timeout time.Duration, prefix string, codec Codec, opts ...registry.WatchOption) (registry.Watcher, error) {
 	var wo registry.WatchOptions
 	for _, o := range opts {
 		o(&wo)
@@ -36,58 +55,202 @@ func newEtcdWatcher(c *clientv3.Client, timeout time.Duration, opts ...registry.
 		}
 		watchPath = prefix
 	} else if len(wo.Service) > 0 {
-		watchPath = servicePath(wo.Domain, wo.Service) + "/"
+		watchPath = servicePath(prefix, wo.Domain, wo.Service) + "/"
+	} else {
+		watchPath = prefixWithDomain(prefix, wo.Domain) + "/"
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	w := c.Watch(ctx, watchPath, clientv3.WithPrefix(), clientv3.WithPrevKV())
-	stop := make(chan bool, 1)
 
-	return &etcdWatcher{
-		cancel:  cancel,
-		stop:    stop,
-		w:       w,
+	ew := &etcdWatcher{
 		client:  c,
 		timeout: timeout,
-	}, nil
+		path:    watchPath,
+		codec:   codec,
+		ctx:     ctx,
+		cancel:  cancel,
+		kvs:     make(map[string][]byte),
+		stop:    make(chan bool),
+	}
+
+	// list the keys first so deletes can be resolved after a compaction
+	if _, err := ew.list(); err != nil {
+		cancel()
+		c.Close()
+		return nil, err
+	}
+	ew.watch()
+
+	return ew, nil
+}
+
+// watch starts watching right after the last revision seen. Requiring a
+// leader ends the watch when the member is partitioned so it can resume
+// against another one.
+func (ew *etcdWatcher) watch() {
+	ctx := clientv3.WithRequireLeader(ew.ctx)
+	ew.w = ew.client.Watch(ctx, ew.path,
+		clientv3.WithPrefix(),
+		clientv3.WithPrevKV(),
+		clientv3.WithRev(ew.rev+1),
+	)
+}
+
+// list reads the watched keys and returns the results turning the known
+// keys into the listed ones
+func (ew *etcdWatcher) list() ([]*registry.Result, error) {
+	ctx, cancel := context.WithTimeout(ew.ctx, ew.timeout)
+	defer cancel()
+
+	rsp, err := ew.client.Get(ctx, ew.path, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make(map[string][]byte, len(rsp.Kvs))
+	var results []*registry.Result
+
+	for _, kv := range rsp.Kvs {
+		key := string(kv.Key)
+		kvs[key] = kv.Value
+
+		old, ok := ew.kvs[key]
+		switch {
+		case !ok:
+			results = ew.appendResult(results, "create", kv.Value)
+		case !bytes.Equal(old, kv.Value):
+			results = ew.appendResult(results, "update", kv.Value)
+		}
+	}
+	for key, v := range ew.kvs {
+		if _, ok := kvs[key]; !ok {
+			results = ew.appendResult(results, "delete", v)
+		}
+	}
+
+	ew.kvs = kvs
+	ew.rev = rsp.Header.Revision
+
+	return results, nil
+}
+
+func (ew *etcdWatcher) appendResult(results []*registry.Result, action string, value []byte) []*registry.Result {
+	service := decode(ew.codec, value)
+	if service == nil {
+		return results
+	}
+	return append(results, &registry.Result{Action: action, Service: service})
+}
+
+// apply records the events of a watch response and queues their results
+func (ew *etcdWatcher) apply(wresp clientv3.WatchResponse) {
+	for _, ev := range wresp.Events {
+		key := string(ev.Kv.Key)
+
+		switch ev.Type {
+		case clientv3.EventTypePut:
+			action := "update"
+			if _, ok := ew.kvs[key]; !ok || ev.IsCreate() {
+				action = "create"
+			}
+			ew.kvs[key] = ev.Kv.Value
+			ew.pending = ew.appendResult(ew.pending, action, ev.Kv.Value)
+		case clientv3.EventTypeDelete:
+			// get service from prevKv, falling back to the last value seen
+			value := ew.kvs[key]
+			if ev.PrevKv != nil {
+				value = ev.PrevKv.Value
+			}
+			delete(ew.kvs, key)
+			ew.pending = ew.appendResult(ew.pending, "delete", value)
+		}
+
+		// the header carries the store revision, which is past the events
+		// not sent yet when a watch which fell behind catches up
+		if ev.Kv.ModRevision > ew.rev {
+			ew.rev = ev.Kv.ModRevision
+		}
+	}
+}
+
+// resume restarts the watch after it ended, listing the keys again if
+// the revisions it missed were compacted. It retries with backoff until
+// the watcher is stopped.
+func (ew *etcdWatcher) resume(compacted bool) error {
+	for attempts := 1; ; attempts++ {
+		if compacted {
+			results, err := ew.list()
+			if err == nil {
+				ew.pending = append(ew.pending, results...)
+				ew.watch()
+				return nil
+			}
+			log.Errorf("Registry [etcd] watcher relist error: %v", err)
+		} else {
+			ew.watch()
+			return nil
+		}
+
+		select {
+		case <-ew.stop:
+			return registry.ErrWatcherStopped
+		case <-time.After(backoff.Do(attempts)):
+		}
+	}
 }
 
 func (ew *etcdWatcher) Next() (*registry.Result, error) {
-	for wresp := range ew.w {
-		if wresp.Err() != nil {
-			return nil, wresp.Err()
+	var attempts int
+
+	for {
+		if len(ew.pending) > 0 {
+			r := ew.pending[0]
+			ew.pending = ew.pending[1:]
+			return r, nil
+		}
+
+		select {
+		case <-ew.stop:
+			return nil, registry.ErrWatcherStopped
+		default:
 		}
-		if wresp.Canceled {
-			return nil, errors.New("could not get next")
+
+		wresp, ok := <-ew.w
+		if ok && wresp.Err() == nil && !wresp.Canceled {
+			attempts = 0
+			ew.apply(wresp)
+			continue
+		}
+
+		select {
+		case <-ew.stop:
+			return nil, registry.ErrWatcherStopped
+		default:
 		}
-		for _, ev := range wresp.Events {
-			service := decode(ev.Kv.Value)
-			var action string
-
-			switch ev.Type {
-			case clientv3.EventTypePut:
-				if ev.IsCreate() {
-					action = "create"
-				} else if ev.IsModify() {
-					action = "update"
-				}
-			case clientv3.EventTypeDelete:
-				action = "delete"
-
-				// get service from prevKv
-				service = decode(ev.PrevKv.Value)
+
+		compacted := ok && (wresp.CompactRevision > 0 || wresp.Err() == rpctypes.ErrCompacted)
+		if compacted {
+			log.Infof("Registry [etcd] watcher revision %d compacted, listing again", ew.rev+1)
+		} else {
+			var err error
+			if ok {
+				err = wresp.Err()
 			}
+			log.Errorf("Registry [etcd] watch of %s ended: %v, resuming from revision %d", ew.path, err, ew.rev+1)
 
-			if service == nil {
-				continue
+			// back off while the watch keeps failing straight away
+			attempts++
+			select {
+			case <-ew.stop:
+				return nil, registry.ErrWatcherStopped
+			case <-time.After(backoff.Do(attempts)):
 			}
-			return &registry.Result{
-				Action:  action,
-				Service: service,
-			}, nil
+		}
+
+		if err := ew.resume(compacted); err != nil {
+			return nil, err
 		}
 	}
-	return nil, errors.New("could not get next")
 }
 
 func (ew *etcdWatcher) Stop() {
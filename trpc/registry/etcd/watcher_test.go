@@ -0,0 +1,110 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+// nextResult returns the next result of w, failing after a timeout
+func nextResult(t *testing.T, w registry.Watcher) *registry.Result {
+	t.Helper()
+
+	type next struct {
+		res *registry.Result
+		err error
+	}
+	ch := make(chan next, 1)
+	go func() {
+		res, err := w.Next()
+		ch <- next{res, err}
+	}()
+
+	select {
+	case n := <-ch:
+		if n.err != nil {
+			t.Fatal(n.err)
+		}
+		return n.res
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for a result")
+		return nil
+	}
+}
+
+func TestWatcherResume(t *testing.T) {
+	f := newFakeEtcd(t)
+	r := newTestRegistry(t, f)
+
+	// hold the events so they are sent one per response once the nodes
+	// are registered, then lose the stream after the first one
+	gate := make(chan struct{})
+	f.Lock()
+	f.gate = gate
+	f.batch = 1
+	f.dropAfter = 1
+	f.Unlock()
+
+	w, err := r.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	for _, id := range []string{"foo-1", "foo-2", "foo-3"} {
+		if err := r.Register(testNode(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(gate)
+
+	// the watch resumes after the last event received rather than the
+	// store revision of the response
+	for _, id := range []string{"foo-1", "foo-2", "foo-3"} {
+		res := nextResult(t, w)
+		if res.Action != "create" || res.Service.Nodes[0].Id != id {
+			t.Fatalf("Expected create of %s got %s of %s", id, res.Action, res.Service.Nodes[0].Id)
+		}
+	}
+}
+
+func TestWatcherCompacted(t *testing.T) {
+	f := newFakeEtcd(t)
+	r := newTestRegistry(t, f)
+
+	if err := r.Register(testNode("foo-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	gate := make(chan struct{})
+	f.Lock()
+	f.gate = gate
+	f.Unlock()
+
+	w, err := r.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// the changes are compacted before the watch reads them
+	if err := r.Register(testNode("foo-2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Deregister(testNode("foo-1")); err != nil {
+		t.Fatal(err)
+	}
+	f.compact()
+	close(gate)
+
+	// listing again sends the difference
+	results := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		res := nextResult(t, w)
+		results[res.Service.Nodes[0].Id] = res.Action
+	}
+	if results["foo-1"] != "delete" || results["foo-2"] != "create" {
+		t.Fatalf("Expected foo-1 deleted and foo-2 created got %v", results)
+	}
+}
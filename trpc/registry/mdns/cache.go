@@ -0,0 +1,273 @@
+package mdns
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+	mdns "github.com/fztcjjl/tiger/trpc/registry/mdns/util"
+)
+
+var (
+	// sweepInterval is how often expired entries are removed from the cache
+	sweepInterval = time.Second
+	// refreshRatio is the part of the ttl after which the records of an
+	// entry are queried again, as recommended by RFC 6762 section 5.2
+	refreshRatio = 0.8
+)
+
+// cacheEntry is a node seen on the network, kept until its records expire
+type cacheEntry struct {
+	domain  string
+	service *registry.Service
+	ttl     time.Duration
+	expires time.Time
+	// refreshing is set once a query renewing the records was sent
+	refreshing bool
+}
+
+// cacheEvent is a change of the cache sent to the watchers
+type cacheEvent struct {
+	domain string
+	result *registry.Result
+}
+
+// nameEntry is a service seen through the record used for listing
+type nameEntry struct {
+	domain  string
+	service string
+	expires time.Time
+}
+
+// entryCache holds the discovered nodes and listed services keyed by
+// their instance name
+type entryCache struct {
+	sync.Mutex
+	entries map[string]*cacheEntry
+	names   map[string]*nameEntry
+}
+
+func newEntryCache() *entryCache {
+	return &entryCache{
+		entries: make(map[string]*cacheEntry),
+		names:   make(map[string]*nameEntry),
+	}
+}
+
+// instanceName is the name of the records of a node
+func instanceName(id, service, domain string) string {
+	return fmt.Sprintf("%s.%s.%s.", id, service, domain)
+}
+
+// serviceFromEntry decodes the service of a single node from an mdns
+// entry named <node id>.<service>.<domain>.
+func serviceFromEntry(e *mdns.ServiceEntry) (string, *registry.Service, bool) {
+	txt, err := decode(e.InfoFields)
+	if err != nil || len(txt.Service) == 0 || len(txt.Version) == 0 {
+		return "", nil, false
+	}
+
+	i := strings.LastIndex(e.Name, "."+txt.Service+".")
+	if i <= 0 {
+		return "", nil, false
+	}
+	id := e.Name[:i]
+	domain := strings.TrimSuffix(e.Name[i+len(txt.Service)+2:], ".")
+
+	var addr string
+	// prefer ipv4 addrs
+	if len(e.AddrV4) > 0 {
+		addr = e.AddrV4.String()
+	} else if len(e.AddrV6) > 0 {
+		addr = "[" + e.AddrV6.String() + "]"
+	} else {
+		return "", nil, false
+	}
+
+	return domain, &registry.Service{
+		Name:      txt.Service,
+		Version:   txt.Version,
+		Endpoints: txt.Endpoints,
+		Nodes: []*registry.Node{{
+			Id:       id,
+			Address:  fmt.Sprintf("%s:%d", addr, e.Port),
+			Metadata: txt.Metadata,
+		}},
+	}, true
+}
+
+// update records an entry, returning the event to send if the cache
+// changed. Entries with a zero ttl are goodbye records removing the node.
+func (c *entryCache) update(e *mdns.ServiceEntry) *cacheEvent {
+	if i := strings.Index(e.Name, "._services."); i > 0 {
+		c.updateName(e.Name[:i], strings.TrimSuffix(e.Name[i+len("._services."):], "."), e)
+		return nil
+	}
+
+	domain, service, ok := serviceFromEntry(e)
+	if !ok {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	old, seen := c.entries[e.Name]
+
+	if e.TTL <= 0 {
+		if !seen {
+			return nil
+		}
+		delete(c.entries, e.Name)
+		return &cacheEvent{domain: domain, result: &registry.Result{Action: "delete", Service: old.service}}
+	}
+
+	ttl := time.Duration(e.TTL) * time.Second
+	c.entries[e.Name] = &cacheEntry{
+		domain:  domain,
+		service: service,
+		ttl:     ttl,
+		expires: time.Now().Add(ttl),
+	}
+
+	switch {
+	case !seen:
+		return &cacheEvent{domain: domain, result: &registry.Result{Action: "create", Service: service}}
+	case !reflect.DeepEqual(old.service, service):
+		return &cacheEvent{domain: domain, result: &registry.Result{Action: "update", Service: service}}
+	}
+	return nil
+}
+
+func (c *entryCache) updateName(service, domain string, e *mdns.ServiceEntry) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e.TTL <= 0 {
+		delete(c.names, e.Name)
+		return
+	}
+	c.names[e.Name] = &nameEntry{
+		domain:  domain,
+		service: service,
+		expires: time.Now().Add(time.Duration(e.TTL) * time.Second),
+	}
+}
+
+// remove drops a node, returning the delete event if it was cached
+func (c *entryCache) remove(name string) *cacheEvent {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[name]
+	if !ok {
+		return nil
+	}
+	delete(c.entries, name)
+	return &cacheEvent{domain: e.domain, result: &registry.Result{Action: "delete", Service: e.service}}
+}
+
+// services returns the versions of a service with their live nodes
+func (c *entryCache) services(domain, name string) []*registry.Service {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	versions := make(map[string]*registry.Service)
+
+	for _, e := range c.entries {
+		if e.domain != domain || e.service.Name != name || !now.Before(e.expires) {
+			continue
+		}
+
+		s, ok := versions[e.service.Version]
+		if !ok {
+			s = &registry.Service{
+				Name:      e.service.Name,
+				Version:   e.service.Version,
+				Endpoints: e.service.Endpoints,
+			}
+			versions[e.service.Version] = s
+		}
+		s.Nodes = append(s.Nodes, e.service.Nodes...)
+	}
+
+	services := make([]*registry.Service, 0, len(versions))
+	for _, s := range versions {
+		services = append(services, registry.CopyService(s))
+	}
+	return services
+}
+
+// list returns the services of a domain, known either through their
+// listing record or their nodes
+func (c *entryCache) list(domain string) []*registry.Service {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	var services []*registry.Service
+
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			services = append(services, &registry.Service{Name: name})
+		}
+	}
+
+	for _, n := range c.names {
+		if n.domain == domain && now.Before(n.expires) {
+			add(n.service)
+		}
+	}
+	for _, e := range c.entries {
+		if e.domain == domain && now.Before(e.expires) {
+			add(e.service.Name)
+		}
+	}
+
+	return services
+}
+
+// expire removes the entries whose records expired before now and
+// returns their delete events, along with the entries which should be
+// queried again before they expire
+func (c *entryCache) expire(now time.Time) ([]*cacheEvent, []*cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+
+	var events []*cacheEvent
+	var refresh []*cacheEntry
+
+	for name, n := range c.names {
+		if !now.Before(n.expires) {
+			delete(c.names, name)
+		}
+	}
+
+	for name, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, name)
+			events = append(events, &cacheEvent{
+				domain: e.domain,
+				result: &registry.Result{Action: "delete", Service: e.service},
+			})
+			continue
+		}
+
+		if e.refreshing {
+			continue
+		}
+		refreshAt := e.expires.Add(-time.Duration(float64(e.ttl) * (1 - refreshRatio)))
+		if !now.Before(refreshAt) {
+			e.refreshing = true
+			refresh = append(refresh, e)
+		}
+	}
+
+	return events, refresh
+}
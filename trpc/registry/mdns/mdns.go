@@ -6,8 +6,8 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	"strconv"
 	"strings"
@@ -17,6 +17,7 @@ import (
 	log "github.com/fztcjjl/tiger/trpc/logger"
 	"github.com/fztcjjl/tiger/trpc/registry"
 	mdns "github.com/fztcjjl/tiger/trpc/registry/mdns/util"
+	"github.com/fztcjjl/tiger/trpc/util/backoff"
 	"github.com/google/uuid"
 )
 
@@ -27,6 +28,10 @@ const (
 	globalDomain = "global"
 )
 
+// claimTimeout is how long Register waits for the new nodes to claim
+// their instance names, probing takes about a second
+var claimTimeout = 5 * time.Second
+
 type mdnsTxt struct {
 	Service   string
 	Version   string
@@ -44,6 +49,14 @@ type mdnsEntry struct {
 // used for listing
 type services map[string][]*mdnsEntry
 
+// Registry is a multicast dns registry
+type Registry interface {
+	registry.Registry
+	// Stop the listener and the background queries, the watchers are
+	// stopped as well
+	Stop()
+}
+
 // mdsRegistry is a multicast dns registry
 type mdnsRegistry struct {
 	opts registry.Options
@@ -57,18 +70,45 @@ type mdnsRegistry struct {
 
 	mtx sync.RWMutex
 
+	// nodes seen on the network until their records expire
+	cache *entryCache
+
 	// watchers
 	watchers map[string]*mdnsWatcher
 
-	// listener
-	listener chan *mdns.ServiceEntry
+	// starts the listener and the background queries on first use
+	once sync.Once
+
+	// closed by Stop to end the listener and the background queries
+	exit     chan struct{}
+	stopOnce sync.Once
+
+	// the services queried in the background
+	qmtx    sync.Mutex
+	queries map[mdnsQuery]bool
+}
+
+// mdnsQuery is a service of a domain kept in the cache, the _services
+// name lists the domain
+type mdnsQuery struct {
+	domain  string
+	service string
 }
 
 type mdnsWatcher struct {
-	id   string
-	wo   registry.WatchOptions
-	ch   chan *mdns.ServiceEntry
+	id string
+	wo registry.WatchOptions
+
+	// the events not read yet, only the last one of a node is kept so a
+	// slow watcher still ends up with the current nodes
+	mtx     sync.Mutex
+	pending map[string]*cacheEvent
+	order   []string
+	// signalled when an event is queued
+	ready chan struct{}
+
 	exit chan struct{}
+	once sync.Once
 	// the mdns domain
 	domain string
 	// the registry
@@ -146,7 +186,7 @@ func decode(record []string) (*mdnsTxt, error) {
 	return txt, nil
 }
 
-func newRegistry(opts ...registry.Option) registry.Registry {
+func newRegistry(opts ...registry.Option) Registry {
 	options := registry.Options{
 		Context: context.Background(),
 		Timeout: time.Millisecond * 100,
@@ -167,7 +207,10 @@ func newRegistry(opts ...registry.Option) registry.Registry {
 		globalDomain:  globalDomain,
 		opts:          options,
 		domains:       make(map[string]services),
+		cache:         newEntryCache(),
 		watchers:      make(map[string]*mdnsWatcher),
+		queries:       make(map[mdnsQuery]bool),
+		exit:          make(chan struct{}),
 	}
 }
 
@@ -184,15 +227,19 @@ func (m *mdnsRegistry) Options() registry.Options {
 
 // createServiceMDNSEntry will create a new wildcard mdns entry for the service in the
 // given domain. This wildcard mdns entry is used when listing services.
-func createServiceMDNSEntry(name, domain string) (*mdnsEntry, error) {
-	ip := net.ParseIP("0.0.0.0")
+func createServiceMDNSEntry(name, domain string, conf mdns.Config) (*mdnsEntry, error) {
+	ip := net.IPv4zero
+	if conf.IPMode == mdns.IPv6Only {
+		ip = net.IPv6zero
+	}
 
 	s, err := mdns.NewMDNSService(name, "_services", domain+".", "", 9999, []net.IP{ip}, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	srv, err := mdns.NewServer(&mdns.Config{Zone: &mdns.DNSSDService{MDNSService: s}, LocalhostChecking: true})
+	conf.Zone = &mdns.DNSSDService{MDNSService: s}
+	srv, err := mdns.NewServer(&conf)
 	if err != nil {
 		return nil, err
 	}
@@ -208,7 +255,12 @@ func (m *mdnsRegistry) createMDNSEntries(domain, serviceName string) ([]*mdnsEnt
 	}
 
 	// create the wildcard entry used for list queries in this domain
-	entry, err := createServiceMDNSEntry(serviceName, domain)
+	conf, err := m.serverConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := createServiceMDNSEntry(serviceName, domain, conf)
 	if err != nil {
 		return nil, err
 	}
@@ -216,7 +268,7 @@ func (m *mdnsRegistry) createMDNSEntries(domain, serviceName string) ([]*mdnsEnt
 	return []*mdnsEntry{entry}, nil
 }
 
-func registerService(service *registry.Service, entries []*mdnsEntry, options registry.RegisterOptions) ([]*mdnsEntry, error) {
+func registerService(service *registry.Service, entries []*mdnsEntry, options registry.RegisterOptions, conf mdns.Config) ([]*mdnsEntry, error) {
 	var lastError error
 	for _, node := range service.Nodes {
 		var seen bool
@@ -266,8 +318,15 @@ func registerService(service *registry.Service, entries []*mdnsEntry, options re
 			lastError = err
 			continue
 		}
+		// the records expire with the registration so the node goes away
+		// if the process dies without sending goodbye records
+		if options.TTL > 0 {
+			s.TTL = uint32(math.Ceil(options.TTL.Seconds()))
+		}
 
-		srv, err := mdns.NewServer(&mdns.Config{Zone: s, LocalhostChecking: true})
+		c := conf
+		c.Zone = s
+		srv, err := mdns.NewServer(&c)
 		if err != nil {
 			lastError = err
 			continue
@@ -299,9 +358,11 @@ func createGlobalDomainService(service *registry.Service, options registry.Regis
 	return &srv
 }
 
+// Register announces the nodes of service which aren't yet. It waits for
+// the new nodes to claim their instance names and returns the
+// *mdns.ConflictError of a node another host already uses, unless the
+// Rename option is set.
 func (m *mdnsRegistry) Register(service *registry.Service, opts ...registry.RegisterOption) error {
-	m.Lock()
-
 	// parse the options
 	var options registry.RegisterOptions
 	for _, o := range opts {
@@ -311,6 +372,33 @@ func (m *mdnsRegistry) Register(service *registry.Service, opts ...registry.Regi
 		options.Domain = m.defaultDomain
 	}
 
+	added, gerr := m.register(service, options)
+
+	// register in the global Domain so it can be queried as one
+	if options.Domain != m.globalDomain {
+		srv := createGlobalDomainService(service, options)
+		goptions := options
+		goptions.Domain = m.globalDomain
+		gadded, err := m.register(srv, goptions)
+		if err != nil {
+			gerr = err
+		}
+		added = append(added, gadded...)
+	}
+
+	if err := m.claim(service.Name, options.Domain, added); err != nil {
+		return err
+	}
+
+	return gerr
+}
+
+// register creates the servers of the new nodes of service, returning
+// their entries
+func (m *mdnsRegistry) register(service *registry.Service, options registry.RegisterOptions) ([]*mdnsEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+
 	// create the domain in the memory store if it doesn't yet exist
 	if _, ok := m.domains[options.Domain]; !ok {
 		m.domains[options.Domain] = make(services)
@@ -318,25 +406,72 @@ func (m *mdnsRegistry) Register(service *registry.Service, opts ...registry.Regi
 
 	entries, err := m.createMDNSEntries(options.Domain, service.Name)
 	if err != nil {
-		m.Unlock()
-		return err
+		return nil, err
+	}
+	known := len(entries)
+
+	conf, err := m.serverConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	entries, gerr := registerService(service, entries, options)
+	entries, err = registerService(service, entries, options, conf)
 
 	// save the mdns entry
 	m.domains[options.Domain][service.Name] = entries
-	m.Unlock()
 
-	// register in the global Domain so it can be queried as one
-	if options.Domain != m.globalDomain {
-		srv := createGlobalDomainService(service, options)
-		if err := m.Register(srv, append(opts, registry.RegisterDomain(m.globalDomain))...); err != nil {
-			gerr = err
+	return entries[known:], err
+}
+
+// claim waits for the new entries to claim their instance names. The
+// nodes another host already uses are dropped from domain and the global
+// domain.
+func (m *mdnsRegistry) claim(service, domain string, added []*mdnsEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), claimTimeout)
+	defer cancel()
+
+	var cerr error
+	for _, entry := range added {
+		// still probing after the timeout means no host answered so far
+		err, ok := entry.node.Claimed(ctx).(*mdns.ConflictError)
+		if !ok {
+			continue
 		}
+		m.drop(domain, service, entry.id)
+		m.drop(m.globalDomain, service, entry.id)
+		cerr = err
 	}
 
-	return gerr
+	return cerr
+}
+
+// drop shuts down the server of node id, along with the wildcard entry
+// once no node of the service is left
+func (m *mdnsRegistry) drop(domain, service, id string) {
+	m.Lock()
+	defer m.Unlock()
+
+	var entries []*mdnsEntry
+	for _, entry := range m.domains[domain][service] {
+		if entry.id == id {
+			entry.node.Shutdown()
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) > 1 || (len(entries) == 1 && entries[0].id != "*") {
+		m.domains[domain][service] = entries
+		return
+	}
+
+	for _, entry := range entries {
+		entry.node.Shutdown()
+	}
+	delete(m.domains[domain], service)
+	if len(m.domains[domain]) == 0 {
+		delete(m.domains, domain)
+	}
 }
 
 func (m *mdnsRegistry) Deregister(service *registry.Service, opts ...registry.DeregisterOption) error {
@@ -376,6 +511,12 @@ func (m *mdnsRegistry) Deregister(service *registry.Service, opts ...registry.De
 			if node.Id == entry.id {
 				entry.node.Shutdown()
 				remove = true
+
+				// drop the node straight away rather than waiting for
+				// the listener to see the goodbye records
+				if ev := m.cache.remove(instanceName(node.Id, service.Name, options.Domain)); ev != nil {
+					m.notify(ev)
+				}
 				break
 			}
 		}
@@ -415,6 +556,9 @@ func (m *mdnsRegistry) Deregister(service *registry.Service, opts ...registry.De
 	return err
 }
 
+// GetService answers from the cache of the listener. The first lookup of
+// a service queries the network, later ones are kept current by the
+// listener and the background queries.
 func (m *mdnsRegistry) GetService(service string, opts ...registry.GetOption) ([]*registry.Service, error) {
 	// parse the options
 	var options registry.GetOptions
@@ -428,11 +572,67 @@ func (m *mdnsRegistry) GetService(service string, opts ...registry.GetOption) ([
 		options.Domain = m.globalDomain
 	}
 
-	serviceMap := make(map[string]*registry.Service)
+	q := mdnsQuery{domain: options.Domain, service: service}
+	if err := m.want(q); err != nil {
+		return nil, err
+	}
+
+	return m.cache.services(options.Domain, service), nil
+}
+
+func (m *mdnsRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	// parse the options
+	var options registry.ListOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if len(options.Domain) == 0 {
+		options.Domain = m.defaultDomain
+	}
+	if options.Domain == registry.WildcardDomain {
+		options.Domain = m.globalDomain
+	}
+
+	q := mdnsQuery{domain: options.Domain, service: "_services"}
+	if err := m.want(q); err != nil {
+		return nil, err
+	}
+
+	return m.cache.list(options.Domain), nil
+}
+
+// want starts the listener and adds q to the background queries, running
+// it first if it is new so the cache has the answers
+func (m *mdnsRegistry) want(q mdnsQuery) error {
+	m.start()
+
+	m.qmtx.Lock()
+	known := m.queries[q]
+	m.queries[q] = true
+	m.qmtx.Unlock()
+
+	if known {
+		return nil
+	}
+
+	if err := m.query(q); err != nil {
+		m.qmtx.Lock()
+		delete(m.queries, q)
+		m.qmtx.Unlock()
+		return err
+	}
+	return nil
+}
+
+// query asks the network for q and records the answers
+func (m *mdnsRegistry) query(q mdnsQuery) error {
 	entries := make(chan *mdns.ServiceEntry, 10)
 	done := make(chan bool)
 
-	p := mdns.DefaultParams(service)
+	p, err := m.queryParams(q.service)
+	if err != nil {
+		return err
+	}
 	// set context with timeout
 	var cancel context.CancelFunc
 	p.Context, cancel = context.WithTimeout(context.Background(), m.opts.Timeout)
@@ -440,55 +640,13 @@ func (m *mdnsRegistry) GetService(service string, opts ...registry.GetOption) ([
 	// set entries channel
 	p.Entries = entries
 	// set the domain
-	p.Domain = options.Domain
+	p.Domain = q.domain
 
 	go func() {
 		for {
 			select {
 			case e := <-entries:
-				// list record so skip
-				if e.Name == "_services" {
-					continue
-				}
-				if e.TTL == 0 {
-					continue
-				}
-
-				txt, err := decode(e.InfoFields)
-				if err != nil {
-					continue
-				}
-
-				if txt.Service != service {
-					continue
-				}
-
-				s, ok := serviceMap[txt.Version]
-				if !ok {
-					s = &registry.Service{
-						Name:      txt.Service,
-						Version:   txt.Version,
-						Endpoints: txt.Endpoints,
-					}
-				}
-				addr := ""
-				// prefer ipv4 addrs
-				if len(e.AddrV4) > 0 {
-					addr = e.AddrV4.String()
-					// else use ipv6
-				} else if len(e.AddrV6) > 0 {
-					addr = "[" + e.AddrV6.String() + "]"
-				} else {
-					log.Infof("[mdns]: invalid endpoint received: %v", e)
-					continue
-				}
-				s.Nodes = append(s.Nodes, &registry.Node{
-					Id:       strings.TrimSuffix(e.Name, "."+p.Service+"."+p.Domain+"."),
-					Address:  fmt.Sprintf("%s:%d", addr, e.Port),
-					Metadata: txt.Metadata,
-				})
-
-				serviceMap[txt.Version] = s
+				m.observe(e)
 			case <-p.Context.Done():
 				close(done)
 				return
@@ -498,82 +656,167 @@ func (m *mdnsRegistry) GetService(service string, opts ...registry.GetOption) ([
 
 	// execute the query
 	if err := mdns.Query(p); err != nil {
-		return nil, err
+		return err
 	}
 
 	// wait for completion
 	<-done
 
-	// create list and return
-	services := make([]*registry.Service, 0, len(serviceMap))
-
-	for _, service := range serviceMap {
-		services = append(services, service)
-	}
+	return nil
+}
 
-	return services, nil
+// start runs the listener shared by the lookups and the watchers along
+// with the background queries, for the life of the registry
+func (m *mdnsRegistry) start() {
+	m.once.Do(func() {
+		go m.listen()
+		go m.run()
+	})
 }
 
-func (m *mdnsRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
-	// parse the options
-	var options registry.ListOptions
-	for _, o := range opts {
-		o(&options)
-	}
-	if len(options.Domain) == 0 {
-		options.Domain = m.defaultDomain
-	}
-	if options.Domain == registry.WildcardDomain {
-		options.Domain = m.globalDomain
+// listen records the entries seen on the network until the registry is
+// stopped, restarting the listener if it fails. The backoff starts over
+// once a listener received entries.
+func (m *mdnsRegistry) listen() {
+	var attempts int
+	for {
+		ch := make(chan *mdns.ServiceEntry, 32)
+		done := make(chan bool)
+
+		go func() {
+			var received bool
+			for e := range ch {
+				received = true
+				m.observe(e)
+			}
+			done <- received
+		}()
+
+		p, err := m.queryParams("")
+		if err == nil {
+			p.Entries = ch
+			// start listening, blocking call
+			err = mdns.ListenWith(p, m.exit)
+		}
+		close(ch)
+
+		if <-done {
+			attempts = 0
+		}
+
+		select {
+		case <-m.exit:
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Errorf("[mdns] registry listener error: %v", err)
+		}
+
+		attempts++
+		select {
+		case <-m.exit:
+			return
+		case <-time.After(backoff.Do(attempts)):
+		}
 	}
+}
 
-	serviceMap := make(map[string]bool)
-	entries := make(chan *mdns.ServiceEntry, 10)
-	done := make(chan bool)
+// run expires the nodes which stopped announcing themselves and queries
+// the known services again to find nodes the listener missed
+func (m *mdnsRegistry) run() {
+	sweep := time.NewTicker(sweepInterval)
+	defer sweep.Stop()
 
-	p := mdns.DefaultParams("_services")
-	// set context with timeout
-	var cancel context.CancelFunc
-	p.Context, cancel = context.WithTimeout(context.Background(), m.opts.Timeout)
-	defer cancel()
-	// set entries channel
-	p.Entries = entries
-	// set domain
-	p.Domain = options.Domain
+	query := time.NewTicker(m.queryInterval())
+	defer query.Stop()
 
-	var services []*registry.Service
+	for {
+		select {
+		case <-m.exit:
+			return
+		case <-sweep.C:
+			m.sweep()
+		case <-query.C:
+			m.qmtx.Lock()
+			queries := make([]mdnsQuery, 0, len(m.queries))
+			for q := range m.queries {
+				queries = append(queries, q)
+			}
+			m.qmtx.Unlock()
 
-	go func() {
-		for {
-			select {
-			case e := <-entries:
-				if e.TTL == 0 {
-					continue
-				}
-				if !strings.HasSuffix(e.Name, p.Domain+".") {
-					continue
+			for _, q := range queries {
+				if err := m.query(q); err != nil {
+					log.Errorf("[mdns] registry query %s.%s error: %v", q.service, q.domain, err)
 				}
-				name := strings.TrimSuffix(e.Name, "."+p.Service+"."+p.Domain+".")
-				if !serviceMap[name] {
-					serviceMap[name] = true
-					services = append(services, &registry.Service{Name: name})
-				}
-			case <-p.Context.Done():
-				close(done)
-				return
 			}
 		}
-	}()
+	}
+}
 
-	// execute query
-	if err := mdns.Query(p); err != nil {
+// interfaces returns the interfaces set by the Interfaces option, nil
+// meaning all of them
+func (m *mdnsRegistry) interfaces() ([]net.Interface, error) {
+	names, ok := m.opts.Context.Value(interfacesKey{}).([]string)
+	if !ok || len(names) == 0 {
+		return nil, nil
+	}
+
+	ifaces := make([]net.Interface, 0, len(names))
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = append(ifaces, *iface)
+	}
+	return ifaces, nil
+}
+
+func (m *mdnsRegistry) ipMode() mdns.IPMode {
+	mode, _ := m.opts.Context.Value(ipModeKey{}).(mdns.IPMode)
+	return mode
+}
+
+// serverConfig returns the config of the servers announcing the nodes
+func (m *mdnsRegistry) serverConfig() (mdns.Config, error) {
+	ifaces, err := m.interfaces()
+	if err != nil {
+		return mdns.Config{}, err
+	}
+
+	rename, _ := m.opts.Context.Value(renameKey{}).(bool)
+	onConflict, _ := m.opts.Context.Value(conflictKey{}).(func(*mdns.ConflictError))
+
+	return mdns.Config{
+		Ifaces:            ifaces,
+		IPMode:            m.ipMode(),
+		Rename:            rename,
+		OnConflict:        onConflict,
+		LocalhostChecking: true,
+	}, nil
+}
+
+// queryParams returns the params of the queries and the listener
+func (m *mdnsRegistry) queryParams(service string) (*mdns.QueryParam, error) {
+	ifaces, err := m.interfaces()
+	if err != nil {
 		return nil, err
 	}
 
-	// wait till done
-	<-done
+	p := mdns.DefaultParams(service)
+	p.Interfaces = ifaces
+	p.IPMode = m.ipMode()
+	p.WantUnicastResponse, _ = m.opts.Context.Value(unicastKey{}).(bool)
+	return p, nil
+}
 
-	return services, nil
+func (m *mdnsRegistry) queryInterval() time.Duration {
+	if d, ok := m.opts.Context.Value(queryIntervalKey{}).(time.Duration); ok && d > 0 {
+		return d
+	}
+	return DefaultQueryInterval
 }
 
 func (m *mdnsRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
@@ -591,153 +834,147 @@ func (m *mdnsRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, er
 	md := &mdnsWatcher{
 		id:       uuid.New().String(),
 		wo:       wo,
-		ch:       make(chan *mdns.ServiceEntry, 32),
+		pending:  make(map[string]*cacheEvent),
+		ready:    make(chan struct{}, 1),
 		exit:     make(chan struct{}),
 		domain:   wo.Domain,
 		registry: m,
 	}
 
 	m.mtx.Lock()
-	defer m.mtx.Unlock()
-
 	// save the watcher
 	m.watchers[md.id] = md
+	m.mtx.Unlock()
 
-	// check of the listener exists
-	if m.listener != nil {
-		return md, nil
-	}
-
-	// start the listener
-	go func() {
-		// go to infinity
-		for {
-			m.mtx.Lock()
+	// share the listener of the lookups
+	m.start()
 
-			// just return if there are no watchers
-			if len(m.watchers) == 0 {
-				m.listener = nil
-				m.mtx.Unlock()
-				return
-			}
-
-			// check existing listener
-			if m.listener != nil {
-				m.mtx.Unlock()
-				return
-			}
-
-			// reset the listener
-			exit := make(chan struct{})
-			ch := make(chan *mdns.ServiceEntry, 32)
-			m.listener = ch
+	return md, nil
+}
 
-			m.mtx.Unlock()
+// observe records an entry in the cache and sends the change to the
+// watchers
+func (m *mdnsRegistry) observe(e *mdns.ServiceEntry) {
+	if ev := m.cache.update(e); ev != nil {
+		m.notify(ev)
+	}
+}
 
-			// send messages to the watchers
-			go func() {
-				send := func(w *mdnsWatcher, e *mdns.ServiceEntry) {
-					select {
-					case w.ch <- e:
-					default:
-					}
-				}
+// notify queues ev on every watcher, it never blocks on a slow watcher
+func (m *mdnsRegistry) notify(ev *cacheEvent) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
 
-				for {
-					select {
-					case <-exit:
-						return
-					case e, ok := <-ch:
-						if !ok {
-							return
-						}
-						m.mtx.RLock()
-						// send service entry to all watchers
-						for _, w := range m.watchers {
-							send(w, e)
-						}
-						m.mtx.RUnlock()
-					}
-				}
+	for _, w := range m.watchers {
+		w.push(ev)
+	}
+}
 
-			}()
+// sweep sends delete events for the expired nodes and queries the
+// services whose records are about to expire so live nodes answer again
+func (m *mdnsRegistry) sweep() {
+	events, refresh := m.cache.expire(time.Now())
+	for _, ev := range events {
+		log.Debugf("[mdns] registry node %s of %s expired", ev.result.Service.Nodes[0].Id, ev.result.Service.Name)
+		m.notify(ev)
+	}
 
-			// start listening, blocking call
-			mdns.Listen(ch, exit)
-
-			// mdns.Listen has unblocked
-			// kill the saved listener
-			m.mtx.Lock()
-			m.listener = nil
-			close(ch)
-			m.mtx.Unlock()
+	queried := make(map[string]bool)
+	for _, e := range refresh {
+		key := e.domain + "/" + e.service.Name
+		if queried[key] {
+			continue
 		}
-	}()
-
-	return md, nil
+		queried[key] = true
+		go m.query(mdnsQuery{domain: e.domain, service: e.service.Name})
+	}
 }
 
 func (m *mdnsRegistry) String() string {
 	return "mdns"
 }
 
-func (m *mdnsWatcher) Next() (*registry.Result, error) {
-	for {
-		select {
-		case e := <-m.ch:
-			txt, err := decode(e.InfoFields)
-			if err != nil {
-				continue
-			}
+func (m *mdnsRegistry) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.exit)
+	})
 
-			if len(txt.Service) == 0 || len(txt.Version) == 0 {
-				continue
-			}
+	m.mtx.RLock()
+	watchers := make([]*mdnsWatcher, 0, len(m.watchers))
+	for _, w := range m.watchers {
+		watchers = append(watchers, w)
+	}
+	m.mtx.RUnlock()
 
-			// Filter watch options
-			// wo.Service: Only keep services we care about
-			if len(m.wo.Service) > 0 && txt.Service != m.wo.Service {
-				continue
-			}
-			var action string
-			if e.TTL == 0 {
-				action = "delete"
-			} else {
-				action = "create"
-			}
+	for _, w := range watchers {
+		w.Stop()
+	}
+}
 
-			service := &registry.Service{
-				Name:      txt.Service,
-				Version:   txt.Version,
-				Endpoints: txt.Endpoints,
-				Metadata:  txt.Metadata,
-			}
+// push queues ev if the watcher wants it, replacing the event of the same
+// node not read yet
+func (m *mdnsWatcher) push(ev *cacheEvent) {
+	// skip anything without the domain we care about
+	if ev.domain != m.domain {
+		return
+	}
 
-			// skip anything without the domain we care about
-			suffix := fmt.Sprintf(".%s.%s.", service.Name, m.domain)
-			if !strings.HasSuffix(e.Name, suffix) {
-				continue
-			}
+	// Filter watch options
+	// wo.Service: Only keep services we care about
+	if len(m.wo.Service) > 0 && ev.result.Service.Name != m.wo.Service {
+		return
+	}
 
-			var addr string
-			if len(e.AddrV4) > 0 {
-				addr = e.AddrV4.String()
-			} else if len(e.AddrV6) > 0 {
-				addr = "[" + e.AddrV6.String() + "]"
-			} else {
-				addr = e.Addr.String()
-			}
+	key := ev.result.Service.Name
+	if len(ev.result.Service.Nodes) > 0 {
+		key += "/" + ev.result.Service.Nodes[0].Id
+	}
 
-			service.Nodes = append(service.Nodes, &registry.Node{
-				Id:       strings.TrimSuffix(e.Name, suffix),
-				Address:  fmt.Sprintf("%s:%d", addr, e.Port),
-				Metadata: txt.Metadata,
-			})
+	m.mtx.Lock()
+	if _, ok := m.pending[key]; !ok {
+		m.order = append(m.order, key)
+	}
+	m.pending[key] = ev
+	m.mtx.Unlock()
 
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the oldest event queued
+func (m *mdnsWatcher) pop() (*cacheEvent, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if len(m.order) == 0 {
+		return nil, false
+	}
+	key := m.order[0]
+	m.order = m.order[1:]
+	ev := m.pending[key]
+	delete(m.pending, key)
+	return ev, true
+}
+
+func (m *mdnsWatcher) Next() (*registry.Result, error) {
+	for {
+		select {
+		case <-m.exit:
+			return nil, registry.ErrWatcherStopped
+		default:
+		}
+
+		if ev, ok := m.pop(); ok {
 			return &registry.Result{
-				Action:  action,
-				Service: service,
+				Action:  ev.result.Action,
+				Service: ev.result.Service,
 			}, nil
+		}
+
+		select {
+		case <-m.ready:
 		case <-m.exit:
 			return nil, registry.ErrWatcherStopped
 		}
@@ -745,19 +982,17 @@ func (m *mdnsWatcher) Next() (*registry.Result, error) {
 }
 
 func (m *mdnsWatcher) Stop() {
-	select {
-	case <-m.exit:
-		return
-	default:
+	// the registry stops its watchers too
+	m.once.Do(func() {
 		close(m.exit)
 		// remove self from the registry
 		m.registry.mtx.Lock()
 		delete(m.registry.watchers, m.id)
 		m.registry.mtx.Unlock()
-	}
+	})
 }
 
 // NewRegistry returns a new default registry which is mdns
-func NewRegistry(opts ...registry.Option) registry.Registry {
+func NewRegistry(opts ...registry.Option) Registry {
 	return newRegistry(opts...)
 }
@@ -1,11 +1,14 @@
 package mdns
 
 import (
+	"fmt"
+	"net"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/fztcjjl/tiger/trpc/registry"
+	mdns "github.com/fztcjjl/tiger/trpc/registry/mdns/util"
 )
 
 func TestMDNS(t *testing.T) {
@@ -340,3 +343,289 @@ func TestWatcher(t *testing.T) {
 		}
 	}
 }
+
+func testEntry(t *testing.T, id, addr string, port, ttl int) *mdns.ServiceEntry {
+	txt, err := encode(&mdnsTxt{
+		Service:  "test1",
+		Version:  "1.0.1",
+		Metadata: map[string]string{"foo": "bar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &mdns.ServiceEntry{
+		Name:       id + ".test1." + registry.DefaultDomain + ".",
+		AddrV4:     net.ParseIP(addr),
+		Port:       port,
+		InfoFields: txt,
+		TTL:        ttl,
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := newEntryCache()
+
+	ev := c.update(testEntry(t, "test1-1", "10.0.0.1", 10001, 10))
+	if ev == nil || ev.result.Action != "create" || ev.domain != registry.DefaultDomain {
+		t.Fatalf("Expected create event got %+v", ev)
+	}
+	if id := ev.result.Service.Nodes[0].Id; id != "test1-1" {
+		t.Fatalf("Expected node id test1-1 got %s", id)
+	}
+
+	// the same records only renew the entry
+	if ev := c.update(testEntry(t, "test1-1", "10.0.0.1", 10001, 10)); ev != nil {
+		t.Fatalf("Expected no event got %+v", ev.result)
+	}
+
+	ev = c.update(testEntry(t, "test1-1", "10.0.0.1", 10002, 10))
+	if ev == nil || ev.result.Action != "update" {
+		t.Fatalf("Expected update event got %+v", ev)
+	}
+
+	// the entry is queried again before expiring
+	events, refresh := c.expire(time.Now().Add(9 * time.Second))
+	if len(events) != 0 || len(refresh) != 1 {
+		t.Fatalf("Expected 1 entry to refresh got %d events and %d entries", len(events), len(refresh))
+	}
+	if _, refresh := c.expire(time.Now().Add(9 * time.Second)); len(refresh) != 0 {
+		t.Fatal("Expected the entry to be refreshed once")
+	}
+
+	events, _ = c.expire(time.Now().Add(11 * time.Second))
+	if len(events) != 1 || events[0].result.Action != "delete" {
+		t.Fatalf("Expected 1 delete event got %d", len(events))
+	}
+	if len(c.entries) != 0 {
+		t.Fatalf("Expected empty cache got %d entries", len(c.entries))
+	}
+
+	// goodbye records remove the node straight away
+	c.update(testEntry(t, "test1-2", "10.0.0.2", 10001, 10))
+	ev = c.update(testEntry(t, "test1-2", "10.0.0.2", 10001, 0))
+	if ev == nil || ev.result.Action != "delete" {
+		t.Fatalf("Expected delete event got %+v", ev)
+	}
+}
+
+func TestWatcherExpiry(t *testing.T) {
+	if travis := os.Getenv("CI"); travis == "true" {
+		t.Skip()
+	}
+
+	r := NewRegistry().(*mdnsRegistry)
+
+	w, err := r.Watch(registry.WatchService("test1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// a node which died without sending goodbye records
+	r.observe(testEntry(t, "test1-9", "10.0.0.9", 10009, 1))
+
+	for _, action := range []string{"create", "delete"} {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Action != action {
+			t.Fatalf("Expected %s event got %s", action, res.Action)
+		}
+		if id := res.Service.Nodes[0].Id; id != "test1-9" {
+			t.Fatalf("Expected node id test1-9 got %s", id)
+		}
+	}
+}
+
+func TestGetServiceCached(t *testing.T) {
+	if travis := os.Getenv("CI"); travis == "true" {
+		t.Skip()
+	}
+
+	r := NewRegistry()
+
+	service := &registry.Service{
+		Name:    "test4",
+		Version: "1.0.4",
+		Nodes: []*registry.Node{
+			{Id: "test4-1", Address: "10.0.0.4:10004"},
+		},
+	}
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(service)
+
+	// the first lookup queries the network
+	if _, err := r.GetService("test4"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a node started later is seen by the listener
+	node := &registry.Service{
+		Name:    "test4",
+		Version: "1.0.4",
+		Nodes: []*registry.Node{
+			{Id: "test4-2", Address: "10.0.0.5:10004"},
+		},
+	}
+	if err := r.Register(node); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(node)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		start := time.Now()
+		s, err := r.GetService("test4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// later lookups are answered from the cache
+		if d := time.Since(start); d > r.Options().Timeout/2 {
+			t.Fatalf("Expected lookup from the cache, took %v", d)
+		}
+		if len(s) == 1 && len(s[0].Nodes) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 nodes got %+v", s)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWatcherSlow(t *testing.T) {
+	if travis := os.Getenv("CI"); travis == "true" {
+		t.Skip()
+	}
+
+	r := NewRegistry().(*mdnsRegistry)
+	defer r.Stop()
+
+	w, err := r.Watch(registry.WatchService("test1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// more changes than a watcher buffers while nobody reads
+	n := 64
+	for i := 0; i < n; i++ {
+		r.observe(testEntry(t, fmt.Sprintf("test1-%d", i), "10.0.1.1", 10000+i, 10))
+	}
+	for i := 0; i < n; i++ {
+		r.observe(testEntry(t, fmt.Sprintf("test1-%d", i), "10.0.1.1", 10000+i, 0))
+	}
+
+	// only the last event of every node is kept
+	for i := 0; i < n; i++ {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Action != "delete" {
+			t.Fatalf("Expected delete event got %s", res.Action)
+		}
+		if id := res.Service.Nodes[0].Id; id != fmt.Sprintf("test1-%d", i) {
+			t.Fatalf("Expected node id test1-%d got %s", i, id)
+		}
+	}
+
+	if _, ok := w.(*mdnsWatcher).pop(); ok {
+		t.Fatal("Expected no more events")
+	}
+}
+
+func TestRegistryStop(t *testing.T) {
+	if travis := os.Getenv("CI"); travis == "true" {
+		t.Skip()
+	}
+
+	r := NewRegistry()
+
+	w, err := r.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Stop()
+	r.Stop()
+
+	if _, err := w.Next(); err != registry.ErrWatcherStopped {
+		t.Fatalf("Expected watcher stopped got %v", err)
+	}
+	w.Stop()
+}
+
+func TestRegistryConflict(t *testing.T) {
+	if travis := os.Getenv("CI"); travis == "true" {
+		t.Skip()
+	}
+
+	service := func(addr string) *registry.Service {
+		return &registry.Service{
+			Name:    "test.conflict",
+			Version: "1.0.0",
+			Nodes:   []*registry.Node{{Id: "conflict-1", Address: addr}},
+		}
+	}
+
+	owner := NewRegistry(IPv4Only())
+	defer owner.Stop()
+	if err := owner.Register(service("10.0.0.1:10001")); err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Deregister(service("10.0.0.1:10001"))
+
+	// the same node id from another host
+	conflicts := make(chan *mdns.ConflictError, 2)
+	r := NewRegistry(IPv4Only(), OnConflict(func(err *mdns.ConflictError) { conflicts <- err }))
+	defer r.Stop()
+
+	err := r.Register(service("10.0.0.2:10002"))
+	cerr, ok := err.(*mdns.ConflictError)
+	if !ok || cerr.Instance != "conflict-1" || len(cerr.Renamed) > 0 {
+		t.Fatalf("Expected a conflict for conflict-1 got %v", err)
+	}
+	select {
+	case err := <-conflicts:
+		if err.Instance != "conflict-1" {
+			t.Fatalf("bad: %v", err)
+		}
+	default:
+		t.Fatal("Expected OnConflict to be called")
+	}
+
+	// the node is dropped so registering again probes again
+	m := r.(*mdnsRegistry)
+	m.Lock()
+	domains := len(m.domains)
+	m.Unlock()
+	if domains != 0 {
+		t.Fatalf("Expected the conflicting node to be dropped, got %d domains", domains)
+	}
+
+	renamed := NewRegistry(IPv4Only(), Rename())
+	defer renamed.Stop()
+	if err := renamed.Register(service("10.0.0.3:10003")); err != nil {
+		t.Fatalf("Expected the node to be renamed got %v", err)
+	}
+	defer renamed.Deregister(service("10.0.0.3:10003"))
+
+	rm := renamed.(*mdnsRegistry)
+	rm.Lock()
+	entries := rm.domains[registry.DefaultDomain]["test.conflict"]
+	rm.Unlock()
+	var instance string
+	for _, entry := range entries {
+		if entry.id == "conflict-1" {
+			instance = entry.node.Instance()
+		}
+	}
+	if instance != "conflict-1-2" {
+		t.Fatalf("Expected instance conflict-1-2 got %q", instance)
+	}
+}
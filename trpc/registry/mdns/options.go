@@ -3,10 +3,28 @@ package mdns
 
 import (
 	"context"
+	"time"
 
 	"github.com/fztcjjl/tiger/trpc/registry"
+	mdns "github.com/fztcjjl/tiger/trpc/registry/mdns/util"
 )
 
+// DefaultQueryInterval is how often the services looked up are queried
+// again in the background
+var DefaultQueryInterval = time.Second * 30
+
+type queryIntervalKey struct{}
+
+type interfacesKey struct{}
+
+type ipModeKey struct{}
+
+type unicastKey struct{}
+
+type renameKey struct{}
+
+type conflictKey struct{}
+
 // Domain sets the mdnsDomain
 func Domain(d string) registry.Option {
 	return func(o *registry.Options) {
@@ -16,3 +34,78 @@ func Domain(d string) registry.Option {
 		o.Context = context.WithValue(o.Context, "mdns.domain", d)
 	}
 }
+
+// QueryInterval sets how often the services looked up are queried again to
+// find the nodes the listener missed
+func QueryInterval(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, queryIntervalKey{}, d)
+	}
+}
+
+// Interfaces restricts the announcements and queries to the named network
+// interfaces, e.g. to keep them off docker bridges and VPN adapters
+func Interfaces(names ...string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, interfacesKey{}, names)
+	}
+}
+
+// IPv4Only announces and queries over ipv4 only
+func IPv4Only() registry.Option {
+	return ipMode(mdns.IPv4Only)
+}
+
+// IPv6Only announces and queries over ipv6 only
+func IPv6Only() registry.Option {
+	return ipMode(mdns.IPv6Only)
+}
+
+func ipMode(mode mdns.IPMode) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, ipModeKey{}, mode)
+	}
+}
+
+// UnicastResponse sets the QU bit of the queries so nodes answer with
+// unicast rather than multicast responses, see RFC 6762 section 5.4
+func UnicastResponse() registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, unicastKey{}, true)
+	}
+}
+
+// Rename announces a node under a new instance name, e.g. "<id>-2", when
+// another host already uses its id. Otherwise Register returns the
+// *mdns.ConflictError and drops the node.
+func Rename() registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, renameKey{}, true)
+	}
+}
+
+// OnConflict sets a func called when another host claims the instance name
+// of a node, which may happen long after it was registered
+func OnConflict(fn func(err *mdns.ConflictError)) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, conflictKey{}, fn)
+	}
+}
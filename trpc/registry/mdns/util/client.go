@@ -46,6 +46,8 @@ type QueryParam struct {
 	Context             context.Context      // Context
 	Timeout             time.Duration        // Lookup timeout, default 1 second. Ignored if Context is provided
 	Interface           *net.Interface       // Multicast interface to use
+	Interfaces          []net.Interface      // Interfaces to query on, every one if empty
+	IPMode              IPMode               // IP versions to query with
 	Entries             chan<- *ServiceEntry // Entries Channel
 	WantUnicastResponse bool                 // Unicast response desired, as per 5.4 in RFC
 }
@@ -57,7 +59,7 @@ func DefaultParams(service string) *QueryParam {
 		Domain:              "local",
 		Timeout:             time.Second,
 		Entries:             make(chan *ServiceEntry),
-		WantUnicastResponse: false, // TODO(reddaly): Change this default.
+		WantUnicastResponse: false,
 	}
 }
 
@@ -67,7 +69,7 @@ func DefaultParams(service string) *QueryParam {
 // either read or buffer.
 func Query(params *QueryParam) error {
 	// Create a new client
-	client, err := newClient()
+	client, err := newClient(params.Interfaces, params.IPMode)
 	if err != nil {
 		return err
 	}
@@ -101,8 +103,16 @@ func Query(params *QueryParam) error {
 
 // Listen listens indefinitely for multicast updates
 func Listen(entries chan<- *ServiceEntry, exit chan struct{}) error {
+	return ListenWith(&QueryParam{Entries: entries}, exit)
+}
+
+// ListenWith listens indefinitely for multicast updates on the interfaces
+// and ip versions of params, sending the entries to params.Entries
+func ListenWith(params *QueryParam, exit chan struct{}) error {
+	entries := params.Entries
+
 	// Create a new client
-	client, err := newClient()
+	client, err := newClient(params.Interfaces, params.IPMode)
 	if err != nil {
 		return err
 	}
@@ -144,6 +154,9 @@ func Listen(entries chan<- *ServiceEntry, exit chan struct{}) error {
 				// Fire off a node specific query
 				m := new(dns.Msg)
 				m.SetQuestion(e.Name, dns.TypePTR)
+				if params.WantUnicastResponse {
+					m.Question[0].Qclass |= 1 << 15
+				}
 				m.RecursionDesired = false
 				if err := client.sendQuery(m); err != nil {
 					log.Printf("[ERR] mdns: Failed to query instance %s: %v", e.Name, err)
@@ -171,18 +184,27 @@ type client struct {
 	ipv4MulticastConn *net.UDPConn
 	ipv6MulticastConn *net.UDPConn
 
+	// send the queries on the selected interfaces, from the unicast port
+	// when a unicast response is wanted and from port 5353 otherwise so the
+	// responders don't take them for legacy queries
+	unicastWriter   *multicastWriter
+	multicastWriter *multicastWriter
+
 	closed    bool
 	closedCh  chan struct{} // TODO(reddaly): This doesn't appear to be used.
 	closeLock sync.Mutex
 }
 
 // NewClient creates a new mdns Client that can be used to query
-// for records
-func newClient() (*client, error) {
+// for records on ifaces, every interface if empty, with the ip versions
+// of mode
+func newClient(ifaces []net.Interface, mode IPMode) (*client, error) {
 	// TODO(reddaly): At least attempt to bind to the port required in the spec.
 	// Create a IPv4 listener
-	uconn4, err4 := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
-	uconn6, err6 := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6zero, Port: 0})
+	uconn4, uconn6, err4, err6 := listenUDP(mode,
+		&net.UDPAddr{IP: net.IPv4zero, Port: 0},
+		&net.UDPAddr{IP: net.IPv6zero, Port: 0},
+	)
 	if err4 != nil && err6 != nil {
 		log.Printf("[ERR] mdns: Failed to bind to udp port: %v %v", err4, err6)
 	}
@@ -191,67 +213,49 @@ func newClient() (*client, error) {
 		return nil, fmt.Errorf("failed to bind to any unicast udp port")
 	}
 
-	if uconn4 == nil {
-		uconn4 = &net.UDPConn{}
-	}
-
-	if uconn6 == nil {
-		uconn6 = &net.UDPConn{}
-	}
-
-	mconn4, err4 := net.ListenUDP("udp4", mdnsWildcardAddrIPv4)
-	mconn6, err6 := net.ListenUDP("udp6", mdnsWildcardAddrIPv6)
+	mconn4, mconn6, err4, err6 := listenUDP(mode, mdnsWildcardAddrIPv4, mdnsWildcardAddrIPv6)
 	if err4 != nil && err6 != nil {
 		log.Printf("[ERR] mdns: Failed to bind to udp port: %v %v", err4, err6)
 	}
 
 	if mconn4 == nil && mconn6 == nil {
+		closeConns(uconn4, uconn6)
 		return nil, fmt.Errorf("failed to bind to any multicast udp port")
 	}
 
-	if mconn4 == nil {
-		mconn4 = &net.UDPConn{}
+	if mconn4 != nil {
+		ipv4.NewPacketConn(mconn4).SetMulticastLoopback(true)
 	}
-
-	if mconn6 == nil {
-		mconn6 = &net.UDPConn{}
+	if mconn6 != nil {
+		ipv6.NewPacketConn(mconn6).SetMulticastLoopback(true)
 	}
 
-	p1 := ipv4.NewPacketConn(mconn4)
-	p2 := ipv6.NewPacketConn(mconn6)
-	p1.SetMulticastLoopback(true)
-	p2.SetMulticastLoopback(true)
-
-	ifaces, err := net.Interfaces()
-	if err != nil {
+	if err := joinGroups(mconn4, mconn6, ifaces); err != nil {
+		closeConns(uconn4, uconn6, mconn4, mconn6)
 		return nil, err
 	}
 
-	var errCount1, errCount2 int
-
-	for _, iface := range ifaces {
-		if err := p1.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
-			errCount1++
-		}
-		if err := p2.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
-			errCount2++
-		}
-	}
-
-	if len(ifaces) == errCount1 && len(ifaces) == errCount2 {
-		return nil, fmt.Errorf("Failed to join multicast group on all interfaces!")
-	}
-
 	c := &client{
 		ipv4MulticastConn: mconn4,
 		ipv6MulticastConn: mconn6,
 		ipv4UnicastConn:   uconn4,
 		ipv6UnicastConn:   uconn6,
+		unicastWriter:     &multicastWriter{conn4: uconn4, conn6: uconn6, ifaces: ifaces},
+		multicastWriter:   &multicastWriter{conn4: mconn4, conn6: mconn6, ifaces: ifaces},
 		closedCh:          make(chan struct{}),
 	}
 	return c, nil
 }
 
+// closeConns closes the connections which were bound
+func closeConns(conns ...*net.UDPConn) {
+	for _, c := range conns {
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
 // Close is used to cleanup the client
 func (c *client) Close() error {
 	c.closeLock.Lock()
@@ -283,26 +287,35 @@ func (c *client) Close() error {
 // setInterface is used to set the query interface, uses sytem
 // default if not provided
 func (c *client) setInterface(iface *net.Interface, loopback bool) error {
-	p := ipv4.NewPacketConn(c.ipv4UnicastConn)
-	if err := p.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
-		return err
-	}
-	p2 := ipv6.NewPacketConn(c.ipv6UnicastConn)
-	if err := p2.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
-		return err
+	if c.ipv4UnicastConn != nil {
+		p := ipv4.NewPacketConn(c.ipv4UnicastConn)
+		if err := p.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
+			return err
+		}
 	}
-	p = ipv4.NewPacketConn(c.ipv4MulticastConn)
-	if err := p.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
-		return err
+	if c.ipv6UnicastConn != nil {
+		p2 := ipv6.NewPacketConn(c.ipv6UnicastConn)
+		if err := p2.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
+			return err
+		}
 	}
-	p2 = ipv6.NewPacketConn(c.ipv6MulticastConn)
-	if err := p2.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
-		return err
+	if c.ipv4MulticastConn != nil {
+		p := ipv4.NewPacketConn(c.ipv4MulticastConn)
+		if err := p.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
+			return err
+		}
+		if loopback {
+			p.SetMulticastLoopback(true)
+		}
 	}
-
-	if loopback {
-		p.SetMulticastLoopback(true)
-		p2.SetMulticastLoopback(true)
+	if c.ipv6MulticastConn != nil {
+		p2 := ipv6.NewPacketConn(c.ipv6MulticastConn)
+		if err := p2.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
+			return err
+		}
+		if loopback {
+			p2.SetMulticastLoopback(true)
+		}
 	}
 
 	return nil
@@ -390,12 +403,14 @@ func (c *client) sendQuery(q *dns.Msg) error {
 	if err != nil {
 		return err
 	}
-	if c.ipv4UnicastConn != nil {
-		c.ipv4UnicastConn.WriteToUDP(buf, ipv4Addr)
-	}
-	if c.ipv6UnicastConn != nil {
-		c.ipv6UnicastConn.WriteToUDP(buf, ipv6Addr)
+
+	for _, qq := range q.Question {
+		if qq.Qclass&(1<<15) != 0 {
+			c.unicastWriter.write(buf)
+			return nil
+		}
 	}
+	c.multicastWriter.write(buf)
 	return nil
 }
 
@@ -0,0 +1,112 @@
+package mdns
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IPMode selects the ip versions used to announce and query
+type IPMode int
+
+const (
+	// IPv4AndIPv6 uses both versions, the default
+	IPv4AndIPv6 IPMode = iota
+	// IPv4Only only uses ipv4
+	IPv4Only
+	// IPv6Only only uses ipv6
+	IPv6Only
+)
+
+func (m IPMode) ipv4() bool {
+	return m != IPv6Only
+}
+
+func (m IPMode) ipv6() bool {
+	return m != IPv4Only
+}
+
+// listenUDP binds the ipv4 and ipv6 connections allowed by mode, either
+// can be nil
+func listenUDP(mode IPMode, addr4, addr6 *net.UDPAddr) (conn4, conn6 *net.UDPConn, err4, err6 error) {
+	if mode.ipv4() {
+		conn4, err4 = net.ListenUDP("udp4", addr4)
+	}
+	if mode.ipv6() {
+		conn6, err6 = net.ListenUDP("udp6", addr6)
+	}
+	return
+}
+
+// joinGroups joins the mdns groups on ifaces, every interface of the host
+// if none is given. It fails only if no group could be joined at all.
+func joinGroups(conn4, conn6 *net.UDPConn, ifaces []net.Interface) error {
+	if len(ifaces) == 0 {
+		var err error
+		if ifaces, err = net.Interfaces(); err != nil {
+			return err
+		}
+	}
+
+	var joined int
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if conn4 != nil {
+			if err := ipv4.NewPacketConn(conn4).JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err == nil {
+				joined++
+			}
+		}
+		if conn6 != nil {
+			if err := ipv6.NewPacketConn(conn6).JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err == nil {
+				joined++
+			}
+		}
+	}
+
+	if joined == 0 {
+		return fmt.Errorf("Failed to join multicast group on all interfaces!")
+	}
+	return nil
+}
+
+// multicastWriter sends packets to the mdns groups, on the given
+// interfaces only if any
+type multicastWriter struct {
+	sync.Mutex
+	conn4  *net.UDPConn
+	conn6  *net.UDPConn
+	ifaces []net.Interface
+}
+
+func (w *multicastWriter) write(buf []byte) {
+	if len(w.ifaces) == 0 {
+		if w.conn4 != nil {
+			w.conn4.WriteToUDP(buf, ipv4Addr)
+		}
+		if w.conn6 != nil {
+			w.conn6.WriteToUDP(buf, ipv6Addr)
+		}
+		return
+	}
+
+	// the outgoing interface is a socket option so sends are serialized
+	w.Lock()
+	defer w.Unlock()
+
+	for i := range w.ifaces {
+		iface := &w.ifaces[i]
+		if w.conn4 != nil {
+			if err := ipv4.NewPacketConn(w.conn4).SetMulticastInterface(iface); err == nil {
+				w.conn4.WriteToUDP(buf, ipv4Addr)
+			}
+		}
+		if w.conn6 != nil {
+			if err := ipv6.NewPacketConn(w.conn6).SetMulticastInterface(iface); err == nil {
+				w.conn6.WriteToUDP(buf, ipv6Addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package mdns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/miekg/dns"
+)
+
+var (
+	// probeWait is the longest random delay before the first probe
+	probeWait = 250 * time.Millisecond
+	// probeInterval is the time between two probes
+	probeInterval = 250 * time.Millisecond
+	// probeCount is the number of probes sent before claiming a name
+	probeCount = 3
+	// probeDefer is how long a host which lost a probe tiebreak waits
+	// before probing again
+	probeDefer = time.Second
+	// announceCount is the number of unsolicited responses announcing
+	// a claimed name
+	announceCount = 3
+)
+
+// probeResult is how probing or defending an instance name ended
+type probeResult int
+
+const (
+	// probeClaimed means no other host answered for the name
+	probeClaimed probeResult = iota
+	// probeConflict means another host answered for the name
+	probeConflict
+	// probeLost means another host probing for the name at the same time
+	// won the tiebreak
+	probeLost
+	// probeShutdown means the server was shut down
+	probeShutdown
+)
+
+// ConflictError is reported when another host claims the instance name of
+// the zone
+type ConflictError struct {
+	// Instance is the name which is in conflict
+	Instance string
+	// Renamed is the name probed instead, empty if the server stopped
+	// answering for the zone
+	Renamed string
+}
+
+func (e *ConflictError) Error() string {
+	if len(e.Renamed) > 0 {
+		return fmt.Sprintf("mdns: instance %s is used by another host, renamed to %s", e.Instance, e.Renamed)
+	}
+	return fmt.Sprintf("mdns: instance %s is used by another host", e.Instance)
+}
+
+// probe claims the instance name of the zone as described in RFC 6762
+// section 8, then defends it for the life of the server as described in
+// section 9. Lookups are answered while probing, the instance names of the
+// registry carry unique ids so waiting for the name is not worth the delay.
+func (s *Server) probe() {
+	defer s.wg.Done()
+	// nothing left to wait for once probing ends
+	defer s.claim(nil)
+
+	if _, ok := s.getZone().(*MDNSService); !ok {
+		return
+	}
+
+	randomizer := rand.New(rand.NewSource(time.Now().UnixNano()))
+	wait := time.Duration(randomizer.Int63n(int64(probeWait)))
+
+	for {
+		res := s.probeName(wait)
+		if res == probeClaimed {
+			s.claim(nil)
+			res = s.announce()
+		}
+
+		switch res {
+		case probeShutdown:
+			return
+		case probeLost:
+			// section 8.2, the other host goes first
+			wait = probeDefer
+		case probeConflict:
+			if !s.resolveConflict() {
+				return
+			}
+			wait = 0
+		}
+	}
+}
+
+// probeName sends the probes for the instance name, section 8.1
+func (s *Server) probeName(wait time.Duration) probeResult {
+	atomic.StoreInt32(&s.probing, 1)
+	defer atomic.StoreInt32(&s.probing, 0)
+
+	// forget what happened to the previous name
+	select {
+	case <-s.conflictCh:
+	default:
+	}
+
+	if res, ok := s.wait(wait); ok {
+		return res
+	}
+
+	sd := s.getZone().(*MDNSService)
+
+	q := new(dns.Msg)
+	q.SetQuestion(sd.instanceAddr, dns.TypeANY)
+	q.RecursionDesired = false
+	// the records we want are in the authority section for the tiebreak
+	q.Ns = uniqueRecords(sd)
+
+	for i := 0; i < probeCount; i++ {
+		if err := s.SendMulticast(q); err != nil {
+			log.Errorf("[ERR] mdns: failed to send probe: %v", err)
+		}
+		if res, ok := s.wait(probeInterval); ok {
+			return res
+		}
+	}
+
+	return probeClaimed
+}
+
+// announce sends the unsolicited responses for a claimed name, then waits
+// for another host to answer for it
+func (s *Server) announce() probeResult {
+	sd := s.getZone().(*MDNSService)
+
+	resp := new(dns.Msg)
+	resp.MsgHdr.Response = true
+	resp.MsgHdr.Authoritative = true
+	resp.Answer = sd.Records(dns.Question{Name: sd.instanceAddr, Qtype: dns.TypeANY, Qclass: dns.ClassINET})
+
+	// From RFC6762
+	//    The Multicast DNS responder MUST send at least two unsolicited
+	//    responses, one second apart. To provide increased robustness against
+	//    packet loss, a responder MAY send up to eight unsolicited responses,
+	//    provided that the interval between unsolicited responses increases by
+	//    at least a factor of two with every response sent.
+	timeout := time.Second
+	for i := 0; i < announceCount; i++ {
+		if err := s.SendMulticast(resp); err != nil {
+			log.Errorf("[ERR] mdns: failed to send announcement: %v", err)
+		}
+		if res, ok := s.wait(timeout); ok && res != probeLost {
+			return res
+		}
+		timeout *= 2
+	}
+
+	for {
+		select {
+		case res := <-s.conflictCh:
+			if res == probeConflict {
+				return res
+			}
+		case <-s.shutdownCh:
+			return probeShutdown
+		}
+	}
+}
+
+// wait sleeps for d, returning early if a conflict was found or the server
+// was shut down
+func (s *Server) wait(d time.Duration) (probeResult, bool) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case res := <-s.conflictCh:
+		return res, true
+	case <-s.shutdownCh:
+		return probeShutdown, true
+	case <-timer.C:
+		return probeClaimed, false
+	}
+}
+
+// claim records how the first probe of the server ended
+func (s *Server) claim(err error) {
+	s.claimOnce.Do(func() {
+		s.claimErr = err
+		close(s.claimed)
+	})
+}
+
+// Claimed waits until the instance name of the zone was claimed, a renamed
+// instance counting once its new name was. It returns the ConflictError if
+// the server stopped answering for the zone, or the error of ctx.
+func (s *Server) Claimed(ctx context.Context) error {
+	select {
+	case <-s.claimed:
+		return s.claimErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// signal wakes up the probing routine
+func (s *Server) signal(res probeResult) {
+	select {
+	case s.conflictCh <- res:
+	default:
+	}
+}
+
+// resolveConflict renames the instance if the config allows it, otherwise
+// it stops answering for the zone. It returns whether to probe again.
+func (s *Server) resolveConflict() bool {
+	sd := s.getZone().(*MDNSService)
+	cerr := &ConflictError{Instance: sd.Instance}
+
+	if s.config.Rename {
+		s.renames++
+		cerr.Renamed = fmt.Sprintf("%s-%d", s.instance, s.renames+1)
+		s.setZone(sd.withInstance(cerr.Renamed))
+	} else {
+		atomic.StoreInt32(&s.conflicted, 1)
+		s.claim(cerr)
+	}
+
+	log.Errorf("[ERR] %v", cerr)
+	if s.config.OnConflict != nil {
+		s.config.OnConflict(cerr)
+	}
+
+	return s.config.Rename
+}
+
+// handleResponse looks for another host answering for our instance name
+// with different records, section 9
+func (s *Server) handleResponse(resp *dns.Msg) {
+	sd, ok := s.getZone().(*MDNSService)
+	if !ok || atomic.LoadInt32(&s.conflicted) == 1 {
+		return
+	}
+
+	ours := uniqueRecords(sd)
+	for _, rr := range append(resp.Answer, resp.Extra...) {
+		// goodbye records are not a claim
+		if rr.Header().Ttl == 0 || !strings.EqualFold(rr.Header().Name, sd.instanceAddr) {
+			continue
+		}
+		if conflicts(rr, ours) {
+			s.signal(probeConflict)
+			return
+		}
+	}
+}
+
+// handleProbe breaks the tie with another host probing for our instance
+// name at the same time, section 8.2. The host whose records are
+// lexicographically later wins, our own probes compare equal.
+func (s *Server) handleProbe(query *dns.Msg) {
+	sd, ok := s.getZone().(*MDNSService)
+	if !ok || !s.isProbing(sd.instanceAddr) {
+		return
+	}
+
+	var theirs []dns.RR
+	for _, rr := range query.Ns {
+		if strings.EqualFold(rr.Header().Name, sd.instanceAddr) {
+			theirs = append(theirs, rr)
+		}
+	}
+	if len(theirs) == 0 {
+		return
+	}
+
+	if compareRecords(uniqueRecords(sd), theirs) < 0 {
+		s.signal(probeLost)
+	}
+}
+
+// isProbing returns whether name is the instance name being probed
+func (s *Server) isProbing(name string) bool {
+	if atomic.LoadInt32(&s.probing) == 0 {
+		return false
+	}
+	sd, ok := s.getZone().(*MDNSService)
+	return ok && strings.EqualFold(name, sd.instanceAddr)
+}
+
+// uniqueRecords returns the records only the owner of the instance name
+// may answer with
+func uniqueRecords(sd *MDNSService) []dns.RR {
+	var recs []dns.RR
+	for _, t := range []uint16{dns.TypeSRV, dns.TypeTXT} {
+		for _, rr := range sd.Records(dns.Question{Name: sd.instanceAddr, Qtype: t, Qclass: dns.ClassINET}) {
+			if rr.Header().Rrtype == t {
+				recs = append(recs, rr)
+			}
+		}
+	}
+	return recs
+}
+
+// conflicts returns whether rr has the type of one of ours with other data
+func conflicts(rr dns.RR, ours []dns.RR) bool {
+	for _, o := range ours {
+		if o.Header().Rrtype == rr.Header().Rrtype {
+			return !bytes.Equal(rdata(o), rdata(rr))
+		}
+	}
+	return false
+}
+
+// compareRecords compares two sets of records by class, type and then
+// raw data once sorted, as described in section 8.2
+func compareRecords(a, b []dns.RR) int {
+	a, b = sortRecords(a), sortRecords(b)
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareRecord(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+func sortRecords(recs []dns.RR) []dns.RR {
+	sorted := append([]dns.RR(nil), recs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return compareRecord(sorted[i], sorted[j]) < 0
+	})
+	return sorted
+}
+
+func compareRecord(a, b dns.RR) int {
+	ha, hb := a.Header(), b.Header()
+	// the top bit of the class is the cache flush bit
+	if ca, cb := ha.Class&0x7fff, hb.Class&0x7fff; ca != cb {
+		if ca < cb {
+			return -1
+		}
+		return 1
+	}
+	if ha.Rrtype != hb.Rrtype {
+		if ha.Rrtype < hb.Rrtype {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(rdata(a), rdata(b))
+}
+
+// rdata returns the uncompressed wire format of the data of rr
+func rdata(rr dns.RR) []byte {
+	buf := make([]byte, dns.Len(rr))
+	end, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+
+	name := make([]byte, 256)
+	start, err := dns.PackDomainName(rr.Header().Name, name, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+
+	// the name is followed by the type, class, ttl and data length
+	start += 10
+	if start > end {
+		return nil
+	}
+	return buf[start:end]
+}
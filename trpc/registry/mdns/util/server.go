@@ -2,11 +2,9 @@ package mdns
 
 import (
 	"fmt"
-	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	log "github.com/fztcjjl/tiger/trpc/logger"
 	"github.com/miekg/dns"
@@ -53,6 +51,22 @@ type Config struct {
 	// is used.
 	Iface *net.Interface
 
+	// Ifaces if provided restricts the listener and the announcements to
+	// the given interfaces, so they don't leak onto bridges or VPNs.
+	Ifaces []net.Interface
+
+	// IPMode selects the ip versions used, both by default
+	IPMode IPMode
+
+	// Rename if set probes again under a new instance name, e.g. "node-2",
+	// when another host claims the instance name of the zone. Otherwise
+	// the server stops answering for the zone.
+	Rename bool
+
+	// OnConflict if set is called when another host claims the instance
+	// name of the zone
+	OnConflict func(err *ConflictError)
+
 	// Port If it is not 0, replace the port 5353 with this port number.
 	Port int
 
@@ -68,8 +82,28 @@ type Config struct {
 type Server struct {
 	config *Config
 
+	// the zone answered, replaced when the instance is renamed
+	zoneLock sync.RWMutex
+	zone     Zone
+	// the instance name of the config and the number of renames
+	instance string
+	renames  int
+
+	// set while the instance name is probed
+	probing int32
+	// set once another host claimed the instance name
+	conflicted int32
+	conflictCh chan probeResult
+	// closed once the first name was claimed or given up, claimErr is the
+	// conflict which made the server stop answering for the zone
+	claimed   chan struct{}
+	claimOnce sync.Once
+	claimErr  error
+
 	ipv4List *net.UDPConn
 	ipv6List *net.UDPConn
+	// sends the announcements on the selected interfaces
+	writer *multicastWriter
 
 	shutdown     bool
 	shutdownCh   chan struct{}
@@ -85,49 +119,26 @@ func NewServer(config *Config) (*Server, error) {
 
 	// Create the listeners
 	// Create wildcard connections (because :5353 can be already taken by other apps)
-	ipv4List, _ := net.ListenUDP("udp4", mdnsWildcardAddrIPv4)
-	ipv6List, _ := net.ListenUDP("udp6", mdnsWildcardAddrIPv6)
+	ipv4List, ipv6List, _, _ := listenUDP(config.IPMode, mdnsWildcardAddrIPv4, mdnsWildcardAddrIPv6)
 	if ipv4List == nil && ipv6List == nil {
 		return nil, fmt.Errorf("[ERR] mdns: Failed to bind to any udp port!")
 	}
 
-	if ipv4List == nil {
-		ipv4List = &net.UDPConn{}
+	// Join multicast groups to receive announcements
+	if ipv4List != nil {
+		ipv4.NewPacketConn(ipv4List).SetMulticastLoopback(true)
 	}
-	if ipv6List == nil {
-		ipv6List = &net.UDPConn{}
+	if ipv6List != nil {
+		ipv6.NewPacketConn(ipv6List).SetMulticastLoopback(true)
 	}
 
-	// Join multicast groups to receive announcements
-	p1 := ipv4.NewPacketConn(ipv4List)
-	p2 := ipv6.NewPacketConn(ipv6List)
-	p1.SetMulticastLoopback(true)
-	p2.SetMulticastLoopback(true)
-
+	ifaces := config.Ifaces
 	if config.Iface != nil {
-		if err := p1.JoinGroup(config.Iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
-			return nil, err
-		}
-		if err := p2.JoinGroup(config.Iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
-			return nil, err
-		}
-	} else {
-		ifaces, err := net.Interfaces()
-		if err != nil {
-			return nil, err
-		}
-		errCount1, errCount2 := 0, 0
-		for _, iface := range ifaces {
-			if err := p1.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
-				errCount1++
-			}
-			if err := p2.JoinGroup(&iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
-				errCount2++
-			}
-		}
-		if len(ifaces) == errCount1 && len(ifaces) == errCount2 {
-			return nil, fmt.Errorf("Failed to join multicast group on all interfaces!")
-		}
+		ifaces = []net.Interface{*config.Iface}
+	}
+	if err := joinGroups(ipv4List, ipv6List, ifaces); err != nil {
+		closeConns(ipv4List, ipv6List)
+		return nil, err
 	}
 
 	ipFunc := getOutboundIP
@@ -137,8 +148,12 @@ func NewServer(config *Config) (*Server, error) {
 
 	s := &Server{
 		config:     config,
+		zone:       config.Zone,
+		conflictCh: make(chan probeResult, 1),
+		claimed:    make(chan struct{}),
 		ipv4List:   ipv4List,
 		ipv6List:   ipv6List,
+		writer:     &multicastWriter{conn4: ipv4List, conn6: ipv6List, ifaces: ifaces},
 		shutdownCh: make(chan struct{}),
 		outboundIP: ipFunc(),
 	}
@@ -146,12 +161,37 @@ func NewServer(config *Config) (*Server, error) {
 	go s.recv(s.ipv4List)
 	go s.recv(s.ipv6List)
 
+	if sd, ok := config.Zone.(*MDNSService); ok {
+		s.instance = sd.Instance
+	}
+
 	s.wg.Add(1)
 	go s.probe()
 
 	return s, nil
 }
 
+// Instance returns the instance name answered for, which differs from the
+// one of the config once the server was renamed after a conflict
+func (s *Server) Instance() string {
+	if sd, ok := s.getZone().(*MDNSService); ok {
+		return sd.Instance
+	}
+	return ""
+}
+
+func (s *Server) getZone() Zone {
+	s.zoneLock.RLock()
+	defer s.zoneLock.RUnlock()
+	return s.zone
+}
+
+func (s *Server) setZone(z Zone) {
+	s.zoneLock.Lock()
+	s.zone = z
+	s.zoneLock.Unlock()
+}
+
 // Shutdown is used to shutdown the listener
 func (s *Server) Shutdown() error {
 	s.shutdownLock.Lock()
@@ -210,6 +250,15 @@ func (s *Server) parsePacket(packet []byte, from net.Addr) error {
 	// We decided to ignore some mDNS answers for the time being
 	// See: https://tools.ietf.org/html/rfc6762#section-7.2
 	msg.Truncated = false
+
+	// responses are never answered, they may claim our instance name
+	if msg.Response {
+		s.handleResponse(&msg)
+		return nil
+	}
+	if len(msg.Ns) > 0 {
+		s.handleProbe(&msg)
+	}
 	return s.handleQuery(&msg, from)
 }
 
@@ -243,6 +292,11 @@ func (s *Server) handleQuery(query *dns.Msg, from net.Addr) error {
 
 	// Handle each question
 	for _, q := range query.Question {
+		// RFC 6762, section 8.1: a host probing for a name does not
+		// answer the probes of others for it
+		if len(query.Ns) > 0 && s.isProbing(q.Name) {
+			continue
+		}
 		mrecs, urecs := s.handleQuestion(q)
 		multicastAnswer = append(multicastAnswer, mrecs...)
 		unicastAnswer = append(unicastAnswer, urecs...)
@@ -301,8 +355,22 @@ func (s *Server) handleQuery(query *dns.Msg, from net.Addr) error {
 		}
 	}
 
+	// RFC 6762, section 6.7: a query which does not come from port 5353
+	// and asks for no unicast response is a one-shot legacy query, it gets
+	// a conventional unicast dns response only
+	if isLegacy(query, from) {
+		lresp := legacyResponse(query, append(multicastAnswer, unicastAnswer...))
+		if lresp == nil {
+			return nil
+		}
+		if err := s.sendResponse(lresp, from); err != nil {
+			return fmt.Errorf("mdns: error sending legacy unicast response: %v", err)
+		}
+		return nil
+	}
+
 	if mresp := resp(false); mresp != nil {
-		if err := s.sendResponse(mresp, from); err != nil {
+		if err := s.SendMulticast(mresp); err != nil {
 			return fmt.Errorf("mdns: error sending multicast response: %v", err)
 		}
 	}
@@ -314,12 +382,64 @@ func (s *Server) handleQuery(query *dns.Msg, from net.Addr) error {
 	return nil
 }
 
+// legacyTTL is the highest ttl of the records of a legacy unicast response
+const legacyTTL = 10
+
+// isLegacy returns whether query comes from a legacy resolver, which sends
+// from another port than 5353 and asks for no unicast response
+func isLegacy(query *dns.Msg, from net.Addr) bool {
+	addr, ok := from.(*net.UDPAddr)
+	if !ok || addr.Port == ipv4Addr.Port {
+		return false
+	}
+	for _, q := range query.Question {
+		if q.Qclass&(1<<15) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// legacyResponse builds the reply to a legacy query as described in
+// RFC 6762 section 6.7. It repeats the query id and question, caps the
+// ttls to ten seconds and clears the cache flush bit.
+func legacyResponse(query *dns.Msg, answer []dns.RR) *dns.Msg {
+	if len(answer) == 0 {
+		return nil
+	}
+
+	recs := make([]dns.RR, len(answer))
+	for i, rr := range answer {
+		// the records belong to the zone
+		rec := dns.Copy(rr)
+		h := rec.Header()
+		h.Class &^= 1 << 15
+		if h.Ttl > legacyTTL {
+			h.Ttl = legacyTTL
+		}
+		recs[i] = rec
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Authoritative = true
+	resp.Compress = true
+	resp.Question = query.Question
+	resp.Answer = recs
+	return resp
+}
+
 // handleQuestion is used to handle an incoming question
 //
 // The response to a question may be transmitted over multicast, unicast, or
 // both.  The return values are DNS records for each transmission type.
 func (s *Server) handleQuestion(q dns.Question) (multicastRecs, unicastRecs []dns.RR) {
-	records := s.config.Zone.Records(q)
+	// another host owns the records
+	if atomic.LoadInt32(&s.conflicted) == 1 {
+		return nil, nil
+	}
+
+	records := s.getZone().Records(q)
 	if len(records) == 0 {
 		return nil, nil
 	}
@@ -341,105 +461,18 @@ func (s *Server) handleQuestion(q dns.Question) (multicastRecs, unicastRecs []dn
 	return records, nil
 }
 
-func (s *Server) probe() {
-	defer s.wg.Done()
-
-	sd, ok := s.config.Zone.(*MDNSService)
-	if !ok {
-		return
-	}
-
-	name := fmt.Sprintf("%s.%s.%s.", sd.Instance, trimDot(sd.Service), trimDot(sd.Domain))
-
-	q := new(dns.Msg)
-	q.SetQuestion(name, dns.TypePTR)
-	q.RecursionDesired = false
-
-	srv := &dns.SRV{
-		Hdr: dns.RR_Header{
-			Name:   name,
-			Rrtype: dns.TypeSRV,
-			Class:  dns.ClassINET,
-			Ttl:    defaultTTL,
-		},
-		Priority: 0,
-		Weight:   0,
-		Port:     uint16(sd.Port),
-		Target:   sd.HostName,
-	}
-	txt := &dns.TXT{
-		Hdr: dns.RR_Header{
-			Name:   name,
-			Rrtype: dns.TypeTXT,
-			Class:  dns.ClassINET,
-			Ttl:    defaultTTL,
-		},
-		Txt: sd.TXT,
-	}
-	q.Ns = []dns.RR{srv, txt}
-
-	randomizer := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	for i := 0; i < 3; i++ {
-		if err := s.SendMulticast(q); err != nil {
-			log.Errorf("[ERR] mdns: failed to send probe:", err.Error())
-		}
-		time.Sleep(time.Duration(randomizer.Intn(250)) * time.Millisecond)
-	}
-
-	resp := new(dns.Msg)
-	resp.MsgHdr.Response = true
-
-	// set for query
-	q.SetQuestion(name, dns.TypeANY)
-
-	resp.Answer = append(resp.Answer, s.config.Zone.Records(q.Question[0])...)
-
-	// reset
-	q.SetQuestion(name, dns.TypePTR)
-
-	// From RFC6762
-	//    The Multicast DNS responder MUST send at least two unsolicited
-	//    responses, one second apart. To provide increased robustness against
-	//    packet loss, a responder MAY send up to eight unsolicited responses,
-	//    provided that the interval between unsolicited responses increases by
-	//    at least a factor of two with every response sent.
-	timeout := 1 * time.Second
-	timer := time.NewTimer(timeout)
-	for i := 0; i < 3; i++ {
-		if err := s.SendMulticast(resp); err != nil {
-			log.Errorf("[ERR] mdns: failed to send announcement:", err.Error())
-		}
-		select {
-		case <-timer.C:
-			timeout *= 2
-			timer.Reset(timeout)
-		case <-s.shutdownCh:
-			timer.Stop()
-			return
-		}
-	}
-}
-
 // SendMulticast us used to send a multicast response packet
 func (s *Server) SendMulticast(msg *dns.Msg) error {
 	buf, err := msg.Pack()
 	if err != nil {
 		return err
 	}
-	if s.ipv4List != nil {
-		s.ipv4List.WriteToUDP(buf, ipv4Addr)
-	}
-	if s.ipv6List != nil {
-		s.ipv6List.WriteToUDP(buf, ipv6Addr)
-	}
+	s.writer.write(buf)
 	return nil
 }
 
-// sendResponse is used to send a response packet
+// sendResponse is used to send a unicast response packet
 func (s *Server) sendResponse(resp *dns.Msg, from net.Addr) error {
-	// TODO(reddaly): Respect the unicast argument, and allow sending responses
-	// over multicast.
 	buf, err := resp.Pack()
 	if err != nil {
 		return err
@@ -467,8 +500,10 @@ func (s *Server) sendResponse(resp *dns.Msg, from net.Addr) error {
 }
 
 func (s *Server) unregister() error {
-	sd, ok := s.config.Zone.(*MDNSService)
-	if !ok {
+	sd, ok := s.getZone().(*MDNSService)
+	// the goodbye records of a name in conflict would remove the ones
+	// of the host owning it
+	if !ok || atomic.LoadInt32(&s.conflicted) == 1 {
 		return nil
 	}
 
@@ -480,7 +515,7 @@ func (s *Server) unregister() error {
 
 	resp := new(dns.Msg)
 	resp.MsgHdr.Response = true
-	resp.Answer = append(resp.Answer, s.config.Zone.Records(q.Question[0])...)
+	resp.Answer = append(resp.Answer, sd.Records(q.Question[0])...)
 
 	return s.SendMulticast(resp)
 }
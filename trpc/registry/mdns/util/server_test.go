@@ -1,8 +1,12 @@
 package mdns
 
 import (
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 func TestServer_StartStop(t *testing.T) {
@@ -59,3 +63,293 @@ func TestServer_Lookup(t *testing.T) {
 		t.Fatalf("record not found")
 	}
 }
+
+// multicastInterface returns an interface multicast packets can be sent on
+func multicastInterface(t *testing.T) net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+			return iface
+		}
+	}
+	t.Skip("no multicast interface")
+	return net.Interface{}
+}
+
+func testLookup(t *testing.T, config *Config, params *QueryParam) {
+	config.Zone = makeServiceWithServiceName(t, "_foobar._tcp")
+	config.LocalhostChecking = true
+	serv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	entries := make(chan *ServiceEntry, 1)
+	params.Service = "_foobar._tcp"
+	params.Domain = "local"
+	params.Timeout = 50 * time.Millisecond
+	params.Entries = entries
+
+	if err := Query(params); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case e := <-entries:
+		if e.Name != "hostname._foobar._tcp.local." || e.Port != 80 {
+			t.Fatalf("bad: %v", e)
+		}
+	default:
+		t.Fatalf("record not found")
+	}
+}
+
+func TestServer_LookupIPv4Only(t *testing.T) {
+	testLookup(t, &Config{IPMode: IPv4Only}, &QueryParam{IPMode: IPv4Only})
+}
+
+func TestServer_LookupInterfaces(t *testing.T) {
+	ifaces := []net.Interface{multicastInterface(t)}
+	testLookup(t, &Config{Ifaces: ifaces}, &QueryParam{Interfaces: ifaces})
+}
+
+func TestServer_LookupUnicastResponse(t *testing.T) {
+	testLookup(t, &Config{}, &QueryParam{WantUnicastResponse: true})
+}
+
+func makeServiceWithPort(t *testing.T, port int) *MDNSService {
+	s := makeServiceWithServiceName(t, "_conflict._tcp")
+	s.Port = port
+	return s
+}
+
+// waitClaimed waits for the server to finish probing its name
+func waitClaimed(t *testing.T, s *Server) {
+	deadline := time.Now().Add(5 * time.Second)
+	time.Sleep(probeWait)
+	for atomic.LoadInt32(&s.probing) == 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout probing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_ConflictRename(t *testing.T) {
+	owner, err := NewServer(&Config{Zone: makeServiceWithPort(t, 80), IPMode: IPv4Only})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer owner.Shutdown()
+	waitClaimed(t, owner)
+
+	conflicts := make(chan *ConflictError, 1)
+	serv, err := NewServer(&Config{
+		Zone:       makeServiceWithPort(t, 81),
+		IPMode:     IPv4Only,
+		Rename:     true,
+		OnConflict: func(err *ConflictError) { conflicts <- err },
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	select {
+	case err := <-conflicts:
+		if err.Instance != "hostname" || err.Renamed != "hostname-2" {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the conflict")
+	}
+	waitClaimed(t, serv)
+
+	if name := serv.Instance(); name != "hostname-2" {
+		t.Fatalf("Expected instance hostname-2 got %s", name)
+	}
+	if name := owner.Instance(); name != "hostname" || atomic.LoadInt32(&owner.conflicted) == 1 {
+		t.Fatalf("Expected the owner to keep hostname got %s", name)
+	}
+
+	// the renamed instance is answered
+	q := dns.Question{Name: "hostname-2._conflict._tcp.local.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}
+	if recs, _ := serv.handleQuestion(q); len(recs) == 0 {
+		t.Fatal("Expected records for the renamed instance")
+	}
+}
+
+func TestServer_ConflictCallback(t *testing.T) {
+	owner, err := NewServer(&Config{Zone: makeServiceWithPort(t, 80), IPMode: IPv4Only})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer owner.Shutdown()
+	waitClaimed(t, owner)
+
+	conflicts := make(chan *ConflictError, 1)
+	serv, err := NewServer(&Config{
+		Zone:       makeServiceWithPort(t, 81),
+		IPMode:     IPv4Only,
+		OnConflict: func(err *ConflictError) { conflicts <- err },
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+
+	select {
+	case err := <-conflicts:
+		if err.Instance != "hostname" || len(err.Renamed) > 0 {
+			t.Fatalf("bad: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the conflict")
+	}
+
+	// the server stopped answering for the name of the owner
+	q := dns.Question{Name: "hostname._conflict._tcp.local.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}
+	if mrecs, urecs := serv.handleQuestion(q); len(mrecs) > 0 || len(urecs) > 0 {
+		t.Fatal("Expected no records after the conflict")
+	}
+}
+
+func TestServer_ProbeTiebreak(t *testing.T) {
+	ours := makeServiceWithPort(t, 81)
+	s := &Server{zone: ours, probing: 1, conflictCh: make(chan probeResult, 1)}
+
+	probe := func(port int) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(ours.instanceAddr, dns.TypeANY)
+		q.Ns = uniqueRecords(makeServiceWithPort(t, port))
+		return q
+	}
+
+	for _, test := range []struct {
+		port int
+		lost bool
+	}{
+		// our own probe
+		{81, false},
+		// lexicographically earlier
+		{80, false},
+		// lexicographically later
+		{82, true},
+	} {
+		s.handleProbe(probe(test.port))
+
+		select {
+		case res := <-s.conflictCh:
+			if !test.lost || res != probeLost {
+				t.Fatalf("port %d: unexpected result %v", test.port, res)
+			}
+		default:
+			if test.lost {
+				t.Fatalf("port %d: expected to lose the tiebreak", test.port)
+			}
+		}
+	}
+}
+
+func TestServer_HandleResponse(t *testing.T) {
+	ours := makeServiceWithPort(t, 81)
+	s := &Server{zone: ours, conflictCh: make(chan probeResult, 1)}
+
+	response := func(sd *MDNSService) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.Response = true
+		resp.Answer = sd.Records(dns.Question{Name: sd.instanceAddr, Qtype: dns.TypeANY, Qclass: dns.ClassINET})
+		return resp
+	}
+
+	// the same records are not a conflict
+	s.handleResponse(response(makeServiceWithPort(t, 81)))
+
+	// nor goodbye records
+	goodbye := makeServiceWithPort(t, 80)
+	goodbye.TTL = 0
+	s.handleResponse(response(goodbye))
+
+	select {
+	case res := <-s.conflictCh:
+		t.Fatalf("unexpected result %v", res)
+	default:
+	}
+
+	s.handleResponse(response(makeServiceWithPort(t, 80)))
+	select {
+	case res := <-s.conflictCh:
+		if res != probeConflict {
+			t.Fatalf("Expected conflict got %v", res)
+		}
+	default:
+		t.Fatal("Expected a conflict")
+	}
+}
+
+func TestServer_LegacyQuery(t *testing.T) {
+	serv, err := NewServer(&Config{Zone: makeServiceWithServiceName(t, "_legacy._tcp"), IPMode: IPv4Only})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer serv.Shutdown()
+	waitClaimed(t, serv)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("hostname._legacy._tcp.local.", dns.TypeSRV)
+	q.Id = 4242
+	q.RecursionDesired = false
+
+	// queries with the unicast bit or from the mdns port aren't legacy
+	qu := q.Copy()
+	qu.Question[0].Qclass |= 1 << 15
+	if isLegacy(qu, conn.LocalAddr()) {
+		t.Fatal("Expected a QU query not to be legacy")
+	}
+	if isLegacy(q, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}) {
+		t.Fatal("Expected a query from port 5353 not to be legacy")
+	}
+	if !isLegacy(q, conn.LocalAddr()) {
+		t.Fatal("Expected a legacy query")
+	}
+
+	if err := serv.handleQuery(q, conn.LocalAddr()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(buf[:n]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if resp.Id != q.Id {
+		t.Fatalf("Expected id %d got %d", q.Id, resp.Id)
+	}
+	if len(resp.Question) != 1 || resp.Question[0] != q.Question[0] {
+		t.Fatalf("Expected the question to be repeated, got %v", resp.Question)
+	}
+	if len(resp.Answer) == 0 {
+		t.Fatal("Expected answers")
+	}
+	for _, rr := range resp.Answer {
+		if h := rr.Header(); h.Ttl > legacyTTL || h.Class&(1<<15) != 0 {
+			t.Fatalf("bad: %v", rr)
+		}
+	}
+}
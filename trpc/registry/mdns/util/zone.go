@@ -130,6 +130,23 @@ func NewMDNSService(instance, service, domain, hostName string, port int, ips []
 	}, nil
 }
 
+// withInstance returns a copy of the service under another instance name
+func (m *MDNSService) withInstance(instance string) *MDNSService {
+	return &MDNSService{
+		Instance:     instance,
+		Service:      m.Service,
+		Domain:       m.Domain,
+		HostName:     m.HostName,
+		Port:         m.Port,
+		IPs:          m.IPs,
+		TXT:          m.TXT,
+		TTL:          atomic.LoadUint32(&m.TTL),
+		serviceAddr:  m.serviceAddr,
+		instanceAddr: fmt.Sprintf("%s.%s.%s.", instance, trimDot(m.Service), trimDot(m.Domain)),
+		enumAddr:     m.enumAddr,
+	}
+}
+
 // trimDot is used to trim the dots from the start or end of a string
 func trimDot(s string) string {
 	return strings.Trim(s, ".")
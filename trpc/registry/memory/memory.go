@@ -0,0 +1,439 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/google/uuid"
+)
+
+var (
+	// how often expired nodes are removed
+	sweepInterval = time.Second
+	// how long to wait for a slow watcher before dropping an event
+	sendEventTime = 10 * time.Millisecond
+)
+
+type node struct {
+	*registry.Node
+	TTL      time.Duration
+	LastSeen time.Time
+}
+
+type record struct {
+	Name      string
+	Version   string
+	Metadata  map[string]string
+	Nodes     map[string]*node
+	Endpoints []*registry.Endpoint
+}
+
+// services is a map of service name to the records of each version
+type services map[string]map[string]*record
+
+// Registry is a registry which keeps services in memory
+type Registry interface {
+	registry.Registry
+	// Stop removing the expired nodes
+	Stop()
+}
+
+type memRegistry struct {
+	opts registry.Options
+
+	// closed by Stop to end the ttl pruning
+	exit chan struct{}
+	once sync.Once
+
+	// the domain used when none is given
+	defaultDomain string
+
+	sync.RWMutex
+	// records keyed by domain
+	records  map[string]services
+	watchers map[string]*memWatcher
+}
+
+// NewRegistry returns a registry which keeps services in memory. It is
+// meant for tests and services running in a single process.
+func NewRegistry(opts ...registry.Option) Registry {
+	options := registry.Options{
+		Context: context.Background(),
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	defaultDomain := registry.DefaultDomain
+	if d, ok := options.Context.Value(domainKey{}).(string); ok && len(d) > 0 {
+		defaultDomain = d
+	}
+
+	records := make(map[string]services)
+	if recs := getServiceRecords(options.Context); recs != nil {
+		records[defaultDomain] = recs
+	}
+
+	m := &memRegistry{
+		opts:          options,
+		exit:          make(chan struct{}),
+		defaultDomain: defaultDomain,
+		records:       records,
+		watchers:      make(map[string]*memWatcher),
+	}
+
+	go m.ttlPrune()
+
+	return m
+}
+
+// ttlPrune removes the nodes which weren't registered again within their ttl
+func (m *memRegistry) ttlPrune() {
+	prune := time.NewTicker(sweepInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-m.exit:
+			return
+		case <-prune.C:
+		}
+
+		var events []func()
+
+		m.Lock()
+		for domain, svcs := range m.records {
+			for name, versions := range svcs {
+				for version, r := range versions {
+					var expired []*registry.Node
+					for id, n := range r.Nodes {
+						if n.TTL == 0 || time.Since(n.LastSeen) <= n.TTL {
+							continue
+						}
+						log.Debugf("Registry [memory] TTL expired for node %s of service %s", id, name)
+						delete(r.Nodes, id)
+						expired = append(expired, copyNode(n.Node))
+					}
+					if len(expired) == 0 {
+						continue
+					}
+
+					svc := recordToService(r)
+					svc.Nodes = expired
+					domain := domain
+					events = append(events, func() { m.sendEvent(domain, &registry.Result{Action: "delete", Service: svc}) })
+
+					if len(r.Nodes) == 0 {
+						delete(versions, version)
+					}
+				}
+				if len(versions) == 0 {
+					delete(svcs, name)
+				}
+			}
+			if len(svcs) == 0 {
+				delete(m.records, domain)
+			}
+		}
+		m.Unlock()
+
+		for _, fn := range events {
+			fn()
+		}
+	}
+}
+
+func (m *memRegistry) Stop() {
+	m.once.Do(func() {
+		close(m.exit)
+	})
+}
+
+// sendEvent passes r to every watcher of domain
+func (m *memRegistry) sendEvent(domain string, r *registry.Result) {
+	m.RLock()
+	watchers := make([]*memWatcher, 0, len(m.watchers))
+	for _, w := range m.watchers {
+		watchers = append(watchers, w)
+	}
+	m.RUnlock()
+
+	for _, w := range watchers {
+		if w.wo.Domain != registry.WildcardDomain && w.wo.Domain != domain {
+			continue
+		}
+
+		select {
+		case <-w.exit:
+			m.Lock()
+			delete(m.watchers, w.id)
+			m.Unlock()
+		default:
+			select {
+			case w.res <- r:
+			case <-time.After(sendEventTime):
+			}
+		}
+	}
+}
+
+func (m *memRegistry) Init(opts ...registry.Option) error {
+	for _, o := range opts {
+		o(&m.opts)
+	}
+
+	// add services
+	m.Lock()
+	defer m.Unlock()
+
+	if d, ok := m.opts.Context.Value(domainKey{}).(string); ok && len(d) > 0 {
+		m.defaultDomain = d
+	}
+
+	recs := getServiceRecords(m.opts.Context)
+	if len(recs) == 0 {
+		return nil
+	}
+
+	if _, ok := m.records[m.defaultDomain]; !ok {
+		m.records[m.defaultDomain] = make(services)
+	}
+	for name, versions := range recs {
+		if _, ok := m.records[m.defaultDomain][name]; !ok {
+			m.records[m.defaultDomain][name] = make(map[string]*record)
+		}
+		for version, r := range versions {
+			m.records[m.defaultDomain][name][version] = r
+		}
+	}
+
+	return nil
+}
+
+func (m *memRegistry) Options() registry.Options {
+	return m.opts
+}
+
+func (m *memRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if len(options.Domain) == 0 {
+		options.Domain = m.defaultDomain
+	}
+
+	m.Lock()
+
+	if _, ok := m.records[options.Domain]; !ok {
+		m.records[options.Domain] = make(services)
+	}
+	srvs := m.records[options.Domain]
+
+	r := serviceToRecord(s, options.TTL)
+
+	if _, ok := srvs[s.Name]; !ok {
+		srvs[s.Name] = make(map[string]*record)
+	}
+
+	if _, ok := srvs[s.Name][s.Version]; !ok {
+		srvs[s.Name][s.Version] = r
+		m.Unlock()
+
+		log.Debugf("Registry [memory] Registered new service: %s, version: %s", s.Name, s.Version)
+		m.sendEvent(options.Domain, &registry.Result{Action: "create", Service: recordToService(r)})
+		return nil
+	}
+
+	existing := srvs[s.Name][s.Version]
+
+	var changed bool
+	for _, n := range s.Nodes {
+		old, ok := existing.Nodes[n.Id]
+		if !ok || old.Address != n.Address || !equalMetadata(old.Metadata, n.Metadata) {
+			changed = true
+		}
+		existing.Nodes[n.Id] = r.Nodes[n.Id]
+	}
+
+	if !equalMetadata(existing.Metadata, r.Metadata) {
+		existing.Metadata = r.Metadata
+		changed = true
+	}
+	existing.Endpoints = r.Endpoints
+
+	if !changed {
+		m.Unlock()
+		return nil
+	}
+
+	svc := recordToService(r)
+	m.Unlock()
+
+	log.Debugf("Registry [memory] Updated registration for service: %s, version: %s", s.Name, s.Version)
+	m.sendEvent(options.Domain, &registry.Result{Action: "update", Service: svc})
+
+	return nil
+}
+
+func (m *memRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	var options registry.DeregisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if len(options.Domain) == 0 {
+		options.Domain = m.defaultDomain
+	}
+
+	m.Lock()
+
+	srvs, ok := m.records[options.Domain]
+	if !ok {
+		m.Unlock()
+		return nil
+	}
+
+	versions, ok := srvs[s.Name]
+	if !ok {
+		m.Unlock()
+		return nil
+	}
+
+	r, ok := versions[s.Version]
+	if !ok {
+		m.Unlock()
+		return nil
+	}
+
+	var removed []*registry.Node
+	for _, n := range s.Nodes {
+		if old, ok := r.Nodes[n.Id]; ok {
+			removed = append(removed, copyNode(old.Node))
+			delete(r.Nodes, n.Id)
+		}
+	}
+
+	// clean up empty records so lookups return not found
+	if len(r.Nodes) == 0 {
+		delete(versions, s.Version)
+	}
+	if len(versions) == 0 {
+		delete(srvs, s.Name)
+	}
+	if len(srvs) == 0 {
+		delete(m.records, options.Domain)
+	}
+
+	if len(removed) == 0 {
+		m.Unlock()
+		return nil
+	}
+
+	svc := recordToService(r)
+	svc.Nodes = removed
+	m.Unlock()
+
+	log.Debugf("Registry [memory] Deregistered service: %s, version: %s", s.Name, s.Version)
+	m.sendEvent(options.Domain, &registry.Result{Action: "delete", Service: svc})
+
+	return nil
+}
+
+func (m *memRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	var options registry.GetOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if len(options.Domain) == 0 {
+		options.Domain = m.defaultDomain
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	var services []*registry.Service
+	for domain, srvs := range m.records {
+		if options.Domain != registry.WildcardDomain && options.Domain != domain {
+			continue
+		}
+		for _, r := range srvs[name] {
+			services = append(services, recordToService(r))
+		}
+	}
+
+	if len(services) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	return services, nil
+}
+
+func (m *memRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	var options registry.ListOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	if len(options.Domain) == 0 {
+		options.Domain = m.defaultDomain
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	var services []*registry.Service
+	for domain, srvs := range m.records {
+		if options.Domain != registry.WildcardDomain && options.Domain != domain {
+			continue
+		}
+		for _, versions := range srvs {
+			for _, r := range versions {
+				services = append(services, recordToService(r))
+			}
+		}
+	}
+
+	return services, nil
+}
+
+func (m *memRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+	if len(wo.Domain) == 0 {
+		wo.Domain = m.defaultDomain
+	}
+
+	w := &memWatcher{
+		id:   uuid.New().String(),
+		wo:   wo,
+		res:  make(chan *registry.Result, 32),
+		exit: make(chan bool),
+	}
+
+	m.Lock()
+	m.watchers[w.id] = w
+	m.Unlock()
+
+	return w, nil
+}
+
+func (m *memRegistry) String() string {
+	return "memory"
+}
+
+func equalMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,424 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+var testData = map[string][]*registry.Service{
+	"foo": {
+		{
+			Name:    "foo",
+			Version: "1.0.0",
+			Nodes: []*registry.Node{
+				{
+					Id:      "foo-1.0.0-123",
+					Address: "localhost:9999",
+				},
+				{
+					Id:      "foo-1.0.0-321",
+					Address: "localhost:9999",
+				},
+			},
+		},
+		{
+			Name:    "foo",
+			Version: "1.0.1",
+			Nodes: []*registry.Node{
+				{
+					Id:      "foo-1.0.1-321",
+					Address: "localhost:6666",
+				},
+			},
+		},
+	},
+	"bar": {
+		{
+			Name:    "bar",
+			Version: "default",
+			Nodes: []*registry.Node{
+				{
+					Id:      "bar-1.0.0-123",
+					Address: "localhost:9999",
+				},
+			},
+		},
+	},
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	m := NewRegistry()
+	defer m.Stop()
+
+	fn := func(k string, v []*registry.Service) {
+		services, err := m.GetService(k)
+		if err != nil {
+			t.Errorf("Unexpected error getting service %s: %v", k, err)
+		}
+
+		if len(services) != len(v) {
+			t.Errorf("Expected %d services for %s, got %d", len(v), k, len(services))
+		}
+
+		for _, service := range v {
+			var seen bool
+			for _, s := range services {
+				if s.Version == service.Version {
+					seen = true
+					if len(s.Nodes) != len(service.Nodes) {
+						t.Errorf("Expected %d nodes for %s %s, got %d", len(service.Nodes), k, s.Version, len(s.Nodes))
+					}
+					break
+				}
+			}
+			if !seen {
+				t.Errorf("expected to find version %s", service.Version)
+			}
+		}
+	}
+
+	// register data
+	for _, v := range testData {
+		for _, service := range v {
+			if err := m.Register(service); err != nil {
+				t.Errorf("Unexpected register error: %v", err)
+			}
+		}
+	}
+
+	// using test data
+	for k, v := range testData {
+		fn(k, v)
+	}
+
+	services, err := m.ListServices()
+	if err != nil {
+		t.Errorf("Unexpected error when listing services: %v", err)
+	}
+
+	if len(services) != 3 {
+		t.Errorf("Expected 3 services, got %d", len(services))
+	}
+
+	// deregister
+	for _, v := range testData {
+		for _, service := range v {
+			if err := m.Deregister(service); err != nil {
+				t.Errorf("Unexpected deregister error: %v", err)
+			}
+		}
+	}
+
+	for k := range testData {
+		if _, err := m.GetService(k); err != registry.ErrNotFound {
+			t.Errorf("Expected not found for %s got %v", k, err)
+		}
+	}
+}
+
+func TestMemoryRegistryServices(t *testing.T) {
+	m := NewRegistry(Services(testData))
+
+	for k, v := range testData {
+		services, err := m.GetService(k)
+		if err != nil {
+			t.Fatalf("Unexpected error getting seeded service %s: %v", k, err)
+		}
+		if len(services) != len(v) {
+			t.Fatalf("Expected %d seeded versions for %s, got %d", len(v), k, len(services))
+		}
+	}
+}
+
+func TestMemoryRegistryCopies(t *testing.T) {
+	m := NewRegistry()
+	defer m.Stop()
+
+	n1 := &registry.Node{Id: "foo-1", Address: "10.0.0.1:8080", Metadata: map[string]string{"zone": "x"}}
+	n2 := &registry.Node{Id: "foo-2", Address: "10.0.0.2:8080", Metadata: map[string]string{"zone": "x"}}
+
+	// the first registration creates the service, the second updates it
+	for _, n := range []*registry.Node{n1, n2} {
+		if err := m.Register(&registry.Service{Name: "foo", Version: "1.0.0", Nodes: []*registry.Node{n}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// changing the nodes afterwards doesn't change the registry
+	for _, n := range []*registry.Node{n1, n2} {
+		n.Address = "10.0.0.9:8080"
+		n.Metadata["zone"] = "y"
+	}
+
+	services, err := m.GetService("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || len(services[0].Nodes) != 2 {
+		t.Fatalf("Expected a service with 2 nodes got %+v", services)
+	}
+	for _, n := range services[0].Nodes {
+		if n.Address == "10.0.0.9:8080" || n.Metadata["zone"] != "x" {
+			t.Fatalf("Expected the registered node %s got %+v", n.Id, n)
+		}
+	}
+}
+
+func TestMemoryRegistryTTL(t *testing.T) {
+	m := NewRegistry()
+	defer m.Stop()
+
+	w, err := m.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	for _, service := range testData["foo"] {
+		if err := m.Register(service, registry.RegisterTTL(time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(sweepInterval * 2)
+
+	if _, err := m.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected expired service to be not found, got %v", err)
+	}
+
+	// two creates followed by a delete of each version
+	actions := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions[res.Action]++
+	}
+	if actions["create"] != 2 || actions["delete"] != 2 {
+		t.Fatalf("Expected 2 create and 2 delete events, got %v", actions)
+	}
+}
+
+func TestMemoryRegistryTTLRefresh(t *testing.T) {
+	m := NewRegistry()
+	defer m.Stop()
+	ttl := sweepInterval * 2
+	service := testData["bar"][0]
+
+	// keep registering within the ttl
+	for i := 0; i < 4; i++ {
+		if err := m.Register(service, registry.RegisterTTL(ttl)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(ttl / 2)
+	}
+
+	if _, err := m.GetService(service.Name); err != nil {
+		t.Fatalf("Expected refreshed service to be found, got %v", err)
+	}
+}
+
+func TestMemoryRegistryDomains(t *testing.T) {
+	m := NewRegistry()
+	defer m.Stop()
+
+	w, err := m.Watch(registry.WatchDomain(registry.WildcardDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	domains := []string{"foo", "bar"}
+	for _, d := range domains {
+		svc := &registry.Service{
+			Name:    "test",
+			Version: d,
+			Nodes:   []*registry.Node{{Id: fmt.Sprintf("test-%s", d), Address: "localhost:9999"}},
+		}
+		if err := m.Register(svc, registry.RegisterDomain(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the default domain is empty
+	if _, err := m.GetService("test"); err != registry.ErrNotFound {
+		t.Fatalf("Expected not found in the default domain, got %v", err)
+	}
+
+	for _, d := range domains {
+		services, err := m.GetService("test", registry.GetDomain(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services) != 1 || services[0].Version != d {
+			t.Fatalf("Expected only the %s service in domain %s, got %v", d, d, services)
+		}
+	}
+
+	services, err := m.GetService("test", registry.GetDomain(registry.WildcardDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("Expected 2 services across domains, got %d", len(services))
+	}
+
+	list, err := m.ListServices(registry.ListDomain("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("Expected 1 service in domain foo, got %d", len(list))
+	}
+
+	// the wildcard watcher sees every domain
+	for range domains {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Action != "create" {
+			t.Fatalf("Expected create event, got %s", res.Action)
+		}
+	}
+}
+
+func TestMemoryWatcher(t *testing.T) {
+	m := NewRegistry()
+	defer m.Stop()
+
+	w, err := m.Watch(registry.WatchService("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range testData {
+		for _, service := range v {
+			if err := m.Register(service); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	res, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "create" || res.Service.Name != "bar" {
+		t.Fatalf("Expected create event for bar, got %s %s", res.Action, res.Service.Name)
+	}
+
+	// registering an unchanged node is not an update
+	if err := m.Register(testData["bar"][0]); err != nil {
+		t.Fatal(err)
+	}
+	node := *testData["bar"][0].Nodes[0]
+	node.Address = "localhost:8888"
+	updated := *testData["bar"][0]
+	updated.Nodes = []*registry.Node{&node}
+	if err := m.Register(&updated); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "update" || res.Service.Nodes[0].Address != "localhost:8888" {
+		t.Fatalf("Expected update event with the new address, got %s %v", res.Action, res.Service.Nodes[0])
+	}
+
+	w.Stop()
+	if _, err := w.Next(); err != registry.ErrWatcherStopped {
+		t.Fatalf("Expected watcher stopped error, got %v", err)
+	}
+}
+
+func TestMemorySubscribe(t *testing.T) {
+	m := NewRegistry(Services(testData))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := registry.Subscribe(ctx, m, registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(typ registry.EventType) registry.Event {
+		select {
+		case ev := <-ch:
+			if ev.Type != typ {
+				t.Fatalf("Expected %s event got %s", typ, ev.Type)
+			}
+			return ev
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s event", typ)
+		}
+		return registry.Event{}
+	}
+
+	// the snapshot holds both versions
+	versions := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		ev := next(registry.Create)
+		versions[ev.Service.Version] = true
+	}
+	if !versions["1.0.0"] || !versions["1.0.1"] {
+		t.Fatalf("Expected a snapshot of both versions, got %v", versions)
+	}
+
+	node := &registry.Node{Id: "foo-1.0.1-999", Address: "localhost:7777"}
+	if err := m.Register(&registry.Service{Name: "foo", Version: "1.0.1", Nodes: []*registry.Node{node}}); err != nil {
+		t.Fatal(err)
+	}
+	ev := next(registry.Update)
+	if ev.Diff == nil || len(ev.Diff.Added) != 1 || ev.Diff.Added[0].Id != node.Id {
+		t.Fatalf("Expected the added node in the diff, got %+v", ev.Diff)
+	}
+	if len(ev.Service.Nodes) != 2 {
+		t.Fatalf("Expected the updated service to hold 2 nodes, got %d", len(ev.Service.Nodes))
+	}
+
+	if err := m.Deregister(&registry.Service{Name: "foo", Version: "1.0.1", Nodes: []*registry.Node{node}}); err != nil {
+		t.Fatal(err)
+	}
+	ev = next(registry.Update)
+	if len(ev.Diff.Removed) != 1 || ev.Diff.Removed[0].Id != node.Id {
+		t.Fatalf("Expected the removed node in the diff, got %+v", ev.Diff)
+	}
+
+	if err := m.Deregister(testData["foo"][1]); err != nil {
+		t.Fatal(err)
+	}
+	ev = next(registry.Delete)
+	if ev.Service.Version != "1.0.1" {
+		t.Fatalf("Expected delete of 1.0.1, got %s", ev.Service.Version)
+	}
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestMemoryRegistryStop(t *testing.T) {
+	m := NewRegistry()
+	service := testData["bar"][0]
+	if err := m.Register(service, registry.RegisterTTL(sweepInterval/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ttl is no longer enforced once stopped
+	m.Stop()
+	m.Stop()
+	time.Sleep(sweepInterval * 2)
+
+	if _, err := m.GetService(service.Name); err != nil {
+		t.Fatalf("Expected service to be kept after stop, got %v", err)
+	}
+}
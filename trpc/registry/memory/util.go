@@ -0,0 +1,97 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+func serviceToRecord(s *registry.Service, ttl time.Duration) *record {
+	// keep a copy so the caller can't change a registered service
+	s = registry.CopyService(s)
+
+	metadata := make(map[string]string, len(s.Metadata))
+	for k, v := range s.Metadata {
+		metadata[k] = v
+	}
+
+	nodes := make(map[string]*node, len(s.Nodes))
+	for _, n := range s.Nodes {
+		nodes[n.Id] = &node{
+			Node:     n,
+			TTL:      ttl,
+			LastSeen: time.Now(),
+		}
+	}
+
+	endpoints := make([]*registry.Endpoint, len(s.Endpoints))
+	for i, e := range s.Endpoints {
+		endpoints[i] = e
+	}
+
+	return &record{
+		Name:      s.Name,
+		Version:   s.Version,
+		Metadata:  metadata,
+		Nodes:     nodes,
+		Endpoints: endpoints,
+	}
+}
+
+func recordToService(r *record) *registry.Service {
+	metadata := make(map[string]string, len(r.Metadata))
+	for k, v := range r.Metadata {
+		metadata[k] = v
+	}
+
+	endpoints := make([]*registry.Endpoint, len(r.Endpoints))
+	for i, e := range r.Endpoints {
+		var request, response *registry.Value
+		if e.Request != nil {
+			request = new(registry.Value)
+			*request = *e.Request
+		}
+		if e.Response != nil {
+			response = new(registry.Value)
+			*response = *e.Response
+		}
+
+		metadata := make(map[string]string, len(e.Metadata))
+		for k, v := range e.Metadata {
+			metadata[k] = v
+		}
+
+		endpoints[i] = &registry.Endpoint{
+			Name:     e.Name,
+			Request:  request,
+			Response: response,
+			Metadata: metadata,
+		}
+	}
+
+	nodes := make([]*registry.Node, 0, len(r.Nodes))
+	for _, n := range r.Nodes {
+		nodes = append(nodes, copyNode(n.Node))
+	}
+
+	return &registry.Service{
+		Name:      r.Name,
+		Version:   r.Version,
+		Metadata:  metadata,
+		Endpoints: endpoints,
+		Nodes:     nodes,
+	}
+}
+
+func copyNode(n *registry.Node) *registry.Node {
+	metadata := make(map[string]string, len(n.Metadata))
+	for k, v := range n.Metadata {
+		metadata[k] = v
+	}
+
+	return &registry.Node{
+		Id:       n.Id,
+		Address:  n.Address,
+		Metadata: metadata,
+	}
+}
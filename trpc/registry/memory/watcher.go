@@ -0,0 +1,41 @@
+package memory
+
+import (
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+type memWatcher struct {
+	id string
+	// wo.Domain is resolved, it is never empty
+	wo   registry.WatchOptions
+	res  chan *registry.Result
+	exit chan bool
+}
+
+func (m *memWatcher) Next() (*registry.Result, error) {
+	for {
+		select {
+		case r := <-m.res:
+			if r.Service == nil {
+				continue
+			}
+
+			if len(m.wo.Service) > 0 && m.wo.Service != r.Service.Name {
+				continue
+			}
+
+			return r, nil
+		case <-m.exit:
+			return nil, registry.ErrWatcherStopped
+		}
+	}
+}
+
+func (m *memWatcher) Stop() {
+	select {
+	case <-m.exit:
+		return
+	default:
+		close(m.exit)
+	}
+}
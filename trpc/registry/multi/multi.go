@@ -0,0 +1,223 @@
+package multi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	log "github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+type multiRegistry struct {
+	sync.RWMutex
+	opts registry.Options
+}
+
+// NewRegistry returns a registry federating the Registries option. Lookups
+// are merged across every registry by node id and keep working while
+// some of the registries fail.
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	m := &multiRegistry{
+		opts: registry.Options{
+			Context: context.Background(),
+		},
+	}
+	m.Init(opts...)
+	return m
+}
+
+func (m *multiRegistry) Init(opts ...registry.Option) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, o := range opts {
+		o(&m.opts)
+	}
+	return nil
+}
+
+func (m *multiRegistry) Options() registry.Options {
+	m.RLock()
+	defer m.RUnlock()
+	return m.opts
+}
+
+func (m *multiRegistry) registries() []registry.Registry {
+	rs, _ := m.Options().Context.Value(registriesKey{}).([]registry.Registry)
+	return rs
+}
+
+// writers returns the registries to write to, the per call subset ctx
+// holds under key takes precedence over the WriteTo option
+func (m *multiRegistry) writers(ctx context.Context, key interface{}) []registry.Registry {
+	if ctx != nil {
+		if rs, ok := ctx.Value(key).([]registry.Registry); ok && len(rs) > 0 {
+			return rs
+		}
+	}
+	if rs, ok := m.Options().Context.Value(writeToKey{}).([]registry.Registry); ok && len(rs) > 0 {
+		return rs
+	}
+	return m.registries()
+}
+
+// multiError joins the errors of several registries
+type multiError []error
+
+func (e multiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (m *multiRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	var errs multiError
+	for _, r := range m.writers(options.Context, registerToKey{}) {
+		if err := r.Register(s, opts...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (m *multiRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	var options registry.DeregisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	var errs multiError
+	for _, r := range m.writers(options.Context, deregisterFromKey{}) {
+		if err := r.Deregister(s, opts...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// each calls fn on every registry at once, returning the results of the
+// registries which succeeded in order. It only fails if every registry
+// failed.
+func (m *multiRegistry) each(fn func(registry.Registry) ([]*registry.Service, error)) ([][]*registry.Service, error) {
+	rs := m.registries()
+	if len(rs) == 0 {
+		return nil, errors.New("no registries")
+	}
+
+	results := make([][]*registry.Service, len(rs))
+	errs := make([]error, len(rs))
+
+	var wg sync.WaitGroup
+	for i, r := range rs {
+		wg.Add(1)
+		go func(i int, r registry.Registry) {
+			defer wg.Done()
+			results[i], errs[i] = fn(r)
+		}(i, r)
+	}
+	wg.Wait()
+
+	var ok [][]*registry.Service
+	var failed error
+	for i, err := range errs {
+		switch err {
+		case nil:
+			ok = append(ok, results[i])
+		case registry.ErrNotFound:
+			ok = append(ok, nil)
+		default:
+			log.Errorf("Registry [multi] %s error: %v", rs[i].String(), err)
+			failed = err
+		}
+	}
+
+	if len(ok) == 0 {
+		return nil, failed
+	}
+	return ok, nil
+}
+
+func (m *multiRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	results, err := m.each(func(r registry.Registry) ([]*registry.Service, error) {
+		return r.GetService(name, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	services := merge(results)
+	if len(services) == 0 {
+		return nil, registry.ErrNotFound
+	}
+	return services, nil
+}
+
+func (m *multiRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	results, err := m.each(func(r registry.Registry) ([]*registry.Service, error) {
+		return r.ListServices(opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return merge(results), nil
+}
+
+// merge combines services by name and version, a node id seen in several
+// registries is kept once, preferring the first registry
+func merge(results [][]*registry.Service) []*registry.Service {
+	var services []*registry.Service
+	index := make(map[string]*registry.Service)
+
+	for _, result := range results {
+		for _, s := range result {
+			key := s.Name + "/" + s.Version
+			svc, ok := index[key]
+			if !ok {
+				svc = registry.CopyService(s)
+				svc.Nodes = nil
+				index[key] = svc
+				services = append(services, svc)
+			}
+
+			for _, n := range s.Nodes {
+				var seen bool
+				for _, sn := range svc.Nodes {
+					if sn.Id == n.Id {
+						seen = true
+						break
+					}
+				}
+				if !seen {
+					node := *n
+					svc.Nodes = append(svc.Nodes, &node)
+				}
+			}
+		}
+	}
+
+	return services
+}
+
+func (m *multiRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newMultiWatcher(m.registries(), opts...)
+}
+
+func (m *multiRegistry) String() string {
+	return "multi"
+}
@@ -0,0 +1,215 @@
+package multi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/registry/memory"
+)
+
+var errDown = errors.New("registry down")
+
+// downRegistry fails every call
+type downRegistry struct {
+	memory.Registry
+}
+
+func (r *downRegistry) GetService(string, ...registry.GetOption) ([]*registry.Service, error) {
+	return nil, errDown
+}
+
+func (r *downRegistry) ListServices(...registry.ListOption) ([]*registry.Service, error) {
+	return nil, errDown
+}
+
+func (r *downRegistry) Watch(...registry.WatchOption) (registry.Watcher, error) {
+	return nil, errDown
+}
+
+func testService(id, addr string) *registry.Service {
+	return &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes:   []*registry.Node{{Id: id, Address: addr}},
+	}
+}
+
+func TestMultiGetService(t *testing.T) {
+	a, b, dr := memory.NewRegistry(), memory.NewRegistry(), &downRegistry{memory.NewRegistry()}
+	defer a.Stop()
+	defer b.Stop()
+	defer dr.Stop()
+	m := NewRegistry(Registries(a, b, dr))
+
+	if err := a.Register(testService("foo-1", "10.0.0.1:9000")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Register(testService("foo-2", "10.0.0.2:9000")); err != nil {
+		t.Fatal(err)
+	}
+	// the same node in both registries is merged by id
+	if err := b.Register(testService("foo-1", "10.0.0.1:9000")); err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := m.GetService("foo")
+	if err != nil {
+		t.Fatalf("Expected a failing registry to be tolerated, got %v", err)
+	}
+	if len(services) != 1 || len(services[0].Nodes) != 2 {
+		t.Fatalf("Expected 1 service with 2 nodes, got %v", services)
+	}
+
+	list, err := m.ListServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("Expected 1 listed service, got %d", len(list))
+	}
+
+	if _, err := m.GetService("bar"); err != registry.ErrNotFound {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+
+	down := NewRegistry(Registries(dr))
+	if _, err := down.GetService("foo"); err != errDown {
+		t.Fatalf("Expected error when every registry fails, got %v", err)
+	}
+}
+
+func TestMultiRegister(t *testing.T) {
+	a, b := memory.NewRegistry(), memory.NewRegistry()
+	defer a.Stop()
+	defer b.Stop()
+	m := NewRegistry(Registries(a, b))
+
+	if err := m.Register(testService("foo-1", "10.0.0.1:9000")); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []registry.Registry{a, b} {
+		if _, err := r.GetService("foo"); err != nil {
+			t.Fatalf("Expected registration in every registry, got %v", err)
+		}
+	}
+
+	if err := m.Register(testService("foo-2", "10.0.0.2:9000"), RegisterTo(b)); err != nil {
+		t.Fatal(err)
+	}
+	services, _ := a.GetService("foo")
+	if len(services[0].Nodes) != 1 {
+		t.Fatalf("Expected foo-2 only in the chosen registry, got %v", services[0].Nodes)
+	}
+
+	if err := m.Deregister(testService("foo-1", "10.0.0.1:9000"), DeregisterFrom(a)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected foo to be deregistered from a, got %v", err)
+	}
+
+	w := NewRegistry(Registries(a, b), WriteTo(a))
+	if err := w.Register(testService("foo-3", "10.0.0.3:9000")); err != nil {
+		t.Fatal(err)
+	}
+	services, _ = b.GetService("foo")
+	for _, n := range services[0].Nodes {
+		if n.Id == "foo-3" {
+			t.Fatal("Expected foo-3 not to be written to b")
+		}
+	}
+}
+
+func TestMultiWatcher(t *testing.T) {
+	a, b, dr := memory.NewRegistry(), memory.NewRegistry(), &downRegistry{memory.NewRegistry()}
+	defer a.Stop()
+	defer b.Stop()
+	defer dr.Stop()
+	m := NewRegistry(Registries(a, b, dr))
+
+	w, err := m.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	next := func(action string) {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Action != action {
+			t.Fatalf("Expected %s got %s", action, res.Action)
+		}
+	}
+
+	svc := testService("foo-1", "10.0.0.1:9000")
+	if err := a.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+	next("create")
+	if err := b.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+	next("create")
+
+	// b still holds the node so the delete from a is dropped
+	if err := a.Deregister(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Register(testService("foo-2", "10.0.0.2:9000")); err != nil {
+		t.Fatal(err)
+	}
+	next("create")
+	if err := b.Deregister(svc); err != nil {
+		t.Fatal(err)
+	}
+	next("delete")
+}
+
+func TestMultiWatcherRegisteredBefore(t *testing.T) {
+	a, b := memory.NewRegistry(), memory.NewRegistry()
+	defer a.Stop()
+	defer b.Stop()
+	m := NewRegistry(Registries(a, b))
+
+	// the node was migrated before the client started watching
+	svc := testService("foo-1", "10.0.0.1:9000")
+	if err := a.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := m.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	next := func(action, id string) {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Action != action || res.Service.Nodes[0].Id != id {
+			t.Fatalf("Expected %s of %s got %s of %s", action, id, res.Action, res.Service.Nodes[0].Id)
+		}
+	}
+
+	// b still serves the node so the delete from a is dropped
+	if err := a.Deregister(svc); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Register(testService("foo-2", "10.0.0.2:9000")); err != nil {
+		t.Fatal(err)
+	}
+	next("create", "foo-2")
+
+	if err := b.Deregister(svc); err != nil {
+		t.Fatal(err)
+	}
+	next("delete", "foo-1")
+}
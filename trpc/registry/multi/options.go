@@ -0,0 +1,55 @@
+// Package multi provides a registry federating several registries
+package multi
+
+import (
+	"context"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+type registriesKey struct{}
+type writeToKey struct{}
+type registerToKey struct{}
+type deregisterFromKey struct{}
+
+// Registries sets the registries which are federated
+func Registries(rs ...registry.Registry) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, registriesKey{}, rs)
+	}
+}
+
+// WriteTo limits registering and deregistering to a subset of the
+// registries, e.g. the new registry during a migration. Lookups still
+// use every registry.
+func WriteTo(rs ...registry.Registry) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, writeToKey{}, rs)
+	}
+}
+
+// RegisterTo registers a service to a subset of the registries only
+func RegisterTo(rs ...registry.Registry) registry.RegisterOption {
+	return func(o *registry.RegisterOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, registerToKey{}, rs)
+	}
+}
+
+// DeregisterFrom deregisters a service from a subset of the registries only
+func DeregisterFrom(rs ...registry.Registry) registry.DeregisterOption {
+	return func(o *registry.DeregisterOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, deregisterFromKey{}, rs)
+	}
+}
@@ -0,0 +1,295 @@
+package multi
+
+import (
+	"time"
+
+	log "github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/util/backoff"
+)
+
+// multiWatcher fans in the results of a watcher per registry. A node is
+// only deleted once every registry which had it deleted it.
+type multiWatcher struct {
+	opts []registry.WatchOption
+	wo   registry.WatchOptions
+
+	next chan *registry.Result
+	exit chan bool
+
+	// registries holding each node keyed by service name and node id,
+	// only used by the fan in loop
+	nodes map[string]map[int]bool
+	in    chan indexedResult
+}
+
+type indexedResult struct {
+	i   int
+	res *registry.Result
+	// if set the nodes registry i held when its watcher started, they
+	// replace the ones recorded for it
+	seed map[string]bool
+}
+
+func newMultiWatcher(rs []registry.Registry, opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	w := &multiWatcher{
+		opts:  opts,
+		wo:    wo,
+		next:  make(chan *registry.Result),
+		exit:  make(chan bool),
+		nodes: make(map[string]map[int]bool),
+		in:    make(chan indexedResult),
+	}
+
+	// fail only if no registry can be watched, the others are retried
+	var started int
+	var lastErr error
+	watchers := make([]registry.Watcher, len(rs))
+	for i, r := range rs {
+		rw, err := r.Watch(opts...)
+		if err != nil {
+			log.Errorf("Registry [multi] watch %s error: %v", r.String(), err)
+			lastErr = err
+			continue
+		}
+		watchers[i] = rw
+		started++
+	}
+	if started == 0 && len(rs) > 0 {
+		return nil, lastErr
+	}
+
+	// record the nodes registered before the watch so a delete from one
+	// registry isn't passed on while another one still holds the node
+	for i, r := range rs {
+		if watchers[i] == nil {
+			continue
+		}
+		nodes, err := w.holding(r)
+		if err != nil {
+			log.Errorf("Registry [multi] listing %s error: %v", r.String(), err)
+		}
+		w.reset(i, nodes)
+	}
+
+	for i, r := range rs {
+		go w.watch(i, r, watchers[i])
+	}
+	go w.run()
+
+	return w, nil
+}
+
+// watch forwards the results of r, recreating its watcher with backoff.
+// The nodes r holds are recorded again every time its watcher restarts as
+// the watchers of some registries only send the changes.
+func (w *multiWatcher) watch(i int, r registry.Registry, rw registry.Watcher) {
+	var attempts int
+	for {
+		if rw != nil {
+			if w.forward(i, rw) {
+				attempts = 0
+			}
+		}
+
+		attempts++
+		select {
+		case <-w.exit:
+			return
+		case <-time.After(backoff.Do(attempts)):
+		}
+
+		var err error
+		if rw, err = r.Watch(w.opts...); err != nil {
+			log.Errorf("Registry [multi] watch %s error: %v", r.String(), err)
+			rw = nil
+			continue
+		}
+		w.seed(i, r)
+	}
+}
+
+// seed records the nodes r holds in place of the ones recorded for it
+func (w *multiWatcher) seed(i int, r registry.Registry) {
+	nodes, err := w.holding(r)
+	if err != nil {
+		log.Errorf("Registry [multi] listing %s error: %v", r.String(), err)
+	}
+
+	select {
+	case w.in <- indexedResult{i: i, seed: nodes}:
+	case <-w.exit:
+	}
+}
+
+// holding returns the keys of the watched nodes r holds
+func (w *multiWatcher) holding(r registry.Registry) (map[string]bool, error) {
+	var getOpts []registry.GetOption
+	var listOpts []registry.ListOption
+	if len(w.wo.Domain) > 0 {
+		getOpts = append(getOpts, registry.GetDomain(w.wo.Domain))
+		listOpts = append(listOpts, registry.ListDomain(w.wo.Domain))
+	}
+
+	names := []string{w.wo.Service}
+	if len(w.wo.Service) == 0 {
+		services, err := r.ListServices(listOpts...)
+		if err != nil {
+			return map[string]bool{}, err
+		}
+		names = names[:0]
+		for _, s := range services {
+			names = append(names, s.Name)
+		}
+	}
+
+	nodes := make(map[string]bool)
+	for _, name := range names {
+		services, err := r.GetService(name, getOpts...)
+		if err == registry.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nodes, err
+		}
+		for _, s := range services {
+			for _, n := range s.Nodes {
+				nodes[s.Name+"/"+n.Id] = true
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// forward passes the results of rw on until it fails, it reports whether
+// any result was received
+func (w *multiWatcher) forward(i int, rw registry.Watcher) bool {
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		select {
+		case <-w.exit:
+		case <-done:
+		}
+		rw.Stop()
+	}()
+
+	var received bool
+	for {
+		res, err := rw.Next()
+		if err != nil {
+			select {
+			case <-w.exit:
+			default:
+				log.Errorf("Registry [multi] watcher stopped: %v", err)
+			}
+			return received
+		}
+		received = true
+
+		select {
+		case w.in <- indexedResult{i: i, res: res}:
+		case <-w.exit:
+			return received
+		}
+	}
+}
+
+func (w *multiWatcher) run() {
+	for {
+		select {
+		case <-w.exit:
+			return
+		case r := <-w.in:
+			if r.seed != nil {
+				w.reset(r.i, r.seed)
+				continue
+			}
+			res := w.filter(r.i, r.res)
+			if res == nil {
+				continue
+			}
+			select {
+			case w.next <- res:
+			case <-w.exit:
+				return
+			}
+		}
+	}
+}
+
+// reset replaces the nodes recorded for registry i
+func (w *multiWatcher) reset(i int, nodes map[string]bool) {
+	for key, holders := range w.nodes {
+		delete(holders, i)
+		if len(holders) == 0 {
+			delete(w.nodes, key)
+		}
+	}
+	for key := range nodes {
+		if _, ok := w.nodes[key]; !ok {
+			w.nodes[key] = make(map[int]bool)
+		}
+		w.nodes[key][i] = true
+	}
+}
+
+// filter tracks which registries hold each node, dropping the nodes of a
+// delete which other registries still hold
+func (w *multiWatcher) filter(i int, res *registry.Result) *registry.Result {
+	if res == nil || res.Service == nil {
+		return nil
+	}
+
+	var nodes []*registry.Node
+	for _, n := range res.Service.Nodes {
+		key := res.Service.Name + "/" + n.Id
+
+		switch res.Action {
+		case "delete":
+			holders := w.nodes[key]
+			delete(holders, i)
+			if len(holders) > 0 {
+				continue
+			}
+			delete(w.nodes, key)
+		default:
+			if _, ok := w.nodes[key]; !ok {
+				w.nodes[key] = make(map[int]bool)
+			}
+			w.nodes[key][i] = true
+		}
+		nodes = append(nodes, n)
+	}
+
+	if len(nodes) == 0 && len(res.Service.Nodes) > 0 {
+		return nil
+	}
+
+	svc := *res.Service
+	svc.Nodes = nodes
+	return &registry.Result{Action: res.Action, Service: &svc}
+}
+
+func (w *multiWatcher) Next() (*registry.Result, error) {
+	select {
+	case r := <-w.next:
+		return r, nil
+	case <-w.exit:
+		return nil, registry.ErrWatcherStopped
+	}
+}
+
+func (w *multiWatcher) Stop() {
+	select {
+	case <-w.exit:
+	default:
+		close(w.exit)
+	}
+}
@@ -1,9 +1,7 @@
 // Package registry is an interface for service discovery
 package registry
 
-import (
-	"errors"
-)
+import "errors"
 
 const (
 	// WildcardDomain indicates any domain
@@ -0,0 +1,20 @@
+// Package static provides a registry loaded from a file
+package static
+
+import (
+	"context"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+type fileKey struct{}
+
+// File sets the yaml or json file listing the nodes of each service
+func File(path string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, fileKey{}, path)
+	}
+}
@@ -0,0 +1,234 @@
+package static
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/registry/memory"
+	"gopkg.in/yaml.v2"
+)
+
+// Node is a node of a service as listed in the file, e.g.
+//
+//	helloworld:
+//	  - id: helloworld-1
+//	    address: 10.0.0.1:9000
+//	    version: 1.0.0
+//	    metadata:
+//	      zone: a
+type Node struct {
+	Id       string            `json:"id" yaml:"id"`
+	Address  string            `json:"address" yaml:"address"`
+	Version  string            `json:"version" yaml:"version"`
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
+}
+
+// staticRegistry serves the services listed in a file. Services can also
+// be registered at runtime, those are kept across reloads of the file.
+type staticRegistry struct {
+	registry.Registry
+
+	sync.Mutex
+	file    string
+	loaded  []*registry.Service
+	watcher *fsnotify.Watcher
+}
+
+// NewRegistry returns a registry loaded from the File option. The file is
+// reloaded when it changes and watchers are told about the difference.
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	s := &staticRegistry{
+		Registry: memory.NewRegistry(),
+	}
+	if err := s.Init(opts...); err != nil {
+		log.Errorf("Registry [static] init error: %v", err)
+	}
+	return s
+}
+
+func (s *staticRegistry) Init(opts ...registry.Option) error {
+	if err := s.Registry.Init(opts...); err != nil {
+		return err
+	}
+
+	ctx := s.Options().Context
+	if ctx == nil {
+		return nil
+	}
+	file, ok := ctx.Value(fileKey{}).(string)
+	if !ok || len(file) == 0 {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if file == s.file {
+		return nil
+	}
+	if s.watcher != nil {
+		s.watcher.Close()
+		s.watcher = nil
+	}
+	s.file = file
+
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	return s.watch()
+}
+
+// watch reloads the file when it changes. The directory is watched rather
+// than the file so editors replacing the file are picked up.
+func (s *staticRegistry) watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(s.file)); err != nil {
+		w.Close()
+		return err
+	}
+	s.watcher = w
+
+	file := filepath.Clean(s.file)
+	go func() {
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) != file || e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				// skip the file while it is truncated and being written
+				if fi, err := os.Stat(file); err != nil || fi.Size() == 0 {
+					continue
+				}
+				s.Lock()
+				if s.watcher == w {
+					if err := s.load(); err != nil {
+						log.Errorf("Registry [static] reload %s error: %v", file, err)
+					}
+				}
+				s.Unlock()
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("Registry [static] watch %s error: %v", file, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// load reads the file and registers the difference with the last load
+func (s *staticRegistry) load() error {
+	services, err := read(s.file)
+	if err != nil {
+		return err
+	}
+
+	// deregister the nodes which are gone first
+	for _, old := range s.loaded {
+		gone := registry.CopyService(old)
+		gone.Nodes = nil
+		for _, n := range old.Nodes {
+			if !hasNode(services, old, n) {
+				gone.Nodes = append(gone.Nodes, n)
+			}
+		}
+		if len(gone.Nodes) == 0 {
+			continue
+		}
+		if err := s.Registry.Deregister(gone); err != nil {
+			return err
+		}
+	}
+
+	// registering an unchanged node is a noop
+	for _, svc := range services {
+		if err := s.Registry.Register(svc); err != nil {
+			return err
+		}
+	}
+
+	s.loaded = services
+	return nil
+}
+
+func hasNode(services []*registry.Service, svc *registry.Service, node *registry.Node) bool {
+	for _, s := range services {
+		if s.Name != svc.Name || s.Version != svc.Version {
+			continue
+		}
+		for _, n := range s.Nodes {
+			if n.Id == node.Id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// read parses the file into services, grouping nodes by version
+func read(file string) ([]*registry.Service, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes map[string][]*Node
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		err = json.Unmarshal(b, &nodes)
+	} else {
+		err = yaml.Unmarshal(b, &nodes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*registry.Service
+	for name, list := range nodes {
+		versions := make(map[string]*registry.Service)
+		for _, n := range list {
+			if len(n.Address) == 0 {
+				return nil, errors.New("static: missing address for a node of " + name)
+			}
+			id := n.Id
+			if len(id) == 0 {
+				id = name + "-" + n.Address
+			}
+
+			svc, ok := versions[n.Version]
+			if !ok {
+				svc = &registry.Service{Name: name, Version: n.Version}
+				versions[n.Version] = svc
+				services = append(services, svc)
+			}
+			svc.Nodes = append(svc.Nodes, &registry.Node{
+				Id:       id,
+				Address:  n.Address,
+				Metadata: n.Metadata,
+			})
+		}
+	}
+
+	return services, nil
+}
+
+func (s *staticRegistry) String() string {
+	return "static"
+}
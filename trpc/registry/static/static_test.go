@@ -0,0 +1,131 @@
+package static
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+)
+
+const testFile = `
+foo:
+  - id: foo-1
+    address: 10.0.0.1:9000
+    version: 1.0.0
+    metadata:
+      zone: a
+  - address: 10.0.0.2:9000
+    version: 1.0.0
+  - id: foo-3
+    address: 10.0.0.3:9000
+    version: 2.0.0
+bar:
+  - id: bar-1
+    address: 10.0.0.4:9000
+`
+
+func writeFile(t *testing.T, file, data string) {
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStaticRegistry(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "services.yaml")
+	writeFile(t, file, testFile)
+
+	r := NewRegistry(File(file))
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("Expected 2 versions of foo, got %d", len(services))
+	}
+	for _, s := range services {
+		switch s.Version {
+		case "1.0.0":
+			if len(s.Nodes) != 2 {
+				t.Fatalf("Expected 2 nodes of foo 1.0.0, got %d", len(s.Nodes))
+			}
+		case "2.0.0":
+			if len(s.Nodes) != 1 {
+				t.Fatalf("Expected 1 node of foo 2.0.0, got %d", len(s.Nodes))
+			}
+		default:
+			t.Fatalf("Unexpected version %s", s.Version)
+		}
+	}
+
+	list, err := r.ListServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("Expected 3 services, got %d", len(list))
+	}
+}
+
+func TestStaticRegistryJSON(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "services.json")
+	writeFile(t, file, `{"foo": [{"id": "foo-1", "address": "10.0.0.1:9000"}]}`)
+
+	r := NewRegistry(File(file))
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Nodes[0].Address != "10.0.0.1:9000" {
+		t.Fatalf("Unexpected services %v", services)
+	}
+}
+
+func TestStaticRegistryReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "services.yaml")
+	writeFile(t, file, testFile)
+
+	r := NewRegistry(File(file))
+
+	w, err := r.Watch(registry.WatchService("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	writeFile(t, file, `
+foo:
+  - id: foo-1
+    address: 10.0.0.1:9000
+    version: 1.0.0
+    metadata:
+      zone: a
+`)
+
+	res, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "delete" || res.Service.Nodes[0].Id != "bar-1" {
+		t.Fatalf("Expected delete of bar-1, got %s %v", res.Action, res.Service.Nodes[0])
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		services, err := r.GetService("foo")
+		if err == nil && len(services) == 1 && len(services[0].Nodes) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected reloaded foo with 1 node, got %v %v", services, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := r.GetService("bar"); err != registry.ErrNotFound {
+		t.Fatalf("Expected bar to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	log "github.com/fztcjjl/tiger/trpc/logger"
+	"github.com/fztcjjl/tiger/trpc/util/backoff"
+)
+
+// Subscribe returns the services of r as typed events, built on top of
+// its Watch and GetService. It sends a snapshot of the watched services
+// as Create events first and turns the watcher results into typed events.
+// When the watcher fails it is recreated with backoff and the services
+// are looked up again, sending the difference so no change is lost. The
+// channel is closed once ctx is done.
+func Subscribe(ctx context.Context, r Registry, opts ...WatchOption) (<-chan Event, error) {
+	var wo WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	// watch before taking the snapshot so no change falls in between
+	w, err := r.Watch(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &subscriber{
+		ctx:      ctx,
+		r:        r,
+		wo:       wo,
+		opts:     opts,
+		ch:       make(chan Event),
+		services: make(map[string]*Service),
+	}
+
+	go s.run(w)
+
+	return s.ch, nil
+}
+
+type subscriber struct {
+	ctx  context.Context
+	r    Registry
+	wo   WatchOptions
+	opts []WatchOption
+	ch   chan Event
+
+	// services known to the subscriber keyed by name and version
+	services map[string]*Service
+}
+
+func serviceKey(s *Service) string {
+	return s.Name + "/" + s.Version
+}
+
+func (s *subscriber) run(w Watcher) {
+	defer close(s.ch)
+
+	var attempts int
+	for {
+		if w != nil {
+			// the snapshot is sent as the difference with the known
+			// services, the first one being all creates
+			if s.resync() && s.next(w) {
+				attempts = 0
+			}
+			w.Stop()
+		}
+
+		attempts++
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(backoff.Do(attempts)):
+		}
+
+		var err error
+		if w, err = s.r.Watch(s.opts...); err != nil {
+			log.Errorf("Registry [%s] subscribe error: %v", s.r.String(), err)
+			w = nil
+		}
+	}
+}
+
+// snapshot looks up the watched services
+func (s *subscriber) snapshot() ([]*Service, error) {
+	if len(s.wo.Service) > 0 {
+		services, err := s.r.GetService(s.wo.Service, GetDomain(s.wo.Domain))
+		if err == ErrNotFound {
+			return nil, nil
+		}
+		return services, err
+	}
+
+	list, err := s.r.ListServices(ListDomain(s.wo.Domain))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var services []*Service
+	for _, l := range list {
+		if seen[l.Name] {
+			continue
+		}
+		seen[l.Name] = true
+
+		svcs, err := s.r.GetService(l.Name, GetDomain(s.wo.Domain))
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, svcs...)
+	}
+	return services, nil
+}
+
+// resync sends the difference between the known services and a fresh
+// snapshot. It returns false if the snapshot failed or ctx is done.
+func (s *subscriber) resync() bool {
+	services, err := s.snapshot()
+	if err != nil {
+		log.Errorf("Registry [%s] subscribe snapshot error: %v", s.r.String(), err)
+		return false
+	}
+
+	current := make(map[string]*Service, len(services))
+	for _, svc := range services {
+		key := serviceKey(svc)
+		if c, ok := current[key]; ok {
+			// the same version from several domains
+			c.Nodes = addNodes(c.Nodes, svc.Nodes)
+			continue
+		}
+		current[key] = CopyService(svc)
+	}
+
+	for key, svc := range current {
+		old, ok := s.services[key]
+		if !ok {
+			if !s.send(Create, svc, nil) {
+				return false
+			}
+			continue
+		}
+
+		diff := &NodeDiff{}
+		for _, n := range svc.Nodes {
+			diffNode(diff, findNode(old.Nodes, n.Id), n)
+		}
+		for _, n := range old.Nodes {
+			if findNode(svc.Nodes, n.Id) == nil {
+				diff.Removed = append(diff.Removed, n)
+			}
+		}
+		if !diff.empty() && !s.send(Update, svc, diff) {
+			return false
+		}
+	}
+
+	for key, svc := range s.services {
+		if _, ok := current[key]; !ok && !s.send(Delete, svc, nil) {
+			return false
+		}
+	}
+
+	s.services = current
+	return true
+}
+
+// next turns watcher results into events until the watcher fails or ctx
+// is done. It reports whether any result was received.
+func (s *subscriber) next(w Watcher) bool {
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			w.Stop()
+		case <-done:
+		}
+	}()
+
+	var received bool
+	for {
+		res, err := w.Next()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Errorf("Registry [%s] subscribe watcher stopped: %v", s.r.String(), err)
+			}
+			return received
+		}
+		received = true
+
+		if !s.apply(res) {
+			return received
+		}
+	}
+}
+
+// apply sends the event for a watcher result, it returns false if ctx
+// is done
+func (s *subscriber) apply(res *Result) bool {
+	if res == nil || res.Service == nil {
+		return true
+	}
+	if len(s.wo.Service) > 0 && res.Service.Name != s.wo.Service {
+		return true
+	}
+
+	key := serviceKey(res.Service)
+	old, ok := s.services[key]
+
+	switch res.Action {
+	case "create", "update":
+		if !ok {
+			svc := CopyService(res.Service)
+			s.services[key] = svc
+			return s.send(Create, svc, nil)
+		}
+
+		diff := &NodeDiff{}
+		for _, n := range res.Service.Nodes {
+			diffNode(diff, findNode(old.Nodes, n.Id), n)
+		}
+
+		svc := CopyService(res.Service)
+		svc.Nodes = addNodes(old.Nodes, res.Service.Nodes)
+		s.services[key] = svc
+
+		if diff.empty() && equalMetadata(old.Metadata, svc.Metadata) {
+			return true
+		}
+		return s.send(Update, svc, diff)
+	case "delete":
+		if !ok {
+			return true
+		}
+
+		diff := &NodeDiff{}
+		for _, n := range res.Service.Nodes {
+			if on := findNode(old.Nodes, n.Id); on != nil {
+				diff.Removed = append(diff.Removed, on)
+			}
+		}
+		if diff.empty() {
+			return true
+		}
+
+		nodes := delNodes(old.Nodes, diff.Removed)
+		if len(nodes) == 0 {
+			delete(s.services, key)
+			return s.send(Delete, old, nil)
+		}
+
+		svc := CopyService(old)
+		svc.Nodes = nodes
+		s.services[key] = svc
+		return s.send(Update, svc, diff)
+	}
+
+	return true
+}
+
+func (s *subscriber) send(t EventType, svc *Service, diff *NodeDiff) bool {
+	ev := Event{
+		Id:        svc.Name,
+		Type:      t,
+		Timestamp: time.Now(),
+		Service:   CopyService(svc),
+		Diff:      diff,
+	}
+
+	select {
+	case s.ch <- ev:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// diffNode adds node to the diff if it is new or changed from old
+func diffNode(diff *NodeDiff, old, node *Node) {
+	switch {
+	case old == nil:
+		diff.Added = append(diff.Added, node)
+	case old.Address != node.Address || !equalMetadata(old.Metadata, node.Metadata):
+		diff.Updated = append(diff.Updated, node)
+	}
+}
+
+func findNode(nodes []*Node, id string) *Node {
+	for _, n := range nodes {
+		if n.Id == id {
+			return n
+		}
+	}
+	return nil
+}
+
+func (d *NodeDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Updated) == 0 && len(d.Removed) == 0
+}
+
+// equalMetadata compares metadata treating nil and empty as equal
+func equalMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
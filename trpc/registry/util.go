@@ -0,0 +1,149 @@
+package registry
+
+func addNodes(old, neu []*Node) []*Node {
+	nodes := make([]*Node, len(neu))
+	// add all new nodes
+	for i, n := range neu {
+		nodes[i] = copyNode(n)
+	}
+
+	// look at old nodes
+	for _, o := range old {
+		var exists bool
+
+		// check against new nodes
+		for _, n := range nodes {
+			// ids match then skip
+			if o.Id == n.Id {
+				exists = true
+				break
+			}
+		}
+
+		// keep old node
+		if !exists {
+			nodes = append(nodes, copyNode(o))
+		}
+	}
+
+	return nodes
+}
+
+func delNodes(old, del []*Node) []*Node {
+	var nodes []*Node
+	for _, o := range old {
+		var rem bool
+		for _, n := range del {
+			if o.Id == n.Id {
+				rem = true
+				break
+			}
+		}
+		if !rem {
+			nodes = append(nodes, o)
+		}
+	}
+	return nodes
+}
+
+func copyNode(node *Node) *Node {
+	n := new(Node)
+	*n = *node
+	n.Metadata = copyMetadata(node.Metadata)
+	return n
+}
+
+func copyMetadata(md map[string]string) map[string]string {
+	if md == nil {
+		return nil
+	}
+	cp := make(map[string]string, len(md))
+	for k, v := range md {
+		cp[k] = v
+	}
+	return cp
+}
+
+// CopyService make a copy of service
+func CopyService(service *Service) *Service {
+	// copy service
+	s := new(Service)
+	*s = *service
+	s.Metadata = copyMetadata(service.Metadata)
+
+	// copy nodes
+	nodes := make([]*Node, len(service.Nodes))
+	for j, node := range service.Nodes {
+		nodes[j] = copyNode(node)
+	}
+	s.Nodes = nodes
+
+	// copy endpoints
+	eps := make([]*Endpoint, len(service.Endpoints))
+	for j, ep := range service.Endpoints {
+		e := new(Endpoint)
+		*e = *ep
+		e.Metadata = copyMetadata(ep.Metadata)
+		eps[j] = e
+	}
+	s.Endpoints = eps
+	return s
+}
+
+// Copy makes a copy of services
+func Copy(current []*Service) []*Service {
+	services := make([]*Service, len(current))
+	for i, service := range current {
+		services[i] = CopyService(service)
+	}
+	return services
+}
+
+// Merge merges two lists of services and returns a new copy, nodes of
+// the same version in nlist replace those with the same id in olist
+func Merge(olist []*Service, nlist []*Service) []*Service {
+	srv := Copy(olist)
+
+	for _, n := range nlist {
+		var seen bool
+		for _, sp := range srv {
+			if sp.Version == n.Version {
+				sp.Nodes = addNodes(sp.Nodes, n.Nodes)
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			srv = append(srv, CopyService(n))
+		}
+	}
+	return srv
+}
+
+// Remove removes services and returns a new copy
+func Remove(old, del []*Service) []*Service {
+	var services []*Service
+
+	for _, o := range old {
+		srv := new(Service)
+		*srv = *o
+
+		var rem bool
+
+		for _, s := range del {
+			if srv.Version == s.Version {
+				srv.Nodes = delNodes(srv.Nodes, s.Nodes)
+
+				if len(srv.Nodes) == 0 {
+					rem = true
+				}
+			}
+		}
+
+		if !rem {
+			services = append(services, srv)
+		}
+	}
+
+	return services
+}
@@ -0,0 +1,48 @@
+package registry
+
+import "testing"
+
+func TestCopyService(t *testing.T) {
+	svc := &Service{
+		Name:     "foo",
+		Metadata: map[string]string{"a": "1"},
+		Nodes: []*Node{
+			{Id: "foo-1", Address: "10.0.0.1:9000", Metadata: map[string]string{"b": "2"}},
+		},
+		Endpoints: []*Endpoint{
+			{Name: "Foo.Bar", Metadata: map[string]string{"stream": "false"}},
+		},
+	}
+
+	cp := CopyService(svc)
+	cp.Metadata["a"] = "x"
+	cp.Nodes[0].Metadata["b"] = "x"
+	cp.Endpoints[0].Metadata["stream"] = "x"
+
+	if svc.Metadata["a"] != "1" || svc.Nodes[0].Metadata["b"] != "2" || svc.Endpoints[0].Metadata["stream"] != "false" {
+		t.Fatalf("Expected the copy not to share metadata, got %v %v %v", svc.Metadata, svc.Nodes[0].Metadata, svc.Endpoints[0].Metadata)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	old := []*Service{{
+		Name:  "foo",
+		Nodes: []*Node{{Id: "foo-1", Metadata: map[string]string{"b": "2"}}},
+	}}
+	neu := []*Service{{
+		Name:  "foo",
+		Nodes: []*Node{{Id: "foo-2", Metadata: map[string]string{"b": "3"}}},
+	}}
+
+	merged := Merge(old, neu)
+	if len(merged) != 1 || len(merged[0].Nodes) != 2 {
+		t.Fatalf("Expected a single service with 2 nodes, got %+v", merged)
+	}
+
+	for _, n := range merged[0].Nodes {
+		n.Metadata["b"] = "x"
+	}
+	if old[0].Nodes[0].Metadata["b"] != "2" || neu[0].Nodes[0].Metadata["b"] != "3" {
+		t.Fatal("Expected the merged nodes not to share metadata")
+	}
+}
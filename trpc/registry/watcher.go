@@ -53,4 +53,17 @@ type Event struct {
 	Timestamp time.Time
 	// Service is registry service
 	Service *Service
+	// Diff holds the nodes which changed on an Update
+	Diff *NodeDiff
+}
+
+// NodeDiff is the difference between the nodes of a service before and
+// after an update
+type NodeDiff struct {
+	// Added nodes which weren't known before
+	Added []*Node
+	// Updated nodes whose address or metadata changed
+	Updated []*Node
+	// Removed nodes which are gone
+	Removed []*Node
 }
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// endpoints describes every method served by the grpc server. Request and
+// response values are resolved from the registered protobuf descriptors,
+// methods of services without a descriptor are listed without them.
+func (s *Server) endpoints() []*registry.Endpoint {
+	var endpoints []*registry.Endpoint
+
+	for name, info := range s.server.GetServiceInfo() {
+		var sd protoreflect.ServiceDescriptor
+		if d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name)); err == nil {
+			sd, _ = d.(protoreflect.ServiceDescriptor)
+		}
+
+		for _, method := range info.Methods {
+			ep := &registry.Endpoint{
+				Name: name + "." + method.Name,
+				Metadata: map[string]string{
+					"stream":        strconv.FormatBool(method.IsClientStream || method.IsServerStream),
+					"client_stream": strconv.FormatBool(method.IsClientStream),
+					"server_stream": strconv.FormatBool(method.IsServerStream),
+				},
+			}
+
+			if sd != nil {
+				if md := sd.Methods().ByName(protoreflect.Name(method.Name)); md != nil {
+					ep.Request = messageValue(string(md.Input().Name()), md.Input(), nil)
+					ep.Response = messageValue(string(md.Output().Name()), md.Output(), nil)
+				}
+			}
+
+			endpoints = append(endpoints, ep)
+		}
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Name < endpoints[j].Name })
+
+	return endpoints
+}
+
+// messageValue builds the value tree of a message. seen holds the
+// messages being expanded so recursive types stop at the first repeat.
+func messageValue(name string, md protoreflect.MessageDescriptor, seen map[protoreflect.FullName]bool) *registry.Value {
+	v := &registry.Value{
+		Name: name,
+		Type: string(md.FullName()),
+	}
+
+	if seen[md.FullName()] {
+		return v
+	}
+
+	next := make(map[protoreflect.FullName]bool, len(seen)+1)
+	for k := range seen {
+		next[k] = true
+	}
+	next[md.FullName()] = true
+
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		v.Values = append(v.Values, fieldValue(fields.Get(i), next))
+	}
+
+	return v
+}
+
+func fieldValue(fd protoreflect.FieldDescriptor, seen map[protoreflect.FullName]bool) *registry.Value {
+	name := string(fd.Name())
+
+	if fd.IsMap() {
+		val := fd.MapValue()
+		v := &registry.Value{
+			Name: name,
+			Type: fmt.Sprintf("map<%s,%s>", kindName(fd.MapKey()), kindName(val)),
+		}
+		if md := val.Message(); md != nil {
+			v.Values = []*registry.Value{messageValue("value", md, seen)}
+		}
+		return v
+	}
+
+	var v *registry.Value
+	if md := fd.Message(); md != nil {
+		v = messageValue(name, md, seen)
+	} else {
+		v = &registry.Value{Name: name, Type: kindName(fd)}
+	}
+
+	if fd.IsList() {
+		v.Type = "[]" + v.Type
+	}
+
+	return v
+}
+
+func kindName(fd protoreflect.FieldDescriptor) string {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return string(fd.Message().FullName())
+	case protoreflect.EnumKind:
+		return string(fd.Enum().FullName())
+	default:
+		return fd.Kind().String()
+	}
+}
@@ -20,6 +20,7 @@ var (
 	DefaultId               = uuid.New().String()
 	DefaultRegisterInterval = time.Second * 30
 	DefaultRegisterTTL      = time.Second * 90
+	DefaultShutdownTimeout  = time.Second * 10
 )
 
 type Options struct {
@@ -30,9 +31,19 @@ type Options struct {
 	Id               string
 	Namespace        string
 	Version          string
+	Metadata         map[string]string
 	RegisterTTL      time.Duration
 	RegisterInterval time.Duration
 
+	// ShutdownTimeout bounds the wait for in-flight rpcs on stop
+	ShutdownTimeout time.Duration
+	// GracePeriod to wait between deregistering and refusing new rpcs
+	GracePeriod time.Duration
+
+	// Hooks run before the server starts draining and after it stopped
+	BeforeStop []func() error
+	AfterStop  []func() error
+
 	// TLSConfig specifies tls.Config for secure serving
 	TLSConfig *tls.Config
 
@@ -45,6 +56,7 @@ func newOptions(opt ...Option) Options {
 	opts := Options{
 		RegisterTTL:      DefaultRegisterTTL,
 		RegisterInterval: DefaultRegisterInterval,
+		ShutdownTimeout:  DefaultShutdownTimeout,
 	}
 
 	for _, o := range opt {
@@ -102,6 +114,14 @@ func Version(v string) Option {
 	}
 }
 
+// Metadata associated with the server node, e.g. the weight and zone
+// read by the client balancers
+func Metadata(md map[string]string) Option {
+	return func(o *Options) {
+		o.Metadata = md
+	}
+}
+
 // Address to bind to - host:port
 func Address(a string) Option {
 	return func(o *Options) {
@@ -146,6 +166,36 @@ func RegisterInterval(t time.Duration) Option {
 	}
 }
 
+// ShutdownTimeout to wait for in-flight rpcs to finish before the
+// server is stopped forcefully
+func ShutdownTimeout(t time.Duration) Option {
+	return func(o *Options) {
+		o.ShutdownTimeout = t
+	}
+}
+
+// GracePeriod to wait after deregistering so clients stop routing to
+// the server before it refuses new rpcs
+func GracePeriod(t time.Duration) Option {
+	return func(o *Options) {
+		o.GracePeriod = t
+	}
+}
+
+// BeforeStop runs fn before the server starts draining
+func BeforeStop(fn func() error) Option {
+	return func(o *Options) {
+		o.BeforeStop = append(o.BeforeStop, fn)
+	}
+}
+
+// AfterStop runs fn once the server has stopped
+func AfterStop(fn func() error) Option {
+	return func(o *Options) {
+		o.AfterStop = append(o.AfterStop, fn)
+	}
+}
+
 // Wait tells the server to wait for requests to finish before exiting
 // If `wg` is nil, server only wait for completion of rpc handler.
 // For user need finer grained control, pass a concrete `wg` here, server will
@@ -168,6 +218,7 @@ type maxMsgSizeKey struct{}
 type maxConnKey struct{}
 type tlsAuth struct{}
 type unaryServerInterceptors struct{}
+type streamServerInterceptors struct{}
 
 // AuthTLS should be used to setup a secure authentication using TLS
 func AuthTLS(t *tls.Config) Option {
@@ -197,6 +248,12 @@ func MaxMsgSize(s int) Option {
 	return setServerOption(maxMsgSizeKey{}, s)
 }
 
+// Interceptors to chain in front of every unary rpc handler
 func Interceptors(interceptors ...grpc.UnaryServerInterceptor) Option {
 	return setServerOption(unaryServerInterceptors{}, interceptors)
 }
+
+// StreamInterceptors to chain in front of every streaming rpc handler
+func StreamInterceptors(interceptors ...grpc.StreamServerInterceptor) Option {
+	return setServerOption(streamServerInterceptors{}, interceptors)
+}
@@ -10,6 +10,8 @@ import (
 	"golang.org/x/net/netutil"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"net"
 	"strings"
 	"sync"
@@ -28,6 +30,7 @@ const (
 
 type Server struct {
 	server *grpc.Server
+	health *health.Server
 	exit   chan chan error
 	//wg     *sync.WaitGroup
 	sync.RWMutex
@@ -39,8 +42,9 @@ type Server struct {
 func NewServer(opt ...Option) *Server {
 	opts := newOptions(opt...)
 	srv := Server{
-		opts: opts,
-		exit: make(chan chan error),
+		opts:   opts,
+		health: health.NewServer(),
+		exit:   make(chan chan error),
 	}
 	srv.configure()
 	return &srv
@@ -79,11 +83,18 @@ func (s *Server) configure(opts ...Option) {
 		srvOpts = append(srvOpts, grpc.ChainUnaryInterceptor(interceptors...))
 	}
 
+	if interceptors := s.getStreamInterceptors(); interceptors != nil {
+		srvOpts = append(srvOpts, grpc.ChainStreamInterceptor(interceptors...))
+	}
+
 	if gopts := s.getGrpcOptions(); gopts != nil {
 		srvOpts = append(srvOpts, gopts...)
 	}
 	s.server = grpc.NewServer(srvOpts...)
 
+	// serve the standard health service so clients can stop routing to
+	// this node before it goes away
+	healthpb.RegisterHealthServer(s.server, s.health)
 }
 
 func (s *Server) getCredentials() credentials.TransportCredentials {
@@ -107,6 +118,18 @@ func (s *Server) getInterceptors() []grpc.UnaryServerInterceptor {
 	return nil
 }
 
+func (s *Server) getStreamInterceptors() []grpc.StreamServerInterceptor {
+	if s.opts.Context == nil {
+		return nil
+	}
+
+	if v, ok := s.opts.Context.Value(streamServerInterceptors{}).([]grpc.StreamServerInterceptor); ok && v != nil {
+		return v
+	}
+
+	return nil
+}
+
 func (s *Server) getGrpcOptions() []grpc.ServerOption {
 	if s.opts.Context == nil {
 		return nil
@@ -188,6 +211,9 @@ func (s *Server) Start() error {
 		log.Errorf("Server register error: %v", err)
 	}
 
+	// mark serving again in case the server was stopped before
+	s.health.Resume()
+
 	go func() {
 		if err := s.server.Serve(ts); err != nil {
 			log.Errorf("gRPC Server start error: %v", err)
@@ -220,15 +246,31 @@ func (s *Server) Start() error {
 			}
 		}
 
+		var err error
+
+		// run the before stop hooks while still serving
+		for _, fn := range s.opts.BeforeStop {
+			if herr := fn(); herr != nil {
+				log.Errorf("Server before stop hook error: %v", herr)
+				err = herr
+			}
+		}
+
+		// flip every service to NOT_SERVING first so health checking
+		// clients move away while in-flight rpcs drain
+		s.health.Shutdown()
+
 		// deregister self
-		if err := s.deregister(); err != nil {
-			log.Error("Server deregister error: ", err)
+		if derr := s.deregister(); derr != nil {
+			log.Error("Server deregister error: ", derr)
 		}
 
-		// wait for waitgroup
-		//if s.wg != nil {
-		//	s.wg.Wait()
-		//}
+		// give clients time to notice the node is gone before
+		// refusing new rpcs
+		if s.opts.GracePeriod > time.Duration(0) {
+			log.Infof("Server waiting %v for clients to stop routing", s.opts.GracePeriod)
+			time.Sleep(s.opts.GracePeriod)
+		}
 
 		// stop the grpc server
 		exit := make(chan bool)
@@ -238,13 +280,23 @@ func (s *Server) Start() error {
 			close(exit)
 		}()
 
+		timer := time.NewTimer(s.opts.ShutdownTimeout)
 		select {
 		case <-exit:
-		case <-time.After(time.Second):
+		case <-timer.C:
+			log.Infof("Server graceful stop timed out after %v, forcing stop", s.opts.ShutdownTimeout)
 			s.server.Stop()
 		}
+		timer.Stop()
+
+		for _, fn := range s.opts.AfterStop {
+			if herr := fn(); herr != nil {
+				log.Errorf("Server after stop hook error: %v", herr)
+				err = herr
+			}
+		}
 
-		ch <- nil
+		ch <- err
 	}()
 
 	s.Lock()
@@ -279,6 +331,12 @@ func (s *Server) Server() *grpc.Server {
 	return s.server
 }
 
+// SetServingStatus sets the health status of a service, the empty service
+// name is the overall status of the server which clients check by default
+func (s *Server) SetServingStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	s.health.SetServingStatus(service, status)
+}
+
 func (s *Server) String() string {
 	return "grpc"
 }
@@ -350,16 +408,23 @@ func (s *Server) register() error {
 		return err
 	}
 
+	md := make(map[string]string, len(config.Metadata))
+	for k, v := range config.Metadata {
+		md[k] = v
+	}
+
 	// register service
 	node := &registry.Node{
-		Id:      config.Name + "-" + config.Id,
-		Address: mnet.HostPort(address, port),
+		Id:       config.Name + "-" + config.Id,
+		Address:  mnet.HostPort(address, port),
+		Metadata: md,
 	}
 
 	svc := &registry.Service{
-		Name:    s.opts.Name,
-		Version: s.opts.Version,
-		Nodes:   []*registry.Node{node},
+		Name:      s.opts.Name,
+		Version:   s.opts.Version,
+		Endpoints: s.endpoints(),
+		Nodes:     []*registry.Node{node},
 	}
 
 	s.RLock()
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fztcjjl/tiger/trpc/registry"
+	"github.com/fztcjjl/tiger/trpc/registry/memory"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestServerEndpoints(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Stop()
+	s := NewServer(Name("test.server"), Version("1.0.0"), Address("127.0.0.1:0"), Registry(r))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	svcs, err := r.GetService("test.server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 || len(svcs[0].Nodes) != 1 {
+		t.Fatalf("expected a single registered node, got %+v", svcs)
+	}
+
+	endpoints := make(map[string]*registry.Endpoint)
+	for _, ep := range svcs[0].Endpoints {
+		endpoints[ep.Name] = ep
+	}
+
+	check, ok := endpoints["grpc.health.v1.Health.Check"]
+	if !ok {
+		t.Fatalf("expected the health check endpoint, got %v", endpoints)
+	}
+	if check.Metadata["stream"] != "false" {
+		t.Errorf("expected check to be unary, got %v", check.Metadata)
+	}
+	if check.Request == nil || check.Request.Type != "grpc.health.v1.HealthCheckRequest" {
+		t.Errorf("unexpected check request %+v", check.Request)
+	}
+	if check.Response == nil || check.Response.Type != "grpc.health.v1.HealthCheckResponse" {
+		t.Errorf("unexpected check response %+v", check.Response)
+	}
+
+	watch, ok := endpoints["grpc.health.v1.Health.Watch"]
+	if !ok {
+		t.Fatalf("expected the health watch endpoint, got %v", endpoints)
+	}
+	if watch.Metadata["server_stream"] != "true" || watch.Metadata["client_stream"] != "false" {
+		t.Errorf("expected watch to be server streaming, got %v", watch.Metadata)
+	}
+}
+
+func TestServerHealthShutdown(t *testing.T) {
+	r := memory.NewRegistry()
+	defer r.Stop()
+	s := NewServer(
+		Name("test.health"),
+		Address("127.0.0.1:0"),
+		Registry(r),
+		GracePeriod(time.Second),
+		ShutdownTimeout(time.Second),
+	)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.Dial(s.Options().Address, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected SERVING got %v", rsp.Status)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Stop()
+	}()
+
+	// the status flips while the server still serves during the grace period
+	rsp, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("expected NOT_SERVING got %v", rsp.Status)
+	}
+
+	// deregistration follows the status change within the grace period
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := r.GetService("test.health"); err == registry.ErrNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the node to be deregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
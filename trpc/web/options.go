@@ -24,6 +24,15 @@ type Options struct {
 	RegisterTTL      time.Duration
 	RegisterInterval time.Duration
 
+	// ShutdownTimeout bounds the wait for in-flight requests on stop
+	ShutdownTimeout time.Duration
+	// GracePeriod to wait between deregistering and refusing new requests
+	GracePeriod time.Duration
+
+	// Hooks run before the server starts draining and after it stopped
+	BeforeStop []func() error
+	AfterStop  []func() error
+
 	Server  *http.Server
 	Handler http.Handler
 
@@ -47,6 +56,7 @@ func newOptions(opt ...Option) Options {
 		Address:          DefaultAddress,
 		RegisterTTL:      DefaultRegisterTTL,
 		RegisterInterval: DefaultRegisterInterval,
+		ShutdownTimeout:  DefaultShutdownTimeout,
 		StaticDir:        DefaultStaticDir,
 		Context:          context.TODO(),
 	}
@@ -73,6 +83,9 @@ var (
 	DefaultRegisterTTL      = time.Minute
 	DefaultRegisterInterval = time.Second * 30
 
+	// for shutdown
+	DefaultShutdownTimeout = time.Second * 10
+
 	// static directory
 	DefaultStaticDir = "html"
 	//DefaultRegisterCheck = func(context.Context) error { return nil }
@@ -196,3 +209,33 @@ func HttpServer(srv *http.Server) Option {
 		o.Server = srv
 	}
 }
+
+//ShutdownTimeout to wait for in-flight requests to finish before the
+//server is closed forcefully
+func ShutdownTimeout(t time.Duration) Option {
+	return func(o *Options) {
+		o.ShutdownTimeout = t
+	}
+}
+
+//GracePeriod to wait after deregistering so clients stop routing to
+//the server before it refuses new requests
+func GracePeriod(t time.Duration) Option {
+	return func(o *Options) {
+		o.GracePeriod = t
+	}
+}
+
+//BeforeStop runs fn before the server starts draining
+func BeforeStop(fn func() error) Option {
+	return func(o *Options) {
+		o.BeforeStop = append(o.BeforeStop, fn)
+	}
+}
+
+//AfterStop runs fn once the server has stopped
+func AfterStop(fn func() error) Option {
+	return func(o *Options) {
+		o.AfterStop = append(o.AfterStop, fn)
+	}
+}
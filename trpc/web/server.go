@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/fztcjjl/tiger/trpc/logger"
@@ -20,8 +21,9 @@ import (
 type Server struct {
 	opts Options
 
-	mux *http.ServeMux
-	srv *registry.Service
+	mux     *http.ServeMux
+	srv     *registry.Service
+	httpSrv *http.Server
 
 	sync.Mutex
 	running bool
@@ -85,30 +87,69 @@ func (s *Server) genSrv() *registry.Service {
 }
 
 func (s *Server) run() {
-	if s.opts.RegisterInterval <= time.Duration(0) {
-		return
+	var tick <-chan time.Time
+	if s.opts.RegisterInterval > time.Duration(0) {
+		t := time.NewTicker(s.opts.RegisterInterval)
+		defer t.Stop()
+		tick = t.C
 	}
 
-	t := time.NewTicker(s.opts.RegisterInterval)
 	// return error chan
 	var ch chan error
 
 Loop:
 	for {
 		select {
-		case <-t.C:
+		case <-tick:
 			s.register()
 		case ch = <-s.exit:
-			t.Stop()
 			break Loop
 		}
 	}
+
+	ch <- s.shutdown()
+}
+
+// shutdown deregisters the server and drains in-flight requests
+func (s *Server) shutdown() error {
+	var err error
+
+	// run the before stop hooks while still serving
+	for _, fn := range s.opts.BeforeStop {
+		if herr := fn(); herr != nil {
+			log.Errorf("Before stop hook error: %v", herr)
+			err = herr
+		}
+	}
+
 	// deregister self
-	if err := s.deregister(); err != nil {
-		log.Error("Server deregister error: ", err)
+	if derr := s.deregister(); derr != nil {
+		log.Error("Server deregister error: ", derr)
+	}
+
+	// give clients time to notice the node is gone before
+	// refusing new requests
+	if s.opts.GracePeriod > time.Duration(0) {
+		log.Infof("Waiting %v for clients to stop routing", s.opts.GracePeriod)
+		time.Sleep(s.opts.GracePeriod)
 	}
 
-	ch <- nil
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+	defer cancel()
+
+	if serr := s.httpSrv.Shutdown(ctx); serr != nil {
+		log.Infof("Graceful shutdown timed out after %v, closing: %v", s.opts.ShutdownTimeout, serr)
+		s.httpSrv.Close()
+	}
+
+	for _, fn := range s.opts.AfterStop {
+		if herr := fn(); herr != nil {
+			log.Errorf("After stop hook error: %v", herr)
+			err = herr
+		}
+	}
+
+	return err
 }
 
 func (s *Server) register() error {
@@ -191,8 +232,13 @@ func (s *Server) start() error {
 	}
 
 	httpSrv.Handler = h
+	s.httpSrv = httpSrv
 
-	go httpSrv.Serve(l)
+	go func() {
+		if err := httpSrv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Http Server serve error: %v", err)
+		}
+	}()
 
 	s.running = true
 